@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -57,3 +60,45 @@ func ConnectDB(config *Config) (*gorm.DB, error) {
 	return db, nil
 }
 
+
+// GetDuration reads a duration such as "30m" from the environment variable
+// key, falling back to def when it is unset or invalid
+func GetDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, def)
+		return def
+	}
+	return d
+}
+
+// GetFloat reads a number from the environment variable key, falling back to
+// def when it is unset or invalid
+func GetFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Printf("Invalid %s %q, using %v", key, value, def)
+		return def
+	}
+	return f
+}
+
+// GetList reads a comma separated list from the environment variable key,
+// empty when it is unset
+func GetList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
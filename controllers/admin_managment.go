@@ -1,7 +1,7 @@
 package controllers
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 
 	"github.com/Ukkenjijo/trendtrek/database"
@@ -9,6 +9,7 @@ import (
 	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm/clause"
 )
 
 func AdminLogin(c *fiber.Ctx) error {
@@ -39,18 +40,15 @@ func AdminLogin(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "You are not an authorized user"})
 	}
 
-	// Generate JWT token
-	token, err := utils.GenerateJWT(user)
+	// Start a session and generate its tokens
+	tokens, err := issueSession(c, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
 	}
-	log.Println("tokenlogin", token)
 
-	// Return the token and user info
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message": "Login successful",
-		"token":   token,
-	})
+	// Return the tokens
+	tokens["message"] = "Login successful"
+	return c.Status(fiber.StatusOK).JSON(tokens)
 
 }
 
@@ -125,6 +123,12 @@ func BlockUser(c *fiber.Ctx) error {
 			"error": "Failed to update user status",
 		})
 	}
+	// Log the user out everywhere
+	if err := revokeUserSessions(database.DB, user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke user sessions",
+		})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "User has been blocked",
@@ -382,13 +386,44 @@ func UpdateOrderStatus(c *fiber.Ctx) error {
 			"error": "Failed to parse request",
 		})
 	}
-    if err:=database.DB.First(&order,orderID).Error;err!=nil{
+    tx := database.DB.Begin()
+    defer tx.Rollback()
+    if err:=tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&order,orderID).Error;err!=nil{
         return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
             "error": "Order not found",
         })
     }
-    order.Status=req.Status
-    if err:=database.DB.Save(&order).Error;err!=nil{
+    // Canceling or returning refunds the whole order, so every item still in
+    // it must follow
+    refunds := models.RefundsOnEntry(req.Status)
+    if refunds {
+        if blocked := blockedItems(order.Items, req.Status, models.RoleAdmin); len(blocked) > 0 {
+            return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+                "error": fmt.Sprintf("Some items of this order cannot be moved to %s", req.Status),
+                "items": blocked,
+            })
+        }
+    }
+    admin := ctxActor(c, models.RoleAdmin)
+    if err := transitionOrder(tx, &order, req.Status, admin, "", models.RefundMethodWallet); err != nil {
+        return transitionError(c, err, "Failed to update order")
+    }
+    // Canceled items refund themselves, a return refunds the whole order
+    if order.Status == models.OrderStatusCanceled {
+        if err := voidPayment(tx, order.ID, admin); err != nil {
+            return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+                "error": "Failed to cancel payment",
+            })
+        }
+    } else if refunds {
+        if _, err := refundOrder(tx, order, nil, order.TotalAmount, models.RefundMethodWallet, fmt.Sprintf("Order %s by admin", order.Status)); err != nil {
+            return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+                "error": "Failed to refund order",
+            })
+        }
+    }
+    pushOrderStatus(tx, order.ID, "Your order", order.Status)
+    if err := tx.Commit().Error; err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Failed to update order",
         })
@@ -399,3 +434,28 @@ func UpdateOrderStatus(c *fiber.Ctx) error {
 
 }
 
+
+// GetOrderDetailsAdmin returns an order with its items and full timeline
+func GetOrderDetailsAdmin(c *fiber.Ctx) error {
+	orderID := c.Params("order_id")
+
+	var order models.Order
+	if err := database.DB.Preload("Items").Preload("SubOrders").First(&order, orderID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Order not found",
+		})
+	}
+
+	timeline, err := orderTimeline(database.DB, order.ID, nil)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve order timeline",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":  "Order details retrieved successfully",
+		"order":    order,
+		"timeline": timeline,
+	})
+}
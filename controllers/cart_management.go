@@ -13,13 +13,18 @@ import (
 	"gorm.io/gorm"
 )
 
+// maxCartQuantity is how many units of one product or variant a cart may hold
+const maxCartQuantity = 5
+
 func AddToCart(c *fiber.Ctx) error {
 	userId := c.Locals("user_id")
 
 	// Parse request body
 	cartItemRequest := new(struct {
-		ProductID uint `json:"product_id" validate:"required"`
-		Quantity  int  `json:"quantity" validate:"required,gte=1"`
+		ProductID uint  `json:"product_id" validate:"required"`
+		VariantID *uint `json:"variant_id"`
+		Quantity  int   `json:"quantity" validate:"required,gte=1"`
+		SearchID  *uint `json:"search_id"` // Search the product was found through
 	})
 	log.Println(cartItemRequest)
 	if err := c.BodyParser(cartItemRequest); err != nil {
@@ -42,31 +47,28 @@ func AddToCart(c *fiber.Ctx) error {
 		}
 	}
 
-	// Find the product in the database with the offers
+	// Find the product in the database and the variant being bought
 	var product models.Product
-	if err := database.DB.Preload("Offer").First(&product, cartItemRequest.ProductID).Error; err != nil {
+	if err := database.DB.First(&product, cartItemRequest.ProductID).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
 	}
-	//Calculate the offer based on the product offer
-	originalPrice := product.Price
-	discountedPrice := originalPrice
-	var discountPercentage *float64
-
-	if product.Offer != nil && product.Offer.DiscountPercentage > 0 {
-
-		discountPercentage = &product.Offer.DiscountPercentage
-		discountedPrice = originalPrice * (1 - *discountPercentage/100)
+	variant, err := resolveVariant(database.DB, product, cartItemRequest.VariantID)
+	if err != nil {
+		return variantError(c, err)
 	}
+	//Calculate the offer based on the product or variant offer
+	originalPrice, discountedPrice, discountPercentage := linePrice(database.DB, product, variant)
+	stock := availableStock(database.DB, product, variant)
 
 	// Check stock availability
-	if cartItemRequest.Quantity > product.StockQuantity {
+	if cartItemRequest.Quantity > stock {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Not enough stock available",
 		})
 	}
 
 	// Check maximum quantity per user
-	maxQuantityPerUser := 5 // For example, limit each user to 5 units of each product
+	maxQuantityPerUser := maxCartQuantity
 	if cartItemRequest.Quantity > maxQuantityPerUser {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("Maximum %d of this product can be added to cart", maxQuantityPerUser),
@@ -76,9 +78,9 @@ func AddToCart(c *fiber.Ctx) error {
 	// Calculate total price
 	totalPrice := float64(cartItemRequest.Quantity) * discountedPrice
 
-	// Check if the product is already in the user's cart
+	// Check if the product or variant is already in the user's cart
 	var existingCartItem models.CartItem
-	if err := database.DB.Where("cart_id = ? AND product_id = ?", cart.ID, cartItemRequest.ProductID).First(&existingCartItem).Error; err == nil {
+	if err := cartLineQuery(database.DB, cart.ID, cartItemRequest.ProductID, variantID(variant)).First(&existingCartItem).Error; err == nil {
 		// Update the quantity of the existing cart item
 		existingCartItem.Quantity += cartItemRequest.Quantity
 		if existingCartItem.Quantity > maxQuantityPerUser {
@@ -86,17 +88,27 @@ func AddToCart(c *fiber.Ctx) error {
 				"error": fmt.Sprintf("Cannot exceed %d of this product in your cart", maxQuantityPerUser),
 			})
 		}
-		if existingCartItem.Quantity > product.StockQuantity {
+		if existingCartItem.Quantity > stock {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Not enough stock available"})
 		}
 
-		// Update the total price for the item
+		// Update the price and total price for the item. The price agreed
+		// for the line stands until the customer acknowledges a change.
+		if existingCartItem.AgreedPrice == 0 {
+			existingCartItem.AgreedPrice = existingCartItem.DiscountedPrice
+		}
+		existingCartItem.Price = originalPrice
+		existingCartItem.DiscountedPrice = discountedPrice
+		existingCartItem.DiscountPercentage = discountPercentage
 		existingCartItem.TotalPrice = float64(existingCartItem.Quantity) * discountedPrice
 
 		// Save the updated cart item
 		if err := database.DB.Save(&existingCartItem).Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart item"})
 		}
+		if cartItemRequest.SearchID != nil {
+			markSearchAddToCart(database.DB, *cartItemRequest.SearchID, &cart.UserID)
+		}
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Cart item updated successfully"})
 	}
 
@@ -104,15 +116,20 @@ func AddToCart(c *fiber.Ctx) error {
 	newCartItem := models.CartItem{
 		CartID:             cart.ID,
 		ProductID:          cartItemRequest.ProductID,
+		VariantID:          variantID(variant),
 		Quantity:           cartItemRequest.Quantity,
-		Price:              product.Price,
+		Price:              originalPrice,
 		DiscountedPrice:    discountedPrice,
+		AgreedPrice:        discountedPrice,
 		DiscountPercentage: discountPercentage,
 		TotalPrice:         totalPrice,
 	}
 	if err := database.DB.Create(&newCartItem).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add to cart"})
 	}
+	if cartItemRequest.SearchID != nil {
+		markSearchAddToCart(database.DB, *cartItemRequest.SearchID, &cart.UserID)
+	}
 
 	var newcart models.Cart
 	if err := database.DB.Preload("Items").Where("user_id = ?", userId).First(&newcart).Error; err != nil {
@@ -121,67 +138,30 @@ func AddToCart(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Product added to cart"})
 }
 
+// ListCartItems shows the cart repriced from current product and offer data.
+// Each item has a status (available, low_stock, insufficient_stock or
+// unavailable) and price_changes lists the items whose price moved since they
+// were added; those must be acknowledged when placing the order.
 func ListCartItems(c *fiber.Ctx) error {
 	userId := c.Locals("user_id")
 
 	var cart models.Cart
-	if err := database.DB.Preload("Items", func(db *gorm.DB) *gorm.DB {
-		return db.Preload("Product",func(db *gorm.DB) *gorm.DB {
-			return db.Preload("Images")
-		})
-	}).Where("user_id = ?", userId).First(&cart).Error; err != nil {
+	if err := database.DB.Where("user_id = ?", userId).First(&cart).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
 	}
 
-	//calculate the total price before discount
-	var totalAmount, product_discount float64
-	for _, item := range cart.Items {
-		totalAmount += item.TotalPrice
-		product_discount += (item.Price - item.DiscountedPrice) * float64(item.Quantity)
-	}
-
-	cart.CartTotal = totalAmount
-
-	if err := database.DB.Save(&cart).Error; err != nil {
+	// Reprice every item and apply the coupon if the cart still qualifies
+	review, err := repriceCart(database.DB, &cart)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
 	}
 
-	//Initalize the discount and total amount
-	var discount float64
-	finalamount := totalAmount
-	//Apply a coupon if there is one
-	if cart.CouponID != nil {
-		var coupon models.Coupon
-		if err := database.DB.First(&coupon, cart.CouponID).Error; err == nil {
-			//Check minimum purchase requirment
-			if totalAmount >= coupon.MinPurchaseAmount {
-				discount = (totalAmount * coupon.Discount / 100)
-
-			} else {
-				discount = 0.0
-			}
-			finalamount = totalAmount - discount
-
-			cart.CartTotal = finalamount
-			cart.CouponDiscount = discount
-			if err := database.DB.Save(&cart).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
-			}
-		} else {
-			//If minimum purchse amount is not met ignore coupon
-			cart.CouponID = nil
-			cart.CartTotal = totalAmount
-			if err := database.DB.Save(&cart).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
-			}
-		}
-	}
-
 	//create a response struct to display cart
 	var itemsResponse []fiber.Map
-	for _, item := range cart.Items {
+	for _, line := range review.Lines {
+		item := line.Item
 
-		itemsResponse = append(itemsResponse, fiber.Map{
+		itemResponse := fiber.Map{
 			"id":            item.ID,
 			"product_id":    item.ProductID,
 			"quantity":      item.Quantity,
@@ -189,19 +169,60 @@ func ListCartItems(c *fiber.Ctx) error {
 			"total_price":   fmt.Sprintf("%.2f", item.TotalPrice),
 			"total_discount": math.RoundToEven(item.Price-item.DiscountedPrice) * float64(item.Quantity),
 			"product_name":  item.Product.Name,
-			"product_image": item.Product.Images[0].URL,
-		})
+			"product_image": cartItemImage(item),
+			"status":        line.Status,
+		}
+		if line.Status == cartLineLowStock || line.Status == cartLineInsufficientStock {
+			itemResponse["stock_left"] = line.Stock
+		}
+		if line.Variant != nil {
+			itemResponse["variant_id"] = line.Variant.ID
+			itemResponse["sku"] = line.Variant.SKU
+			itemResponse["variant"] = line.Variant.Label()
+		}
+		itemsResponse = append(itemsResponse, itemResponse)
 
 	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"items":            itemsResponse,
 		"total_amount":     fmt.Sprintf("%.2f", cart.CartTotal),
 		"coupon_discount":  fmt.Sprintf("%.2f", cart.CouponDiscount),
-		"toatl_product_discounts": fmt.Sprintf("%.2f", product_discount),
-		"total_items":      len(cart.Items),
+		"toatl_product_discounts": fmt.Sprintf("%.2f", review.ProductDiscount),
+		"total_items":      len(review.Lines),
+		"price_changes":    review.PriceChanges,
+		"can_checkout":     review.orderable(),
 	})
 }
 
+// AcknowledgeCartPrices accepts price changes of the cart so they no longer
+// need to be acknowledged when placing the order. It returns the changes
+// still waiting for acknowledgement.
+func AcknowledgeCartPrices(c *fiber.Ctx) error {
+	userId := c.Locals("user_id")
+
+	req := new(models.PriceAcknowledgementRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var cart models.Cart
+	if err := database.DB.Where("user_id = ?", userId).First(&cart).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	}
+	review, err := repriceCart(database.DB, &cart)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
+	}
+	pending, err := acknowledgePrices(database.DB, review.PriceChanges, req.AcknowledgedPrices)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Prices acknowledged", "price_changes": pending})
+}
+
 func UpdateCartQuantity(c *fiber.Ctx) error {
 	userId := c.Locals("user_id")
 	productId := c.Params("id")
@@ -227,38 +248,41 @@ func UpdateCartQuantity(c *fiber.Ctx) error {
 
 	// Find the product and cart item
 	var product models.Product
-	if err := database.DB.Preload("Offer").First(&product, productId).Error; err != nil {
+	if err := database.DB.First(&product, productId).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
 	}
 
 	var cartItem models.CartItem
-	if err := database.DB.Where("cart_id = ? AND product_id = ?", cart.ID, productId).First(&cartItem).Error; err != nil {
+	if err := cartLineQuery(database.DB, cart.ID, product.ID, queryVariantID(c)).First(&cartItem).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found in cart"})
 	}
+	variant, err := resolveVariant(database.DB, product, cartItem.VariantID)
+	if err != nil {
+		return variantError(c, err)
+	}
 
 	// Check if the new quantity exceeds stock or max quantity per user
-	if cartItemRequest.Quantity > product.StockQuantity {
+	if cartItemRequest.Quantity > availableStock(database.DB, product, variant) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Not enough stock available"})
 	}
-	maxQuantityPerUser := 5
+	maxQuantityPerUser := maxCartQuantity
 	if cartItemRequest.Quantity > maxQuantityPerUser {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("Maximum %d of this product can be added to cart", maxQuantityPerUser),
 		})
 	}
 
-	//Calculate the offer based on the product offer
-	originalPrice := product.Price
-	discountedPrice := originalPrice
-	var discountPercentage *float64
+	//Calculate the offer based on the product or variant offer
+	originalPrice, discountedPrice, discountPercentage := linePrice(database.DB, product, variant)
 
-	if product.Offer != nil && product.Offer.DiscountPercentage > 0 {
-
-		discountPercentage = &product.Offer.DiscountPercentage
-		discountedPrice = originalPrice * (1 - *discountPercentage/100)
+	// Update the cart item's quantity and total price, keeping the price
+	// the customer agreed to until they acknowledge a change
+	if cartItem.AgreedPrice == 0 {
+		cartItem.AgreedPrice = cartItem.DiscountedPrice
 	}
-
-	// Update the cart item's quantity and total price
+	cartItem.Price = originalPrice
+	cartItem.DiscountedPrice = discountedPrice
+	cartItem.DiscountPercentage = discountPercentage
 	cartItem.Quantity = cartItemRequest.Quantity
 	cartItem.TotalPrice = float64(cartItem.Quantity) * discountedPrice
 
@@ -281,7 +305,7 @@ func RemoveFromCart(c *fiber.Ctx) error {
 
 	// Find the cart item in the database
 	var cartItem models.CartItem
-	if err := database.DB.Where("cart_id = ? AND product_id = ?", cart.ID, productId).First(&cartItem).Error; err != nil {
+	if err := cartLineQuery(database.DB, cart.ID, productId, queryVariantID(c)).First(&cartItem).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found in cart"})
 	}
 
@@ -302,3 +326,42 @@ func RemoveFromCart(c *fiber.Ctx) error {
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Product removed from cart"})
 }
+
+// cartLineQuery finds the cart line of a product, or of one of its variants
+// when variantID is set
+func cartLineQuery(tx *gorm.DB, cartID uint, productID interface{}, variantID *uint) *gorm.DB {
+	query := tx.Where("cart_id = ? AND product_id = ?", cartID, productID)
+	if variantID != nil {
+		return query.Where("variant_id = ?", *variantID)
+	}
+	return query.Where("variant_id IS NULL")
+}
+
+// queryVariantID reads the optional variant_id query parameter
+func queryVariantID(c *fiber.Ctx) *uint {
+	id := c.QueryInt("variant_id")
+	if id <= 0 {
+		return nil
+	}
+	variantID := uint(id)
+	return &variantID
+}
+
+// variantID returns the ID of variant, or nil for products without variants
+func variantID(variant *models.ProductVariant) *uint {
+	if variant == nil {
+		return nil
+	}
+	return &variant.ID
+}
+
+// cartItemImage prefers the picture of the chosen variant
+func cartItemImage(item models.CartItem) string {
+	if item.Variant != nil && len(item.Variant.Images) > 0 {
+		return item.Variant.Images[0].URL
+	}
+	if len(item.Product.Images) > 0 {
+		return item.Product.Images[0].URL
+	}
+	return ""
+}
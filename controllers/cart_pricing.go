@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+)
+
+// Availability of a cart line when the cart is repriced
+const (
+	cartLineAvailable         = "available"
+	cartLineLowStock          = "low_stock"          // Can be ordered, few units left
+	cartLineInsufficientStock = "insufficient_stock" // Fewer units left than in the cart
+	cartLineUnavailable       = "unavailable"        // Deleted, deactivated or sold out
+)
+
+// cartLine is a cart item checked against the current product, offer and
+// stock data
+type cartLine struct {
+	Item    models.CartItem
+	Variant *models.ProductVariant
+	Status  string
+	Stock   int // Units left to sell
+}
+
+// priceChange is a cart line whose unit price moved since the customer agreed
+// to it
+type priceChange struct {
+	ItemID      uint    `json:"item_id"`
+	ProductID   uint    `json:"product_id"`
+	VariantID   *uint   `json:"variant_id,omitempty"`
+	ProductName string  `json:"product_name"`
+	OldPrice    float64 `json:"old_price"`
+	NewPrice    float64 `json:"new_price"`
+}
+
+// cartReview is a cart repriced from current data
+type cartReview struct {
+	Lines           []cartLine
+	PriceChanges    []priceChange
+	Total           float64 // Available lines at current prices
+	ProductDiscount float64
+	CouponDiscount  float64
+}
+
+// orderable reports whether every line of the cart can be ordered as it is
+func (r *cartReview) orderable() bool {
+	for _, line := range r.Lines {
+		if line.Status == cartLineUnavailable || line.Status == cartLineInsufficientStock {
+			return false
+		}
+	}
+	return true
+}
+
+// cartLowStock is the stock at or below which a line is flagged low_stock
+func cartLowStock() int {
+	return int(config.GetFloat("CART_LOW_STOCK_THRESHOLD", 5))
+}
+
+// pricesDiffer compares unit prices to the cent
+func pricesDiffer(a, b float64) bool {
+	return math.Abs(a-b) >= 0.005
+}
+
+// repriceCart prices every line of cart from the current product, variant and
+// offer data, checks that it can still be bought and saves the new prices
+// and totals. Unavailable lines stay in the cart but are left out of the
+// totals. Lines whose price differs from the one the customer agreed to are
+// reported as price changes.
+func repriceCart(tx *gorm.DB, cart *models.Cart) (*cartReview, error) {
+	var items []models.CartItem
+	if err := tx.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped().Preload("Images")
+	}).Preload("Variant", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped().Preload("Values").Preload("Images")
+	}).Where("cart_id = ?", cart.ID).Order("id").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	review, err := reviewCartLines(tx, items)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range review.Lines {
+		if line.Status == cartLineUnavailable {
+			continue
+		}
+		item := line.Item
+		if err := tx.Model(&models.CartItem{}).Where("id = ?", item.ID).Updates(map[string]interface{}{
+			"price":               item.Price,
+			"discounted_price":    item.DiscountedPrice,
+			"discount_percentage": item.DiscountPercentage,
+			"total_price":         item.TotalPrice,
+			"agreed_price":        item.AgreedPrice,
+		}).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the coupon if the cart still qualifies
+	if cart.CouponID != nil {
+		var coupon models.Coupon
+		if err := tx.First(&coupon, cart.CouponID).Error; err == nil {
+			if review.Total >= coupon.MinPurchaseAmount {
+				review.CouponDiscount = review.Total * coupon.Discount / 100
+			}
+		} else {
+			cart.CouponID = nil
+		}
+	}
+	cart.CartTotal = review.Total - review.CouponDiscount
+	cart.CouponDiscount = review.CouponDiscount
+	if err := tx.Model(cart).Updates(map[string]interface{}{
+		"cart_total":      cart.CartTotal,
+		"coupon_discount": cart.CouponDiscount,
+		"coupon_id":       cart.CouponID,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+// reviewCartLines prices cart lines, loaded with their product and variant,
+// from current data without saving anything. Guest carts are priced with it
+// too.
+func reviewCartLines(tx *gorm.DB, items []models.CartItem) (*cartReview, error) {
+	review := &cartReview{PriceChanges: []priceChange{}}
+	for _, item := range items {
+		line := cartLine{Item: item, Variant: item.Variant, Status: cartLineUnavailable}
+		product := item.Product
+		if product.ID == 0 || product.DeletedAt.Valid || !product.IsActive {
+			review.Lines = append(review.Lines, line)
+			continue
+		}
+		variant, err := resolveVariant(tx, product, item.VariantID)
+		if err != nil {
+			if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) {
+				review.Lines = append(review.Lines, line)
+				continue
+			}
+			return nil, err
+		}
+		if variant != nil {
+			line.Variant = variant
+		}
+
+		line.Stock = availableStock(tx, product, variant)
+		switch {
+		case line.Stock <= 0:
+			review.Lines = append(review.Lines, line)
+			continue
+		case line.Stock < item.Quantity:
+			line.Status = cartLineInsufficientStock
+		case line.Stock <= cartLowStock():
+			line.Status = cartLineLowStock
+		default:
+			line.Status = cartLineAvailable
+		}
+
+		// Lines added before prices were agreed on count the stored price
+		if item.AgreedPrice == 0 {
+			item.AgreedPrice = item.DiscountedPrice
+		}
+		price, discounted, discountPercentage := linePrice(tx, product, variant)
+		if pricesDiffer(discounted, item.AgreedPrice) {
+			review.PriceChanges = append(review.PriceChanges, priceChange{
+				ItemID:      item.ID,
+				ProductID:   item.ProductID,
+				VariantID:   item.VariantID,
+				ProductName: product.Name,
+				OldPrice:    item.AgreedPrice,
+				NewPrice:    discounted,
+			})
+		}
+		item.Price = price
+		item.DiscountedPrice = discounted
+		item.DiscountPercentage = discountPercentage
+		item.TotalPrice = float64(item.Quantity) * discounted
+		line.Item = item
+		review.Lines = append(review.Lines, line)
+		review.Total += item.TotalPrice
+		review.ProductDiscount += (item.Price - item.DiscountedPrice) * float64(item.Quantity)
+	}
+	return review, nil
+}
+
+// lockCartStock locks the stock rows of every line of a cart, in stockRowLess
+// order, until the transaction ends. Repricing the cart afterwards in the
+// same transaction sees stock that checkouts of the same products cannot
+// change.
+func lockCartStock(tx *gorm.DB, cartID uint) error {
+	var items []models.CartItem
+	if err := tx.Select("product_id", "variant_id").Where("cart_id = ?", cartID).Find(&items).Error; err != nil {
+		return err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return stockRowLess(items[i].ProductID, items[i].VariantID, items[j].ProductID, items[j].VariantID)
+	})
+	for _, item := range items {
+		if _, err := lockedStock(tx, item.ProductID, item.VariantID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acknowledgePrices records the price changes the customer accepted as the
+// agreed price of their lines, so they are not reported again unless the
+// price moves once more
+func acknowledgePrices(tx *gorm.DB, changes []priceChange, acknowledged map[uint]float64) ([]priceChange, error) {
+	pending := []priceChange{}
+	for _, change := range changes {
+		if price, ok := acknowledged[change.ItemID]; !ok || pricesDiffer(price, change.NewPrice) {
+			pending = append(pending, change)
+			continue
+		}
+		if err := tx.Model(&models.CartItem{}).Where("id = ?", change.ItemID).Update("agreed_price", change.NewPrice).Error; err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// unacknowledgedPriceChanges returns the price changes the customer has not
+// accepted. acknowledged maps cart item IDs to the new price the customer
+// saw; a price that moved again since then needs a new acknowledgement.
+func unacknowledgedPriceChanges(changes []priceChange, acknowledged map[uint]float64) []priceChange {
+	pending := []priceChange{}
+	for _, change := range changes {
+		if price, ok := acknowledged[change.ItemID]; !ok || pricesDiffer(price, change.NewPrice) {
+			pending = append(pending, change)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// setupCheckoutDB connects to the database in TEST_DATABASE_DSN and migrates
+// it. Tests needing a database are skipped when it is not set.
+func setupCheckoutDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// checkoutFixture is a customer with one product worth 1000 in their cart
+type checkoutFixture struct {
+	user    models.User
+	address models.Address
+	product models.Product
+	cart    models.Cart
+}
+
+func newCheckoutFixture(t *testing.T, db *gorm.DB) checkoutFixture {
+	t.Helper()
+	suffix := time.Now().UnixNano()
+	var f checkoutFixture
+	f.user = models.User{Name: "Checkout Customer", Email: fmt.Sprintf("customer%d@example.com", suffix), PhoneNumber: fmt.Sprintf("c%d", suffix), HashedPassword: "unused", Verified: true}
+	seller := models.User{Name: "Checkout Seller", Email: fmt.Sprintf("seller%d@example.com", suffix), PhoneNumber: fmt.Sprintf("s%d", suffix), HashedPassword: "unused", Verified: true, Role: "seller"}
+	for _, user := range []*models.User{&f.user, &seller} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	store := models.Store{Name: "Checkout Store", UserID: seller.ID}
+	if err := db.Create(&store).Error; err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	category := models.Category{Name: "Checkout", IsActive: true}
+	if err := db.Create(&category).Error; err != nil {
+		t.Fatalf("create category: %v", err)
+	}
+	f.product = models.Product{StoreID: store.ID, Name: "Checkout Shirt", Price: 500, StockQuantity: 10, StockLeft: 10, CategoryID: category.ID, IsActive: true}
+	if err := db.Create(&f.product).Error; err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	f.address = models.Address{UserID: f.user.ID, Street: "1 Test Street", City: "Kochi", State: "Kerala", Country: "India", ZipCode: "682001"}
+	if err := db.Create(&f.address).Error; err != nil {
+		t.Fatalf("create address: %v", err)
+	}
+	f.cart = models.Cart{UserID: f.user.ID, CartTotal: 1000}
+	if err := db.Create(&f.cart).Error; err != nil {
+		t.Fatalf("create cart: %v", err)
+	}
+	item := models.CartItem{CartID: f.cart.ID, ProductID: f.product.ID, Quantity: 2, Price: 500, DiscountedPrice: 500, AgreedPrice: 500, TotalPrice: 1000}
+	if err := db.Create(&item).Error; err != nil {
+		t.Fatalf("create cart item: %v", err)
+	}
+	return f
+}
+
+// checkoutApp serves the checkout routes with userID logged in
+func checkoutApp(userID uint) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user_id", float64(userID))
+		return c.Next()
+	})
+	app.Post("/checkout", PlaceOrder)
+	app.Post("/verify", VerfyRazorpayPayment)
+	return app
+}
+
+func postJSON(t *testing.T, app *fiber.App, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func TestRazorpayCheckoutWithMockGateway(t *testing.T) {
+	db := setupCheckoutDB(t)
+	database.DB = db
+	mock := utils.NewMockProvider("test_secret")
+	PaymentGateway = mock
+
+	f := newCheckoutFixture(t, db)
+	app := checkoutApp(f.user.ID)
+
+	status, placed := postJSON(t, app, "/checkout", models.OrderRequest{AddressID: fmt.Sprint(f.address.ID), PaymentMode: "razorpay"})
+	if status != fiber.StatusOK {
+		t.Fatalf("place order: status %d, body %v", status, placed)
+	}
+	gatewayOrderID, _ := placed["razorpay_order_id"].(string)
+	if gatewayOrderID == "" {
+		t.Fatalf("place order: no razorpay_order_id in %v", placed)
+	}
+	if amount, _ := placed["amount"].(float64); amount != 1000 {
+		t.Fatalf("place order: amount %v, want 1000", placed["amount"])
+	}
+	orderID := uint(placed["order_id"].(float64))
+
+	var reservation models.StockReservation
+	if err := db.Where("order_id = ?", orderID).First(&reservation).Error; err != nil {
+		t.Fatalf("load reservation: %v", err)
+	}
+	if reservation.Status != models.ReservationActive || reservation.Quantity != 2 {
+		t.Fatalf("reservation = %s of %d, want active of 2", reservation.Status, reservation.Quantity)
+	}
+
+	paymentID, signature, err := mock.Pay(gatewayOrderID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	forged := models.RAZORPAY_Payment{RazorpayOrderID: gatewayOrderID, RazorpayPaymentID: paymentID, RazorpaySignature: "forged"}
+	if status, body := postJSON(t, app, "/verify", forged); status != fiber.StatusUnauthorized {
+		t.Fatalf("verify with a forged signature: status %d, body %v", status, body)
+	}
+	paid := models.RAZORPAY_Payment{RazorpayOrderID: gatewayOrderID, RazorpayPaymentID: paymentID, RazorpaySignature: signature}
+	if status, body := postJSON(t, app, "/verify", paid); status != fiber.StatusOK {
+		t.Fatalf("verify: status %d, body %v", status, body)
+	}
+
+	var payment models.Payment
+	if err := db.Where("order_id = ?", orderID).First(&payment).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if payment.PaymentStatus != "paid" || payment.GatewayPaymentID != paymentID {
+		t.Fatalf("payment = %s by %q, want paid by %s", payment.PaymentStatus, payment.GatewayPaymentID, paymentID)
+	}
+	var product models.Product
+	if err := db.First(&product, f.product.ID).Error; err != nil {
+		t.Fatalf("load product: %v", err)
+	}
+	if product.StockQuantity != 8 {
+		t.Fatalf("stock = %d, want 8", product.StockQuantity)
+	}
+	if err := db.First(&reservation, reservation.ID).Error; err != nil {
+		t.Fatalf("reload reservation: %v", err)
+	}
+	if reservation.Status != models.ReservationConverted {
+		t.Fatalf("reservation = %s, want converted", reservation.Status)
+	}
+	var carts int64
+	db.Model(&models.Cart{}).Where("id = ?", f.cart.ID).Count(&carts)
+	if carts != 0 {
+		t.Fatal("the cart was not cleared after the payment")
+	}
+}
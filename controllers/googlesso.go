@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 
@@ -10,10 +11,10 @@ import (
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
-	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"gorm.io/gorm"
 )
 
 var ClientID = os.Getenv("GOOGLE_CLIENT_ID")
@@ -90,6 +91,9 @@ func GoogleCallback(c *fiber.Ctx) error {
 	// Check if the user already exists in your database, if not create a new user
 	var user models.User
 	if err := database.DB.Where("email = ?", userInfo.Email).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch users"})
+		}
 		// Create a new user if not found
 		user = models.User{
 			Email:          userInfo.Email,
@@ -97,23 +101,29 @@ func GoogleCallback(c *fiber.Ctx) error {
 			ProfilePicture: userInfo.Picture,
 			Verified:       true,
 		}
-		database.DB.Create(&user)
-	} else {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to fetch users"})
+		if err := database.DB.Create(&user).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create user"})
+		}
+	}
+	if user.Blocked {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "user is not authorized to access",
+		})
 	}
 
-	// Generate a JWT token for the user
-	jwtToken, err := utils.GenerateJWT(user)
+	// Start a session and generate its tokens
+	tokens, err := issueSession(c, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate JWT",
 		})
 	}
 
-	// Return the JWT token to the client
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message": "User authenticated successfully",
-		"token":   jwtToken,
-		"user":    user,
-	})
+	// Move the cart built before logging in into the user's cart
+	mergeGuestCartOnLogin(c, user, tokens)
+
+	// Return the tokens to the client
+	tokens["message"] = "User authenticated successfully"
+	tokens["user"] = user
+	return c.Status(fiber.StatusOK).JSON(tokens)
 }
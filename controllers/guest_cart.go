@@ -0,0 +1,477 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The cart token is sent in a header by API clients. Browsers also get it as
+// a cookie, which is what reaches the Google login callback.
+const (
+	cartTokenHeader = "X-Cart-Token"
+	cartTokenCookie = "cart_token"
+)
+
+// guestCartTTL is how long a guest cart is kept after its last change
+func guestCartTTL() time.Duration {
+	return config.GetDuration("GUEST_CART_TTL", 30*24*time.Hour)
+}
+
+// guestCartToken reads the cart token of the request
+func guestCartToken(c *fiber.Ctx) string {
+	if token := c.Get(cartTokenHeader); token != "" {
+		return token
+	}
+	return c.Cookies(cartTokenCookie)
+}
+
+// setCartTokenCookie hands the cart token to browsers
+func setCartTokenCookie(c *fiber.Ctx, token string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     cartTokenCookie,
+		Value:    token,
+		Path:     "/api/v1/user",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// findGuestCart loads the unexpired guest cart of token
+func findGuestCart(tx *gorm.DB, token string) (*models.GuestCart, error) {
+	if token == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var cart models.GuestCart
+	if err := tx.Where("token_hash = ? AND expires_at > ?", utils.HashToken(token), time.Now()).First(&cart).Error; err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// guestCartFor returns the guest cart of the request and its token, starting
+// a new cart when the request has none. The cart's expiry is pushed back.
+func guestCartFor(c *fiber.Ctx) (*models.GuestCart, string, error) {
+	expires := time.Now().Add(guestCartTTL())
+	token := guestCartToken(c)
+	cart, err := findGuestCart(database.DB, token)
+	switch {
+	case err == nil:
+		if err := touchGuestCart(c, cart, token); err != nil {
+			return nil, "", err
+		}
+		return cart, token, nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		var hash string
+		if token, hash, err = utils.GenerateGuestCartToken(); err != nil {
+			return nil, "", err
+		}
+		cart = &models.GuestCart{TokenHash: hash, ExpiresAt: expires}
+		if err := database.DB.Create(cart).Error; err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", err
+	}
+	setCartTokenCookie(c, token, expires)
+	return cart, token, nil
+}
+
+// touchGuestCart pushes back the expiry of a guest cart after a change
+func touchGuestCart(c *fiber.Ctx, cart *models.GuestCart, token string) error {
+	expires := time.Now().Add(guestCartTTL())
+	if err := database.DB.Model(cart).Update("expires_at", expires).Error; err != nil {
+		return err
+	}
+	setCartTokenCookie(c, token, expires)
+	return nil
+}
+
+// guestCartLineQuery finds the guest cart line of a product, or of one of its
+// variants when variantID is set
+func guestCartLineQuery(tx *gorm.DB, cartID uint, productID interface{}, variantID *uint) *gorm.DB {
+	query := tx.Where("guest_cart_id = ? AND product_id = ?", cartID, productID)
+	if variantID != nil {
+		return query.Where("variant_id = ?", *variantID)
+	}
+	return query.Where("variant_id IS NULL")
+}
+
+// AddToGuestCart adds a product to the cart of a visitor who has not logged
+// in. The first add starts a cart and returns its cart_token, which must be
+// sent back in the X-Cart-Token header (browsers get it as a cookie).
+func AddToGuestCart(c *fiber.Ctx) error {
+	cartItemRequest := new(struct {
+		ProductID uint  `json:"product_id" validate:"required"`
+		VariantID *uint `json:"variant_id"`
+		Quantity  int   `json:"quantity" validate:"required,gte=1"`
+		SearchID  *uint `json:"search_id"` // Search the product was found through
+	})
+	if err := c.BodyParser(cartItemRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := utils.ValidateStruct(cartItemRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Find the product and the variant being bought
+	var product models.Product
+	if err := database.DB.First(&product, cartItemRequest.ProductID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
+	}
+	variant, err := resolveVariant(database.DB, product, cartItemRequest.VariantID)
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	cart, token, err := guestCartFor(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create cart"})
+	}
+
+	// Add to the line of the product if it is already in the cart
+	var item models.GuestCartItem
+	if err := guestCartLineQuery(database.DB, cart.ID, product.ID, variantID(variant)).First(&item).Error; err != nil {
+		_, discounted, _ := linePrice(database.DB, product, variant)
+		item = models.GuestCartItem{GuestCartID: cart.ID, ProductID: product.ID, VariantID: variantID(variant), AgreedPrice: discounted}
+	}
+	item.Quantity += cartItemRequest.Quantity
+	if item.Quantity > maxCartQuantity {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Cannot exceed %d of this product in your cart", maxCartQuantity),
+		})
+	}
+	if item.Quantity > availableStock(database.DB, product, variant) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Not enough stock available"})
+	}
+	if err := database.DB.Save(&item).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add to cart"})
+	}
+	if cartItemRequest.SearchID != nil {
+		markSearchAddToCart(database.DB, *cartItemRequest.SearchID, nil)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Product added to cart", "cart_token": token})
+}
+
+// ListGuestCart shows the guest cart with current prices. Like the user's
+// cart, each item has a status and price_changes lists the items whose price
+// moved since they were added.
+func ListGuestCart(c *fiber.Ctx) error {
+	cart, err := findGuestCart(database.DB, guestCartToken(c))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	}
+	var items []models.GuestCartItem
+	if err := database.DB.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped().Preload("Images")
+	}).Preload("Variant", func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped().Preload("Values").Preload("Images")
+	}).Where("guest_cart_id = ?", cart.ID).Order("id").Find(&items).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch cart"})
+	}
+
+	// Price the lines the way the user's cart is priced, without saving
+	lines := make([]models.CartItem, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, models.CartItem{
+			Model:       gorm.Model{ID: item.ID},
+			ProductID:   item.ProductID,
+			Product:     item.Product,
+			VariantID:   item.VariantID,
+			Variant:     item.Variant,
+			Quantity:    item.Quantity,
+			AgreedPrice: item.AgreedPrice,
+		})
+	}
+	review, err := reviewCartLines(database.DB, lines)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch cart"})
+	}
+
+	itemsResponse := []fiber.Map{}
+	for _, line := range review.Lines {
+		item := line.Item
+		itemResponse := fiber.Map{
+			"id":               item.ID,
+			"product_id":       item.ProductID,
+			"quantity":         item.Quantity,
+			"price":            fmt.Sprintf("%.2f", item.Price),
+			"discounted_price": fmt.Sprintf("%.2f", item.DiscountedPrice),
+			"total_price":      fmt.Sprintf("%.2f", item.TotalPrice),
+			"product_name":     item.Product.Name,
+			"product_image":    cartItemImage(item),
+			"status":           line.Status,
+		}
+		if line.Status == cartLineLowStock || line.Status == cartLineInsufficientStock {
+			itemResponse["stock_left"] = line.Stock
+		}
+		if line.Variant != nil {
+			itemResponse["variant_id"] = line.Variant.ID
+			itemResponse["sku"] = line.Variant.SKU
+			itemResponse["variant"] = line.Variant.Label()
+		}
+		itemsResponse = append(itemsResponse, itemResponse)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items":                   itemsResponse,
+		"total_amount":            fmt.Sprintf("%.2f", review.Total),
+		"total_product_discounts": fmt.Sprintf("%.2f", review.ProductDiscount),
+		"total_items":             len(review.Lines),
+		"price_changes":           review.PriceChanges,
+		"expires_at":              cart.ExpiresAt,
+	})
+}
+
+// UpdateGuestCartQuantity sets the quantity of a product in the guest cart.
+// Products with variants take ?variant_id=.
+func UpdateGuestCartQuantity(c *fiber.Ctx) error {
+	cartItemRequest := new(struct {
+		Quantity int `json:"quantity" validate:"required,gte=1"`
+	})
+	if err := c.BodyParser(cartItemRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := utils.ValidateStruct(cartItemRequest); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	cart, err := findGuestCart(database.DB, guestCartToken(c))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	}
+	var item models.GuestCartItem
+	if err := guestCartLineQuery(database.DB, cart.ID, c.Params("id"), queryVariantID(c)).Preload("Product").First(&item).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found in cart"})
+	}
+	variant, err := resolveVariant(database.DB, item.Product, item.VariantID)
+	if err != nil {
+		return variantError(c, err)
+	}
+
+	if cartItemRequest.Quantity > maxCartQuantity {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Maximum %d of this product can be added to cart", maxCartQuantity),
+		})
+	}
+	if cartItemRequest.Quantity > availableStock(database.DB, item.Product, variant) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Not enough stock available"})
+	}
+	if err := database.DB.Model(&item).Update("quantity", cartItemRequest.Quantity).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart item"})
+	}
+	if err := touchGuestCart(c, cart, guestCartToken(c)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Cart item quantity updated successfully"})
+}
+
+// RemoveFromGuestCart removes a product from the guest cart. Products with
+// variants take ?variant_id=.
+func RemoveFromGuestCart(c *fiber.Ctx) error {
+	cart, err := findGuestCart(database.DB, guestCartToken(c))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	}
+	result := guestCartLineQuery(database.DB.Unscoped(), cart.ID, c.Params("id"), queryVariantID(c)).Delete(&models.GuestCartItem{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to remove product from cart"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found in cart"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Product removed from cart"})
+}
+
+// mergeGuestCartOnLogin moves the guest cart of the request into the cart of
+// user and notes in the login response what could not be moved in full.
+// Login never fails because of the merge.
+func mergeGuestCartOnLogin(c *fiber.Ctx, user models.User, response fiber.Map) {
+	token := guestCartToken(c)
+	if token == "" || user.Role == models.RoleSeller || user.Role == models.RoleAdmin {
+		return
+	}
+	merged, adjusted, err := mergeGuestCart(database.DB, token, user.ID)
+	if err != nil {
+		log.Printf("Failed to merge guest cart into the cart of user %d: %v", user.ID, err)
+		return
+	}
+	setCartTokenCookie(c, "", time.Now().Add(-time.Hour))
+	if merged {
+		response["cart_merged"] = true
+		if len(adjusted) > 0 {
+			response["cart_adjustments"] = adjusted
+		}
+	}
+}
+
+// mergeGuestCart moves the items of the guest cart of token into the cart of
+// userID and deletes the guest cart. Quantities of a product already in the
+// user's cart are added up, capped by the per-product limit and the stock
+// left. It returns whether there was a guest cart and the lines that could
+// not be moved in full.
+func mergeGuestCart(db *gorm.DB, token string, userID uint) (bool, []fiber.Map, error) {
+	merged := false
+	adjusted := []fiber.Map{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock the guest cart so two logins cannot both move it
+		var guest models.GuestCart
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND expires_at > ?", utils.HashToken(token), time.Now()).First(&guest).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		merged = true
+
+		var items []models.GuestCartItem
+		if err := tx.Where("guest_cart_id = ?", guest.ID).Order("id").Find(&items).Error; err != nil {
+			return err
+		}
+		var cart models.Cart
+		if err := tx.Where("user_id = ?", userID).First(&cart).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if len(items) > 0 {
+				cart = models.Cart{UserID: userID}
+				if err := tx.Create(&cart).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for _, item := range items {
+			added, reason, err := mergeGuestCartItem(tx, cart.ID, item)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				adjusted = append(adjusted, fiber.Map{
+					"product_id": item.ProductID,
+					"variant_id": item.VariantID,
+					"requested":  item.Quantity,
+					"added":      added,
+					"reason":     reason,
+				})
+			}
+		}
+
+		if err := tx.Unscoped().Where("guest_cart_id = ?", guest.ID).Delete(&models.GuestCartItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&guest).Error
+	})
+	return merged, adjusted, err
+}
+
+// mergeGuestCartItem adds a guest cart line to the user's cart and returns
+// how many units were added and, when not all of them, why
+func mergeGuestCartItem(tx *gorm.DB, cartID uint, item models.GuestCartItem) (int, string, error) {
+	var product models.Product
+	if err := tx.First(&product, item.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, "Product is no longer available", nil
+		}
+		return 0, "", err
+	}
+	variant, err := resolveVariant(tx, product, item.VariantID)
+	if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) {
+		return 0, "Variant is no longer available", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	var line models.CartItem
+	if err := cartLineQuery(tx, cartID, product.ID, variantID(variant)).First(&line).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, "", err
+	}
+	stock := availableStock(tx, product, variant)
+	limit := min(maxCartQuantity, stock)
+	added := max(min(line.Quantity+item.Quantity, limit)-line.Quantity, 0)
+	reason := ""
+	if added < item.Quantity {
+		reason = fmt.Sprintf("Cannot exceed %d of this product in your cart", maxCartQuantity)
+		if stock < maxCartQuantity {
+			reason = "Not enough stock available"
+		}
+	}
+	if added == 0 {
+		return 0, reason, nil
+	}
+
+	price, discounted, discountPercentage := linePrice(tx, product, variant)
+	// New lines keep the price agreed in the guest cart and a line the user
+	// already had keeps its own, so a change since then still has to be
+	// acknowledged at checkout
+	switch {
+	case line.ID == 0 && item.AgreedPrice > 0:
+		line.AgreedPrice = item.AgreedPrice
+	case line.ID == 0:
+		line.AgreedPrice = discounted
+	case line.AgreedPrice == 0:
+		line.AgreedPrice = line.DiscountedPrice
+	}
+	line.CartID = cartID
+	line.ProductID = product.ID
+	line.VariantID = variantID(variant)
+	line.Quantity += added
+	line.Price = price
+	line.DiscountedPrice = discounted
+	line.DiscountPercentage = discountPercentage
+	line.TotalPrice = float64(line.Quantity) * discounted
+	if err := tx.Save(&line).Error; err != nil {
+		return 0, "", err
+	}
+	return added, reason, nil
+}
+
+// PurgeExpiredGuestCarts deletes guest carts that have not changed within
+// their lifetime and returns how many were deleted
+func PurgeExpiredGuestCarts(db *gorm.DB) (int64, error) {
+	var count int64
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Model(&models.GuestCart{}).Select("id").Where("expires_at <= ?", now)
+		if err := tx.Unscoped().Where("guest_cart_id IN (?)", expired).Delete(&models.GuestCartItem{}).Error; err != nil {
+			return err
+		}
+		result := tx.Unscoped().Where("expires_at <= ?", now).Delete(&models.GuestCart{})
+		count = result.RowsAffected
+		return result.Error
+	})
+	return count, err
+}
+
+// StartGuestCartCleanup purges expired guest carts every interval in the
+// background
+func StartGuestCartCleanup(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			count, err := PurgeExpiredGuestCarts(db)
+			if err != nil {
+				log.Printf("Failed to purge guest carts: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Purged %d expired guest carts", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// notificationStreamPoll is how often an open stream checks for new
+// notifications. Polling the table keeps streams working across instances.
+const notificationStreamPoll = 2 * time.Second
+
+// notificationStreamPing is how often an idle stream sends a comment so
+// proxies keep the connection open
+const notificationStreamPing = 15 * time.Second
+
+// pushNotification adds a notification to a user's feed in tx. It runs in a
+// savepoint and only logs a failure, a feed entry is never worth failing the
+// change it is about.
+func pushNotification(tx *gorm.DB, notification models.Notification) {
+	if err := tx.Transaction(func(sp *gorm.DB) error {
+		return sp.Create(&notification).Error
+	}); err != nil {
+		log.Printf("Failed to add %s notification for user %d: %v", notification.Type, notification.UserID, err)
+	}
+}
+
+// pushOrderStatus tells the customer of an order that what moved to status,
+// e.g. "Your order #12" or "Shoes in order #12"
+func pushOrderStatus(tx *gorm.DB, orderID uint, what, status string) {
+	var order models.Order
+	if err := tx.Select("id", "user_id").First(&order, orderID).Error; err != nil {
+		log.Printf("Failed to load order %d for notifications: %v", orderID, err)
+		return
+	}
+	pushNotification(tx, models.Notification{
+		UserID:  order.UserID,
+		Type:    models.NotificationTypeOrderStatus,
+		Title:   fmt.Sprintf("Order #%d %s", order.ID, status),
+		Body:    fmt.Sprintf("%s is now %s", what, status),
+		OrderID: &order.ID,
+	})
+}
+
+// notifyPriceDrop tells everyone with the product on their wishlist that its
+// price went down from oldPrice to newPrice
+func notifyPriceDrop(tx *gorm.DB, product models.Product, oldPrice, newPrice float64) {
+	if newPrice >= oldPrice {
+		return
+	}
+	var userIDs []uint
+	if err := tx.Model(&models.WishlistItem{}).Where("product_id = ?", product.ID).Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+		log.Printf("Failed to load wishlists of product %d: %v", product.ID, err)
+		return
+	}
+	productID := product.ID
+	for _, userID := range userIDs {
+		pushNotification(tx, models.Notification{
+			UserID:    userID,
+			Type:      models.NotificationTypePriceDrop,
+			Title:     "Price dropped on your wishlist",
+			Body:      fmt.Sprintf("%s is now %.2f, down from %.2f", product.Name, newPrice, oldPrice),
+			ProductID: &productID,
+		})
+	}
+}
+
+// effectivePrice is what a product sells for after its offer
+func effectivePrice(tx *gorm.DB, product models.Product) float64 {
+	price := product.Price
+	var offer models.Offer
+	if err := tx.Where("product_id = ? AND variant_id IS NULL", product.ID).First(&offer).Error; err == nil {
+		price = price * (1 - offer.DiscountPercentage/100)
+	}
+	roundAmount(&price)
+	return price
+}
+
+// ListNotifications returns the user's notifications, newest first. Pass
+// unread=true for only the unread ones.
+func ListNotifications(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	query := database.DB.Where("user_id = ?", userID)
+	if c.QueryBool("unread") {
+		query = query.Where("read_at IS NULL")
+	}
+	var notifications []models.Notification
+	if err := query.Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&notifications).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch notifications"})
+	}
+	var unread int64
+	if err := database.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&unread).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch notifications"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"notifications": notifications,
+		"unread_count":  unread,
+		"page":          page,
+		"limit":         limit,
+	})
+}
+
+// MarkNotificationRead marks one of the user's notifications read
+func MarkNotificationRead(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid notification ID"})
+	}
+	var notification models.Notification
+	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).First(&notification).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Notification not found"})
+	}
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		if err := database.DB.Model(&notification).Update("read_at", now).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update notification"})
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Notification marked as read", "notification": notification})
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user read
+func MarkAllNotificationsRead(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	result := database.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Update("read_at", time.Now())
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update notifications"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "All notifications marked as read", "updated": result.RowsAffected})
+}
+
+// StreamNotifications sends the user's new notifications as server-sent
+// events. A client that reconnects with Last-Event-ID gets what it missed.
+func StreamNotifications(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	lastID, _ := strconv.ParseUint(c.Get("Last-Event-ID"), 10, 64)
+	if lastID == 0 {
+		// A new stream starts from now, older notifications come from the list
+		if err := database.DB.Model(&models.Notification{}).Where("user_id = ?", userID).
+			Select("COALESCE(MAX(id), 0)").Scan(&lastID).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to open notification stream"})
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		fmt.Fprint(w, "retry: 5000\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+		ticker := time.NewTicker(notificationStreamPoll)
+		defer ticker.Stop()
+		lastWrite := time.Now()
+		for range ticker.C {
+			var notifications []models.Notification
+			if err := database.DB.Where("user_id = ? AND id > ?", userID, lastID).Order("id").Limit(50).Find(&notifications).Error; err != nil {
+				log.Printf("Failed to poll notifications for user %d: %v", userID, err)
+				return
+			}
+			for _, notification := range notifications {
+				data, err := json.Marshal(notification)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", notification.ID, data)
+				lastID = uint64(notification.ID)
+			}
+			if len(notifications) == 0 {
+				if time.Since(lastWrite) < notificationStreamPing {
+					continue
+				}
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			// Flushing fails once the client has gone away
+			if err := w.Flush(); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"gorm.io/gorm"
+)
+
+// Notifications queues and delivers customer and vendor notifications. When
+// it is nil nothing is sent.
+var Notifications *utils.Notifier
+
+// InitNotifications sets up Notifications on the database and starts
+// delivering queued messages every interval. OTPs are emailed through it too,
+// but never queued.
+func InitNotifications(db *gorm.DB, interval time.Duration) {
+	Notifications = utils.NewNotifier(db)
+	Notifications.Start(interval)
+	if manager, ok := OTPs.(*utils.OTPManager); ok {
+		manager.Sender = emailOTP
+	}
+}
+
+// emailOTP emails an OTP right away. It skips the outbox so the plain code is
+// never stored.
+func emailOTP(email string, purpose utils.OTPPurpose, code string, ttl time.Duration) error {
+	return Notifications.SendNow(utils.NotificationChannelEmail, email, "otp", utils.OTPMessageData(purpose, code, ttl))
+}
+
+// notify queues a notification to a user's email in tx. Problems are logged
+// and never fail tx.
+func notify(tx *gorm.DB, userID uint, template string, data map[string]interface{}) {
+	if Notifications == nil {
+		return
+	}
+	var user models.User
+	if err := tx.Select("id", "name", "email").First(&user, userID).Error; err != nil {
+		log.Printf("Failed to load user %d for %s notification: %v", userID, template, err)
+		return
+	}
+	data["Name"] = user.Name
+	Notifications.Enqueue(tx, utils.NotificationChannelEmail, user.Email, template, data)
+}
+
+// notifyOrderConfirmed tells the customer their order was placed and every
+// store in it that it has a new order. It runs once the order no longer
+// waits for an online payment.
+func notifyOrderConfirmed(tx *gorm.DB, orderID uint) {
+	var order models.Order
+	if err := tx.Preload("Items.Product").Preload("SubOrders.Store").Preload("SubOrders.Items.Product").First(&order, orderID).Error; err != nil {
+		log.Printf("Failed to load order %d for notifications: %v", orderID, err)
+		return
+	}
+	notify(tx, order.UserID, "order_placed", map[string]interface{}{"Order": order, "Items": order.Items})
+	for _, subOrder := range order.SubOrders {
+		if subOrder.Store == nil {
+			continue
+		}
+		notify(tx, subOrder.Store.UserID, "vendor_new_order", map[string]interface{}{
+			"Order":     order,
+			"SubOrder":  subOrder,
+			"StoreName": subOrder.Store.Name,
+			"Items":     subOrder.Items,
+		})
+		orderID := order.ID
+		pushNotification(tx, models.Notification{
+			UserID:  subOrder.Store.UserID,
+			Type:    models.NotificationTypeNewOrder,
+			Title:   "New order received",
+			Body:    fmt.Sprintf("Order #%d has %d item(s) for %s", order.ID, len(subOrder.Items), subOrder.Store.Name),
+			OrderID: &orderID,
+		})
+	}
+}
+
+// notifyStatusChange tells the customer that their order, or a store's part
+// of it when subOrderID is set, moved to status. Only shipping, delivery and
+// cancellation are worth an email.
+func notifyStatusChange(tx *gorm.DB, orderID uint, subOrderID *uint, status string) {
+	if Notifications == nil {
+		return
+	}
+	// Shipping and delivery happen per store, cancellation for the order
+	if subOrderID != nil && status != models.OrderStatusShipped && status != models.OrderStatusDelivered {
+		return
+	}
+	if subOrderID == nil && status != models.OrderStatusCanceled {
+		return
+	}
+	var order models.Order
+	if err := tx.Select("id", "user_id").First(&order, orderID).Error; err != nil {
+		log.Printf("Failed to load order %d for notifications: %v", orderID, err)
+		return
+	}
+	data := map[string]interface{}{"OrderID": order.ID, "Status": status, "StoreName": ""}
+	if subOrderID != nil {
+		var subOrder models.SubOrder
+		if err := tx.Preload("Store").First(&subOrder, *subOrderID).Error; err == nil && subOrder.Store != nil {
+			data["StoreName"] = subOrder.Store.Name
+		}
+	}
+	notify(tx, order.UserID, "order_status", data)
+}
+
+// notifyRefundProcessed tells the customer a refund reached them
+func notifyRefundProcessed(tx *gorm.DB, refund *models.Refund) {
+	destination := "original payment method"
+	if refund.Method == models.RefundMethodWallet {
+		destination = "wallet"
+	}
+	orderID := refund.OrderID
+	pushNotification(tx, models.Notification{
+		UserID:  refund.UserID,
+		Type:    models.NotificationTypeRefund,
+		Title:   fmt.Sprintf("Refund for order #%d", refund.OrderID),
+		Body:    fmt.Sprintf("%.2f was refunded to your %s", refund.Amount, destination),
+		OrderID: &orderID,
+	})
+	notify(tx, refund.UserID, "refund_processed", map[string]interface{}{"Refund": refund})
+}
@@ -18,6 +18,7 @@ func CreateOrUpdateOffer(c *fiber.Ctx) error {
 	// Parse the discount percentage from the request body
 	var req struct {
 		DiscountPercentage float64 `json:"discount_percentage" validate:"required,gte=0,lte=100"`
+		VariantID          *uint   `json:"variant_id"` // Limits the offer to one variant
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
@@ -29,13 +30,24 @@ func CreateOrUpdateOffer(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
 	}
 
-	// Check if an offer already exists for this product
+	// An offer on a variant only changes that variant's price
+	var variant *models.ProductVariant
+	if req.VariantID != nil {
+		variant = new(models.ProductVariant)
+		if err := database.DB.Where("id = ? AND product_id = ?", *req.VariantID, product.ID).First(variant).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Variant not found"})
+		}
+	}
+	oldPrice := offerPrice(product, variant)
+
+	// Check if an offer already exists for this product or variant
 	var offer models.Offer
-	if err := database.DB.Where("product_id = ?", product.ID).First(&offer).Error; err != nil {
+	if err := offerQuery(database.DB, product.ID, req.VariantID).First(&offer).Error; err != nil {
 		// If no existing offer, create a new one
 		if err == gorm.ErrRecordNotFound {
 			offer = models.Offer{
 				ProductID:          product.ID,
+				VariantID:          req.VariantID,
 				DiscountPercentage: req.DiscountPercentage,
 			}
 			if err := database.DB.Create(&offer).Error; err != nil {
@@ -52,10 +64,31 @@ func CreateOrUpdateOffer(c *fiber.Ctx) error {
 		}
 	}
 
+	notifyPriceDrop(database.DB, product, oldPrice, offerPrice(product, variant))
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Offer applied successfully", "offer": offer})
 }
 
-// DeleteOffer removes an offer from a product
+// offerQuery finds the offer on a product, or on one of its variants when
+// variantID is set
+func offerQuery(tx *gorm.DB, productID uint, variantID *uint) *gorm.DB {
+	query := tx.Where("product_id = ?", productID)
+	if variantID != nil {
+		return query.Where("variant_id = ?", *variantID)
+	}
+	return query.Where("variant_id IS NULL")
+}
+
+// offerPrice is the price of the product or variant after its offers
+func offerPrice(product models.Product, variant *models.ProductVariant) float64 {
+	if variant != nil {
+		return effectiveVariantPrice(database.DB, product, *variant)
+	}
+	return effectivePrice(database.DB, product)
+}
+
+// DeleteOffer removes an offer from a product, or from one of its variants
+// when variant_id is given
 func DeleteOffer(c *fiber.Ctx) error {
 	// Extract product ID and seller ID
 	productID := c.Params("product_id")
@@ -68,8 +101,8 @@ func DeleteOffer(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
 	}
 
-	// Delete the offer associated with this product
-	if err := database.DB.Where("product_id = ?", product.ID).Delete(&models.Offer{}).Error; err != nil {
+	// Delete the offer associated with this product or variant
+	if err := offerQuery(database.DB, product.ID, queryVariantID(c)).Delete(&models.Offer{}).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete offer"})
 	}
 
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// recordOrderEvent writes an entry on the order timeline for the given actor
+func recordOrderEvent(tx *gorm.DB, event models.OrderEvent, actor models.Actor) error {
+	event.Actor = actor.Role
+	event.ActorID = actor.ID
+	return tx.Create(&event).Error
+}
+
+// orderTimeline returns the events of an order oldest first. When subOrderID
+// is not nil only order level events and events of that sub-order and its
+// items are returned.
+func orderTimeline(db *gorm.DB, orderID uint, subOrderID *uint) ([]models.OrderEvent, error) {
+	query := db.Where("order_id = ?", orderID)
+	if subOrderID != nil {
+		query = query.Where("(sub_order_id IS NULL AND order_item_id IS NULL) OR sub_order_id = ? OR order_item_id IN (SELECT id FROM order_items WHERE sub_order_id = ?)", *subOrderID, *subOrderID)
+	}
+	var events []models.OrderEvent
+	if err := query.Order("created_at asc, id asc").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ctxActor builds the actor for the logged in user with the given role
+func ctxActor(c *fiber.Ctx, role models.Role) models.Actor {
+	userID, _ := c.Locals("user_id").(float64)
+	return models.Actor{Role: role, ID: uint(userID)}
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+)
+
+// Statuses of online payments whose order can no longer be paid. A payment
+// that still arrives is refunded.
+const (
+	PaymentStatusExpired  = "expired"  // Not completed within the payment window
+	PaymentStatusCanceled = "canceled" // The order was canceled before it was paid
+)
+
+// ExpireUnpaidOrders cancels online orders that are still unpaid window after
+// they were placed and releases their stock. It returns how many orders were
+// expired.
+func ExpireUnpaidOrders(db *gorm.DB, window time.Duration) (int, error) {
+	var payments []models.Payment
+	if err := db.Where("payment_type = ? AND payment_status IN ? AND created_at < ?", "razorpay", []string{"pending", "failed"}, time.Now().Add(-window)).
+		Find(&payments).Error; err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, payment := range payments {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return expireOrder(tx, payment.ID, window)
+		})
+		if err != nil {
+			log.Printf("Failed to expire order %d: %v", payment.OrderID, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// expireOrder expires a single unpaid payment and cancels its order. The
+// order and payment rows are locked so a payment confirmed at the same moment
+// wins.
+func expireOrder(tx *gorm.DB, paymentID uint, window time.Duration) error {
+	var payment models.Payment
+	if err := tx.First(&payment, paymentID).Error; err != nil {
+		return err
+	}
+	order, err := lockOrderPayment(tx, &payment)
+	if err != nil {
+		return err
+	}
+	if payment.PaymentStatus != "pending" && payment.PaymentStatus != "failed" {
+		return nil
+	}
+	if err := tx.Model(&payment).Update("payment_status", PaymentStatusExpired).Error; err != nil {
+		return err
+	}
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID: payment.OrderID,
+		Type:    models.OrderEventPayment,
+		Note:    fmt.Sprintf("Payment not received within %s, payment expired", window),
+	}, models.SystemActor); err != nil {
+		return err
+	}
+
+	if models.IsFinalStatus(order.Status) {
+		return nil
+	}
+	// Canceling only puts back stock that was taken, which unpaid online
+	// orders never did. The canceled items give back the wallet share of a
+	// split payment, the gateway share was never paid.
+	return transitionOrder(tx, order, models.OrderStatusCanceled, models.SystemActor, "Canceled, payment not received in time", models.RefundMethodWallet)
+}
+
+// StartOrderExpiryJob expires unpaid online orders older than window, checking
+// every interval in the background
+func StartOrderExpiryJob(db *gorm.DB, window, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			count, err := ExpireUnpaidOrders(db, window)
+			if err != nil {
+				log.Printf("Failed to expire unpaid orders: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Expired %d unpaid orders", count)
+			}
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -12,15 +13,22 @@ import (
 	"github.com/Ukkenjijo/trendtrek/models"
 	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/razorpay/razorpay-go"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// Initialize Razorpay Client
-var razorpayClient *razorpay.Client
+// PaymentGateway takes the online payments. It is picked by the
+// PAYMENT_PROVIDER environment variable and can be replaced in tests.
+var PaymentGateway utils.PaymentProvider
 
-func InitRazorpay() {
-	razorpayClient = razorpay.NewClient(os.Getenv("RAZORPAY_KEY"), os.Getenv("RAZORPAY_SECRET"))
+// InitPaymentGateway sets up the payment gateway from the environment. It
+// stops the server when the configured gateway cannot be used.
+func InitPaymentGateway() {
+	gateway, err := utils.NewPaymentProvider(os.Getenv("PAYMENT_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Could not set up the payment gateway: %v", err)
+	}
+	PaymentGateway = gateway
 }
 func roundAmount(amount *float64) {
 	*amount = math.Round(*amount*100) / 100
@@ -37,7 +45,6 @@ func PlaceOrder(c *fiber.Ctx) error {
 		log.Println(err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
 	}
-	log.Println(req)
 
 	// Validate the request
 	if err := utils.ValidateStruct(req); err != nil {
@@ -46,7 +53,7 @@ func PlaceOrder(c *fiber.Ctx) error {
 
 	// Get the user's cart
 	var cart models.Cart
-	if err := database.DB.Preload("Items").Preload("Coupon").Where("user_id = ?", userId).First(&cart).Error; err != nil {
+	if err := database.DB.Preload("Coupon").Where("user_id = ?", userId).First(&cart).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
 	}
 	addressID, _ := strconv.ParseUint(req.AddressID, 10, 32)
@@ -57,36 +64,91 @@ func PlaceOrder(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Address not found"})
 	}
 
+	// Begin transaction
+	tx := database.DB.Begin()
+	defer tx.Rollback()
+
+	// Lock the stock rows of the cart, in a fixed order so concurrent
+	// checkouts cannot deadlock, and reprice it under those locks so the
+	// order is placed at current prices and stock. The locks are held until
+	// the order is placed.
+	if err := lockCartStock(tx, cart.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check stock"})
+	}
+	review, err := repriceCart(tx, &cart)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
+	}
+	for _, line := range review.Lines {
+		cart.Items = append(cart.Items, line.Item)
+	}
+
 	// Ensure the cart is not empty
 	if len(cart.Items) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Cart is empty"})
 	}
+	if !review.orderable() {
+		var blocked []fiber.Map
+		for _, line := range review.Lines {
+			if line.Status == cartLineUnavailable || line.Status == cartLineInsufficientStock {
+				blocked = append(blocked, fiber.Map{"item_id": line.Item.ID, "product_id": line.Item.ProductID, "status": line.Status, "stock_left": max(line.Stock, 0)})
+			}
+		}
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Some items in your cart can no longer be ordered", "items": blocked})
+	}
+	// Prices that moved since the items were added must be accepted first
+	if pending := unacknowledgedPriceChanges(review.PriceChanges, req.AcknowledgedPrices); len(pending) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Prices in your cart have changed, please review them", "price_changes": pending})
+	}
 
 	if cart.CartTotal <= 100.0 && req.PaymentMode != "COD" {
-		log.Println(cart.CartTotal)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Minimum order amount is 100"})
 
 	}
 
-	// Begin transaction
-	tx := database.DB.Begin()
-	defer tx.Rollback()
+	// The accepted prices become the agreed ones
+	if _, err := acknowledgePrices(tx, review.PriceChanges, req.AcknowledgedPrices); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update cart"})
+	}
 
-	// Check stock availability and calculate total amount
+	// Calculate the total amount, the stock was checked when repricing
 	var totalAmount float64 = cart.CartTotal
+	products := make(map[uint]models.Product)
+	variants := make(map[uint]*models.ProductVariant)
 	for _, item := range cart.Items {
 		var product models.Product
 		if err := tx.First(&product, item.ProductID).Error; err != nil {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
 		}
-
-		if product.StockQuantity < item.Quantity {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Not enough stock for product %s", product.Name)})
+		products[product.ID] = product
+		variant, err := resolveVariant(tx, product, item.VariantID)
+		if err != nil {
+			return variantError(c, err)
 		}
-
+		variants[item.ID] = variant
 	}
 	roundAmount(&totalAmount)
 
+	// Apply the wallet balance to part of the order when asked to, the rest
+	// is paid through the chosen payment mode
+	walletAmount := 0.0
+	if req.UseWallet && req.PaymentMode != "WALLET" {
+		var wallet models.Wallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userId).First(&wallet).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Wallet not found"})
+		}
+		walletAmount = math.Min(wallet.Balance, totalAmount)
+		if req.WalletAmount > 0 {
+			walletAmount = math.Min(walletAmount, req.WalletAmount)
+		}
+		roundAmount(&walletAmount)
+		// A wallet that covers everything makes this a plain wallet order
+		if walletAmount >= totalAmount {
+			req.PaymentMode = "WALLET"
+			walletAmount = 0
+		}
+	}
+
 	// Create the order in the database
 	order := models.Order{
 		UserID:          uint(userId.(float64)),
@@ -103,21 +165,38 @@ func PlaceOrder(c *fiber.Ctx) error {
 	if err := tx.Create(&order).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create order"})
 	}
+	customer := ctxActor(c, models.RoleCustomer)
+	if err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, Type: models.OrderEventStatus, ToStatus: order.Status, Note: "Order placed"}, customer); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create order"})
+	}
 	cartOrginal, TotalDiscount := 0.0, 0.0
+	var orderItems []models.OrderItem
 	// Create the order items
 	for _, item := range cart.Items {
 		orderItem := models.OrderItem{
 			OrderID:    order.ID,
 			ProductID:  item.ProductID,
+			VariantID:  item.VariantID,
 			Quantity:   item.Quantity,
 			Price:      item.DiscountedPrice,
 			TotalPrice: item.TotalPrice,
 		}
+		// Keep what was bought even if the variant changes later
+		if variant := variants[item.ID]; variant != nil {
+			orderItem.SKU = variant.SKU
+			orderItem.VariantLabel = variant.Label()
+		}
 		cartOrginal += item.Price
 		TotalDiscount += (item.Price - item.DiscountedPrice)
 		if err := tx.Create(&orderItem).Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create order item"})
 		}
+		orderItem.Product = products[item.ProductID]
+		orderItems = append(orderItems, orderItem)
+	}
+	// Split the order into one sub-order per store
+	if _, err := createSubOrders(tx, order.ID, orderItems, cart.CouponDiscount, totalAmount); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create store orders"})
 	}
 	//Create the order details
 	var orderPaymentDetail models.OrderPaymentDetail
@@ -130,47 +209,43 @@ func PlaceOrder(c *fiber.Ctx) error {
 	}
 	orderPaymentDetail.CouponSavings = cart.CouponDiscount
 	orderPaymentDetail.FinalOrderAmount = totalAmount
-	if totalAmount > 500 {
-		orderPaymentDetail.ShippingCost = 0
-	} else {
-		orderPaymentDetail.ShippingCost = 50
-	}
+	orderPaymentDetail.WalletAmount = walletAmount
 
 	// Create the payment
 	var payment models.Payment
 	payment.OrderID = order.ID
 	payment.UserID = uint(userId.(float64))
 	payment.PaymentType = req.PaymentMode
-	payment.Amount = totalAmount
+	payment.Amount = totalAmount - walletAmount
+	payment.WalletAmount = walletAmount
 	payment.PaymentStatus = "pending"
+	roundAmount(&payment.Amount)
 
-	if req.PaymentMode == "WALLET" {
-		//check if the user has enough balance
-		var wallet models.Wallet
-		if err := tx.Where("user_id = ?", userId).First(&wallet).Error; err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Wallet not found"})
+	// Take the wallet share of a split payment now, the rest follows below
+	if walletAmount > 0 {
+		if _, err := debitWallet(tx, payment.UserID, walletAmount, models.LedgerAccountSales, "Order Payment", fmt.Sprintf("order:%d", order.ID)); err != nil {
+			if errors.Is(err, ErrInsufficientBalance) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient balance"})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update wallet"})
 		}
-		if wallet.Balance < totalAmount {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient balance"})
+		if err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, Type: models.OrderEventPayment, Note: fmt.Sprintf("Paid %.2f from wallet, %.2f due by %s", walletAmount, payment.Amount, req.PaymentMode)}, customer); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 		}
-		wallet.Balance -= totalAmount
-		if err := tx.Save(&wallet).Error; err != nil {
+	}
+
+	if req.PaymentMode == "WALLET" {
+		//take the amount out of the wallet, this fails if the balance is too low
+		if _, err := debitWallet(tx, payment.UserID, totalAmount, models.LedgerAccountSales, "Order Payment", fmt.Sprintf("order:%d", order.ID)); err != nil {
+			if errors.Is(err, ErrInsufficientBalance) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Insufficient balance"})
+			}
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update wallet"})
 		}
 		payment.Amount = totalAmount
 		payment.PaymentStatus = "success"
-		//add wallet transaction
-		walletTransaction := models.WalletHistory{
-			WalletID:  wallet.ID,
-			Amount:    totalAmount,
-			Operation: "debit",
-			Balance:   wallet.Balance,
-			UserID:    uint(userId.(float64)),
-			Reason:    "Order Payment",
-		}
-
-		if err := tx.Create(&walletTransaction).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create wallet transaction"})
+		if err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, Type: models.OrderEventPayment, Note: fmt.Sprintf("Paid %.2f from wallet", totalAmount)}, customer); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 		}
 		if err := tx.Create(&payment).Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
@@ -182,6 +257,7 @@ func PlaceOrder(c *fiber.Ctx) error {
 		if err := ReducestockandDeleteCart(tx, &cart); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reduce stock and delete cart"})
 		}
+		notifyOrderConfirmed(tx, order.ID)
 
 		// Commit the transaction and return the Razorpay order ID
 		if err := tx.Commit().Error; err != nil {
@@ -191,29 +267,14 @@ func PlaceOrder(c *fiber.Ctx) error {
 
 	}
 
-	InitRazorpay()
-
-	// If PaymentMode is Razorpay, create a Razorpay order
+	// If PaymentMode is Razorpay, hold the stock and create an order on the
+	// payment gateway. The gateway is called after the commit so the stock
+	// rows are not locked while it answers.
 	if req.PaymentMode == "razorpay" {
-		// Razorpay expects the amount in paise (so multiply by 100)
-		amount := int(totalAmount * 100)
-
-		// Prepare Razorpay order options
-		options := map[string]interface{}{
-			"amount":          amount,
-			"currency":        "INR",
-			"receipt":         fmt.Sprintf("order_%d", order.ID),
-			"payment_capture": 1,
+		// Hold the stock while the customer pays
+		if err := reserveOrderStock(tx, order.ID, orderItems); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reserve stock"})
 		}
-
-		// Create Razorpay order
-		razorpayOrder, err := razorpayClient.Order.Create(options, nil)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create Razorpay order"})
-		}
-		//set the payment status for razorpay
-		payment.RazorpayPaymentID = razorpayOrder["id"].(string)
-
 		if err := tx.Create(&payment).Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 		}
@@ -222,23 +283,40 @@ func PlaceOrder(c *fiber.Ctx) error {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 		}
 
-		// Commit the transaction and return the Razorpay order ID
 		if err := tx.Commit().Error; err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to commit transaction"})
 		}
 
+		// The order is placed and holds its stock; if the gateway fails the
+		// customer can retry the payment until the order expires
+		gatewayOrder, err := PaymentGateway.CreateOrder(payment.Amount, "INR", fmt.Sprintf("order_%d", order.ID))
+		if err == nil {
+			err = database.DB.Transaction(func(tx *gorm.DB) error {
+				return attachGatewayOrder(tx, &payment, gatewayOrder, customer,
+					fmt.Sprintf("Razorpay order %s created, awaiting payment", gatewayOrder.ID))
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Order placed but the payment could not be started, please retry the payment", "order_id": order.ID})
+		}
+
 		// Return Razorpay order details
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
 			"message":           "Order placed successfully",
 			"order_id":          order.ID,
-			"razorpay_order_id": razorpayOrder["id"],
-			"amount":            totalAmount,
+			"razorpay_order_id": gatewayOrder.ID,
+			"amount":            payment.Amount,
+			"wallet_amount":     walletAmount,
 			"currency":          "INR",
+			"reserved_until":    time.Now().Add(reservationTTL()),
 		})
 	}
 	if err := tx.Create(&payment).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 	}
+	if err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, Type: models.OrderEventPayment, Note: fmt.Sprintf("%s payment of %.2f pending", req.PaymentMode, payment.Amount)}, customer); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
+	}
 	// Clear the cart
 	if err := ReducestockandDeleteCart(tx, &cart); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reduce stock and delete cart"})
@@ -246,6 +324,7 @@ func PlaceOrder(c *fiber.Ctx) error {
 	if err := tx.Create(&orderPaymentDetail).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create payment"})
 	}
+	notifyOrderConfirmed(tx, order.ID)
 
 	// Commit the transaction for non-Razorpay payments
 	if err := tx.Commit().Error; err != nil {
@@ -253,8 +332,10 @@ func PlaceOrder(c *fiber.Ctx) error {
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message":  "Order placed successfully",
-		"order_id": order.ID,
+		"message":       "Order placed successfully",
+		"order_id":      order.ID,
+		"amount":        payment.Amount,
+		"wallet_amount": walletAmount,
 	})
 }
 
@@ -315,69 +396,47 @@ func ListOrders(c *fiber.Ctx) error {
 func CancelOrder(c *fiber.Ctx) error {
 	userId := c.Locals("user_id")
 	orderId, _ := c.ParamsInt("id")
+	method, err := refundMethod(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Find the order
 	var order models.Order
 	tx := database.DB.Begin()
 	defer tx.Rollback()
 
-	if err := tx.Preload("Items").Where("id = ? AND user_id = ?", orderId, userId).First(&order).Error; err != nil {
+	// Lock the order so a payment confirmed meanwhile waits for the cancel
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").Where("id = ? AND user_id = ?", orderId, userId).First(&order).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
 	}
 
-	// Ensure the order can still be canceled (e.g., only "pending" orders can be canceled)
-	if order.Status != "pending" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Order cannot be canceled"})
-	}
-
-	// Update the order status to "canceled"
-	order.Status = "canceled"
-	if err := tx.Save(&order).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel order"})
+	// The whole order is refunded below, so every item still in it must be
+	// cancelable
+	if blocked := blockedItems(order.Items, models.OrderStatusCanceled, models.RoleCustomer); len(blocked) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Some items of this order can no longer be canceled", "items": blocked})
 	}
 
-	// Return stock back to the products
+	var canceled []uint
 	for _, item := range order.Items {
-		var product models.Product
-		if err := tx.First(&product, item.ProductID).Error; err == nil {
-			product.StockQuantity += item.Quantity
-
-			if err := tx.Save(&product).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to return stock"})
-			}
-		}
-		//set status to canceled
-		item.Status = "canceled"
-		log.Println(item.Status)
-		if err := tx.Save(&item).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel order item"})
+		if !models.IsFinalStatus(item.Status) {
+			canceled = append(canceled, item.ID)
 		}
 	}
 
-	//refund the canceled product amount to the user
-	//get the user wallet
-	var wallet models.Wallet
-	if err := tx.First(&wallet, order.UserID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get user wallet"})
+	// Move the order and its items to canceled, this also returns the stock
+	// and refunds every item
+	customer := ctxActor(c, models.RoleCustomer)
+	if err := transitionOrder(tx, &order, models.OrderStatusCanceled, customer, "Canceled by customer", method); err != nil {
+		return transitionError(c, err, "Failed to cancel order")
 	}
-	//return the total amount to the user
-	wallet.Balance += order.TotalAmount
-	if err := tx.Save(&wallet).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to return money to user"})
+	// An online payment still on its way is refunded when it arrives
+	if err := voidPayment(tx, order.ID, customer); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel payment"})
 	}
-
-	// Create a new wallet transaction
-	walletTransaction := models.WalletHistory{
-		UserID:    order.UserID,
-		Amount:    order.TotalAmount,
-		WalletID:  wallet.ID,
-		Operation: "credit",
-		Reason:    "Order Canceled",
-		Balance:   wallet.Balance,
-	}
-
-	if err := tx.Create(&walletTransaction).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create wallet transaction"})
+	refunds, err := itemRefunds(tx, canceled)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to refund order"})
 	}
 
 	// Commit the transaction
@@ -388,6 +447,7 @@ func CancelOrder(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message":  "Order canceled successfully",
 		"order_id": order.ID,
+		"refunds":  refunds,
 	})
 }
 
@@ -395,114 +455,51 @@ func CancelOrderItem(c *fiber.Ctx) error {
 	userId := c.Locals("user_id")
 	orderId, _ := c.ParamsInt("order_id")
 	itemId, _ := c.ParamsInt("item_id")
+	method, err := refundMethod(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Find the order
 	var order models.Order
 	tx := database.DB.Begin()
 	defer tx.Rollback()
 
-	if err := tx.Where("id = ? AND user_id = ?", orderId, userId).First(&order).Error; err != nil {
+	// Lock the order so a payment confirmed meanwhile waits for the cancel
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND user_id = ?", orderId, userId).First(&order).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
 	}
 
 	// Find the order item
 	var orderItem models.OrderItem
-	if err := tx.Preload("Product").Where("order_id = ? AND id = ?", orderId, itemId).First(&orderItem).Error; err != nil {
+	if err := tx.Where("order_id = ? AND id = ?", orderId, itemId).First(&orderItem).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order item not found"})
 	}
-	var orderPaymentDetails models.OrderPaymentDetail
-	if err := tx.Where("order_id = ?", orderId).First(&orderPaymentDetails).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order payment details not found"})
-	}
-	//Only pending items can be cancelled
-	if orderItem.Status != "pending" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Order item cannot be canceled"})
-	}
-	//set the status to canceled
-	orderItem.Status = "canceled"
-
-	//check if the coupon is still valid after canceling the order
-	var coupon models.Coupon
-	if err := tx.Where("code = ?", orderPaymentDetails.CouponCode).First(&coupon).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Coupon not found"})
+	//Move the item to canceled, this also returns the stock and refunds the
+	//item or lowers what is still due
+	if err := transitionOrderItem(tx, &orderItem, models.OrderStatusCanceled, ctxActor(c, models.RoleCustomer), "Canceled by customer", method); err != nil {
+		return transitionError(c, err, "Failed to cancel order item")
 	}
-    log.Println(order.TotalAmount,"fff",orderPaymentDetails.CouponSavings)
-	order.TotalAmount = order.TotalAmount-orderItem.TotalPrice + orderPaymentDetails.CouponSavings 
-	log.Println(order.TotalAmount,"dd",orderItem.TotalPrice,orderPaymentDetails.CouponSavings)
-	orderPaymentDetails.OrderAmount -= orderItem.Product.Price
-	orderPaymentDetails.OrderDiscount -= (orderItem.Product.Price * float64(orderItem.Quantity)) - orderItem.TotalPrice
-
-	refundAmount := 0.0
-	//check if the remaining order amount meets the coupon requirement
-	if order.TotalAmount >= coupon.MinPurchaseAmount {
-		orderPaymentDetails.CouponSavings = order.TotalAmount * (coupon.Discount / 100)
-		log.Println(orderPaymentDetails.CouponSavings)
-
-		refundAmount = orderPaymentDetails.FinalOrderAmount - order.TotalAmount + orderPaymentDetails.CouponSavings
-		log.Println(refundAmount,"refund amount")
-
-		orderPaymentDetails.FinalOrderAmount = order.TotalAmount - orderPaymentDetails.CouponSavings
-		order.TotalAmount = order.TotalAmount - orderPaymentDetails.CouponSavings
-	} else {
-		orderPaymentDetails.CouponSavings = 0
-		orderPaymentDetails.CouponCode = ""
-		refundAmount = orderPaymentDetails.FinalOrderAmount - order.TotalAmount
-		orderPaymentDetails.FinalOrderAmount -= refundAmount
-	}
-
-	if err := tx.Save(&orderItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel order item"})
-	}
-
-	if err := tx.Save(&order).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order"})
+	refunds, err := itemRefunds(tx, []uint{orderItem.ID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to refund order item"})
 	}
 
-	if err := tx.Save(&orderPaymentDetails).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order payment details"})
-	}
-	//add the refund amount to the wallet
-	var wallet models.Wallet
-	if err := tx.Where("user_id = ?", userId).First(&wallet).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Wallet not found"})
-	}
-	wallet.Balance += refundAmount
-	if err := tx.Save(&wallet).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update wallet"})
-	}
-	//create transaction history
-	history := models.WalletHistory{
-		WalletID:  wallet.ID,
-		Amount:    refundAmount,
-		UserID:    uint(userId.(float64)),
-		Operation: "Refund",
-		Balance:   wallet.Balance,
-		Reason:    "Order cancellation refund",
-	}
-	if err := tx.Create(&history).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create wallet history"})
-	}
-	
-	//return back the stock that was canceled
-	var product models.Product
-	if err:=tx.First(&product,orderItem.ProductID).Error;err == nil{
-		product.StockQuantity += orderItem.Quantity
-		if err := tx.Save(&product).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update product"})
-		}
+	//roll the order status up from its items
+	if err := syncOrderStatus(tx, order.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
 	}
 
-
-
 	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Transaction failed"})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Order item canceled successfully"})
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Order item canceled successfully", "refunds": refunds})
 
 }
 
 func GetOrderDetails(c *fiber.Ctx) error {
+	userId := c.Locals("user_id")
 	orderId := c.Params("id")
 	var order models.Order
 	tx := database.DB.Begin()
@@ -512,7 +509,7 @@ func GetOrderDetails(c *fiber.Ctx) error {
 		return tx.Preload("Product", func(db *gorm.DB) *gorm.DB {
 			return tx.Preload("Images")
 		})
-	}).First(&order, orderId).Error; err != nil {
+	}).Preload("SubOrders.Store").Where("id = ? AND user_id = ?", orderId, userId).First(&order).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
 		}
@@ -545,6 +542,7 @@ func GetOrderDetails(c *fiber.Ctx) error {
 
 		orderResponse["items"].([]fiber.Map)[i] = fiber.Map{
 			"id":            item.ID,
+			"sub_order_id":  item.SubOrderID,
 			"product_id":    item.ProductID,
 			"quantity":      item.Quantity,
 			"total_price":   item.TotalPrice,
@@ -552,9 +550,37 @@ func GetOrderDetails(c *fiber.Ctx) error {
 			"product_name":  item.Product.Name,
 			"product_image": item.Product.Images[0].URL,
 		}
-		fmt.Print(item.ID)
 	}
 
+	timeline, err := orderTimeline(database.DB, order.ID, nil)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve order timeline"})
+	}
+	orderResponse["timeline"] = timeline
+
+	subOrders := make([]fiber.Map, len(order.SubOrders))
+	for i, subOrder := range order.SubOrders {
+		storeName := ""
+		if subOrder.Store != nil {
+			storeName = subOrder.Store.Name
+		}
+		subOrders[i] = fiber.Map{
+			"sub_order_id":       subOrder.ID,
+			"store_id":           subOrder.StoreID,
+			"store_name":         storeName,
+			"status":             subOrder.Status,
+			"items_total":        subOrder.ItemsTotal,
+			"payment_allocation": subOrder.PaymentAllocation,
+		}
+	}
+	orderResponse["sub_orders"] = subOrders
+
+	var refunds []models.Refund
+	if err := database.DB.Where("order_id = ?", order.ID).Order("created_at").Find(&refunds).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve refunds"})
+	}
+	orderResponse["refunds"] = refunds
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "Order details retrieved successfully",
 		"data":    orderResponse,
@@ -562,7 +588,8 @@ func GetOrderDetails(c *fiber.Ctx) error {
 }
 
 type ReturnRequest struct {
-	Reason string `json:"reason" validate:"required"` // Reason for returning the item
+	Reason       string `json:"reason" validate:"required"` // Reason for returning the item
+	RefundMethod string `json:"refund_method"`              // "wallet" (default) or "source"
 }
 
 func ReturnOrderItem(c *fiber.Ctx) error {
@@ -577,10 +604,18 @@ func ReturnOrderItem(c *fiber.Ctx) error {
 	if err := c.BodyParser(req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
+	method, err := parseRefundMethod(req.RefundMethod)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The return, refund and wallet credit happen together or not at all
+	tx := database.DB.Begin()
+	defer tx.Rollback()
 
 	// Step 3: Find the order item by ID in the database
 	var orderItem models.OrderItem
-	if err := database.DB.First(&orderItem, uint(orderItemID)).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&orderItem, uint(orderItemID)).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order item not found"})
 		}
@@ -589,18 +624,23 @@ func ReturnOrderItem(c *fiber.Ctx) error {
 
 	// Step 4: Check if the order item is eligible for return (e.g., within return window)
 	var order models.Order
-	if err := database.DB.First(&order, orderItem.OrderID).Error; err != nil {
+	if err := tx.Where("id = ? AND user_id = ?", orderItem.OrderID, c.Locals("user_id")).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order item not found"})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to query order"})
 	}
 
 	// Assume the return window is 30 days from order creation
 	returnWindow := order.CreatedAt.AddDate(0, 0, 30)
-	if time.Now().After(returnWindow) || orderItem.Status != "pending" {
+	if time.Now().After(returnWindow) {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Return window has expired"})
 	}
 
-	// Step 5: Update the order item's status to "returned" and set the return reason
-	orderItem.Status = "returned"
+	// Step 5: Move the order item to "returned" and set the return reason
+	if err := transitionOrderItem(tx, &orderItem, models.OrderStatusReturned, models.Actor{Role: models.RoleCustomer, ID: order.UserID}, req.Reason, method); err != nil {
+		return transitionError(c, err, "Failed to update order item")
+	}
 	orderItem.ReturnReason = req.Reason
 	orderItem.ReturnedAt = time.Now()
 	//calculate the refund amount
@@ -609,7 +649,7 @@ func ReturnOrderItem(c *fiber.Ctx) error {
 
 	//get the orderpaymentdetails
 	var orderPaymentDetails models.OrderPaymentDetail
-	if err := database.DB.Where("order_id = ?", orderItem.OrderID).First(&orderPaymentDetails).Error; err != nil {
+	if err := tx.Where("order_id = ?", orderItem.OrderID).First(&orderPaymentDetails).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to query order payment details"})
 	}
 
@@ -627,44 +667,37 @@ func ReturnOrderItem(c *fiber.Ctx) error {
 	log.Println(orderItem.TotalPrice)
 	orderPaymentDetails.CouponSavings -= itemdiscount
 	orderPaymentDetails.FinalOrderAmount -= orderItem.TotalPrice
-	if err := database.DB.Save(&orderPaymentDetails).Error; err != nil {
+	if err := tx.Save(&orderPaymentDetails).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order amount"})
 	}
+	if err := reduceSubOrderAmounts(tx, orderItem, refundAmount); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update store order"})
+	}
 
-	if err := database.DB.Save(&orderItem).Error; err != nil {
+	if err := tx.Save(&orderItem).Error; err != nil {
 		log.Printf("Error updating order item: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order item"})
 	}
 
-	// Step 6: Add the refund amount to the user's wallet
-	var wallet models.Wallet
-	if err := database.DB.Where("user_id = ?", order.UserID).First(&wallet).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to query wallet"})
+	// Step 6: Refund the amount to the wallet or the original payment method
+	refunds, err := refundOrder(tx, order, &orderItem.ID, refundAmount, method, "Refund")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to refund order item"})
 	}
-	wallet.Balance += refundAmount
 
-	//create a wallet transaction
-	walletransaction := models.WalletHistory{
-		UserID:    order.UserID,
-		Amount:    refundAmount,
-		Reason:    "Refund",
-		Operation: "credit",
-		Balance:   wallet.Balance,
-		WalletID:  wallet.ID,
-	}
-	if err := database.DB.Save(&wallet).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update wallet"})
+	if err := tx.Save(&order).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order amount"})
 	}
-	if err := database.DB.Save(&walletransaction).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update wallet transaction"})
+	if err := syncOrderStatus(tx, order.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
 	}
-
-	if err := database.DB.Save(&order).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order amount"})
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Transaction failed"})
 	}
 	// Step 6: Respond with success message and updated order item details
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message":    "Item returned successfully",
 		"order_item": orderItem,
+		"refunds":    refunds,
 	})
 }
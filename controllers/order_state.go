@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// statusRank orders the fulfilment statuses so an order can be rolled up to
+// the least advanced status of its items
+var statusRank = map[string]int{
+	models.OrderStatusPending:   0,
+	models.OrderStatusConfirmed: 1,
+	models.OrderStatusPacked:    2,
+	models.OrderStatusShipped:   3,
+	models.OrderStatusDelivered: 4,
+	models.OrderStatusCompleted: 5,
+}
+
+// transitionOrderItem moves a single order item to a new status, applies the
+// side effects of entering that status and records it on the timeline. A
+// canceled item is refunded through method.
+func transitionOrderItem(tx *gorm.DB, item *models.OrderItem, to string, actor models.Actor, note, method string) error {
+	from := item.Status
+	if err := models.ValidateTransition(from, to, actor.Role); err != nil {
+		return err
+	}
+	if err := tx.Model(item).Update("status", to).Error; err != nil {
+		return err
+	}
+	item.Status = to
+
+	eventType := models.OrderEventStatus
+	if to == models.OrderStatusReturned {
+		eventType = models.OrderEventReturn
+	}
+	itemID := item.ID
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID:     item.OrderID,
+		SubOrderID:  item.SubOrderID,
+		OrderItemID: &itemID,
+		Type:        eventType,
+		FromStatus:  from,
+		ToStatus:    to,
+		Note:        note,
+	}, actor); err != nil {
+		return err
+	}
+
+	if to == models.OrderStatusDelivered {
+		if err := markCODCollected(tx, item.OrderID); err != nil {
+			return err
+		}
+	}
+
+	if models.RestoresStockOnEntry(to) {
+		committed, err := stockCommitted(tx, item.OrderID)
+		if err != nil {
+			return err
+		}
+		if committed {
+			if err := restoreStock(tx, item.ProductID, item.VariantID, item.Quantity); err != nil {
+				return err
+			}
+		} else if err := cancelReservations(tx, item.OrderID, item.ID); err != nil {
+			// Unpaid online orders only hold the stock
+			return err
+		}
+	}
+
+	// Every way of canceling an item refunds it, returns are refunded by
+	// the return itself
+	if to == models.OrderStatusCanceled {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, item.OrderID).Error; err != nil {
+			return err
+		}
+		if _, err := refundCanceledItem(tx, &order, *item, method); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transitionOrder moves an order to a new status and cascades the change to
+// every item that is allowed to follow it
+func transitionOrder(tx *gorm.DB, order *models.Order, to string, actor models.Actor, note, method string) error {
+	from := order.Status
+	if err := models.ValidateTransition(from, to, actor.Role); err != nil {
+		return err
+	}
+	if err := tx.Model(order).Update("status", to).Error; err != nil {
+		return err
+	}
+	order.Status = to
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID:    order.ID,
+		Type:       models.OrderEventStatus,
+		FromStatus: from,
+		ToStatus:   to,
+		Note:       note,
+	}, actor); err != nil {
+		return err
+	}
+	notifyStatusChange(tx, order.ID, nil, to)
+
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ?", order.ID).Find(&items).Error; err != nil {
+		return err
+	}
+	if err := cascadeItems(tx, items, to, actor, note, method); err != nil {
+		return err
+	}
+	order.Items = items
+	return syncOrderStatus(tx, order.ID)
+}
+
+// transitionSubOrder moves a store's part of an order to a new status,
+// cascades the change to its items and rolls it up to the order
+func transitionSubOrder(tx *gorm.DB, subOrder *models.SubOrder, to string, actor models.Actor, note, method string) error {
+	from := subOrder.Status
+	if err := models.ValidateTransition(from, to, actor.Role); err != nil {
+		return err
+	}
+	if err := tx.Model(subOrder).Update("status", to).Error; err != nil {
+		return err
+	}
+	subOrder.Status = to
+	subOrderID := subOrder.ID
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID:    subOrder.OrderID,
+		SubOrderID: &subOrderID,
+		Type:       models.OrderEventStatus,
+		FromStatus: from,
+		ToStatus:   to,
+		Note:       note,
+	}, actor); err != nil {
+		return err
+	}
+	notifyStatusChange(tx, subOrder.OrderID, &subOrderID, to)
+
+	var items []models.OrderItem
+	if err := tx.Where("sub_order_id = ?", subOrder.ID).Find(&items).Error; err != nil {
+		return err
+	}
+	if err := cascadeItems(tx, items, to, actor, note, method); err != nil {
+		return err
+	}
+	subOrder.Items = items
+	return syncOrderStatus(tx, subOrder.OrderID)
+}
+
+// cascadeItems moves every item that is allowed to follow a parent status
+// change. Items that are already past that point are left alone.
+func cascadeItems(tx *gorm.DB, items []models.OrderItem, to string, actor models.Actor, note, method string) error {
+	for i := range items {
+		if items[i].Status == to || models.ValidateTransition(items[i].Status, to, actor.Role) != nil {
+			continue
+		}
+		if err := transitionOrderItem(tx, &items[i], to, actor, note, method); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockedItems returns the IDs of the active items that cannot follow their
+// order to status to. Canceled and returned items are no longer part of the
+// order and are left out.
+func blockedItems(items []models.OrderItem, to string, role models.Role) []uint {
+	blocked := []uint{}
+	for _, item := range items {
+		if item.Status == to || models.IsFinalStatus(item.Status) {
+			continue
+		}
+		if models.ValidateTransition(item.Status, to, role) != nil {
+			blocked = append(blocked, item.ID)
+		}
+	}
+	return blocked
+}
+
+// rollupStatus derives a status from a set of items. Active items decide the
+// status, otherwise the items are all returned or canceled.
+func rollupStatus(items []models.OrderItem) string {
+	status := ""
+	hasReturned := false
+	for _, item := range items {
+		switch item.Status {
+		case models.OrderStatusCanceled:
+		case models.OrderStatusReturned:
+			hasReturned = true
+		default:
+			if status == "" || statusRank[item.Status] < statusRank[status] {
+				status = item.Status
+			}
+		}
+	}
+	if status == "" {
+		status = models.OrderStatusCanceled
+		if hasReturned {
+			status = models.OrderStatusReturned
+		}
+	}
+	return status
+}
+
+// syncOrderStatus rolls the sub-order and order statuses up from their items
+// after an item level change
+func syncOrderStatus(tx *gorm.DB, orderID uint) error {
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ?", orderID).Find(&items).Error; err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	var subOrders []models.SubOrder
+	if err := tx.Where("order_id = ?", orderID).Find(&subOrders).Error; err != nil {
+		return err
+	}
+	for _, subOrder := range subOrders {
+		var subItems []models.OrderItem
+		for _, item := range items {
+			if item.SubOrderID != nil && *item.SubOrderID == subOrder.ID {
+				subItems = append(subItems, item)
+			}
+		}
+		if len(subItems) == 0 {
+			continue
+		}
+		from, status := subOrder.Status, rollupStatus(subItems)
+		if from == status {
+			continue
+		}
+		if err := tx.Model(&subOrder).Update("status", status).Error; err != nil {
+			return err
+		}
+		subOrderID := subOrder.ID
+		if err := recordOrderEvent(tx, models.OrderEvent{
+			OrderID:    orderID,
+			SubOrderID: &subOrderID,
+			Type:       models.OrderEventStatus,
+			FromStatus: from,
+			ToStatus:   status,
+			Note:       "Store order status updated from its items",
+		}, models.SystemActor); err != nil {
+			return err
+		}
+		notifyStatusChange(tx, orderID, &subOrderID, status)
+	}
+
+	var order models.Order
+	if err := tx.Select("id", "status").First(&order, orderID).Error; err != nil {
+		return err
+	}
+	from, status := order.Status, rollupStatus(items)
+	if from == status {
+		return nil
+	}
+	if err := tx.Model(&order).Update("status", status).Error; err != nil {
+		return err
+	}
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID:    orderID,
+		Type:       models.OrderEventStatus,
+		FromStatus: from,
+		ToStatus:   status,
+		Note:       "Order status updated from its items",
+	}, models.SystemActor); err != nil {
+		return err
+	}
+	notifyStatusChange(tx, orderID, nil, status)
+	return nil
+}
+
+// stockCommitted reports whether the stock for an order has already been
+// taken out of inventory. Razorpay orders only reserve it until paid.
+func stockCommitted(tx *gorm.DB, orderID uint) (bool, error) {
+	var payment models.Payment
+	if err := tx.Where("order_id = ?", orderID).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return payment.PaymentType != "razorpay" || payment.PaymentStatus == "paid", nil
+}
+
+// markCODCollected marks a cash on delivery payment as paid once the first
+// item of the order is delivered
+func markCODCollected(tx *gorm.DB, orderID uint) error {
+	result := tx.Model(&models.Payment{}).
+		Where("order_id = ? AND payment_type = ? AND payment_status = ?", orderID, "COD", "pending").
+		Update("payment_status", "paid")
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return recordOrderEvent(tx, models.OrderEvent{OrderID: orderID, Type: models.OrderEventPayment, Note: "Cash on delivery payment collected"}, models.SystemActor)
+}
+
+// restoreStock puts quantity units of a product, or of one of its variants
+// when variantID is set, back in stock
+func restoreStock(tx *gorm.DB, productID uint, variantID *uint, quantity int) error {
+	if variantID != nil {
+		return tx.Model(&models.ProductVariant{}).Unscoped().Where("id = ?", *variantID).
+			UpdateColumn("stock_quantity", gorm.Expr("stock_quantity + ?", quantity)).Error
+	}
+	return tx.Model(&models.Product{}).Where("id = ?", productID).
+		UpdateColumn("stock_quantity", gorm.Expr("stock_quantity + ?", quantity)).Error
+}
+
+// transitionError maps a failed transition to an HTTP response
+func transitionError(c *fiber.Ctx, err error, message string) error {
+	if errors.Is(err, models.ErrInvalidTransition) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": message})
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// OTPs sends and checks the one time codes of signup, password reset and
+// OTP login. Tests can replace it with a fake.
+var OTPs utils.OTPService
+
+// InitOTPService sets up OTPs on the database
+func InitOTPService(db *gorm.DB) {
+	OTPs = utils.NewOTPService(utils.NewGormOTPStore(db))
+}
+
+// sendOTP sends a code for purpose to email and writes the error response
+// when it cannot. It returns true when the code was sent.
+func sendOTP(c *fiber.Ctx, email string, purpose utils.OTPPurpose) (bool, error) {
+	err := OTPs.Send(email, purpose, c.IP())
+	if err == nil {
+		return true, nil
+	}
+	return false, otpError(c, err)
+}
+
+// canReceiveOTP reports whether user may be sent a code for purpose. Signup
+// codes only go to accounts still to be verified, login codes only to
+// verified accounts that are not blocked and reset codes to any account.
+func canReceiveOTP(user models.User, purpose utils.OTPPurpose) bool {
+	switch purpose {
+	case utils.OTPPurposeSignup:
+		return !user.Verified
+	case utils.OTPPurposeLogin:
+		return user.Verified && !user.Blocked
+	case utils.OTPPurposePasswordReset:
+		return true
+	}
+	return false
+}
+
+// otpError turns an OTP service error into a response
+func otpError(c *fiber.Ctx, err error) error {
+	var cooldown *utils.OTPCooldownError
+	switch {
+	case errors.As(err, &cooldown):
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":         "Please wait before requesting another OTP",
+			"cooldown_time": cooldown.RetryAfter.Seconds(),
+		})
+	case errors.Is(err, utils.ErrOTPAttemptsExceeded):
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many wrong attempts, request a new OTP"})
+	case errors.Is(err, utils.ErrOTPInvalid):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired OTP"})
+	}
+	log.Printf("OTP service error: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
+}
+
+// RequestLoginOTP emails a code the user can log in with instead of a
+// password
+func RequestLoginOTP(c *fiber.Ctx) error {
+	req := new(models.OTPRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Only send codes to accounts that can log in, but answer the same way
+	// either way so the endpoint does not reveal who has an account
+	var user models.User
+	if err := database.DB.Where("email = ?", req.Email).First(&user).Error; err == nil && canReceiveOTP(user, utils.OTPPurposeLogin) {
+		if ok, err := sendOTP(c, req.Email, utils.OTPPurposeLogin); !ok {
+			return err
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "If the account exists, an OTP was sent to the email"})
+}
+
+// LoginWithOTP logs the user in with a code from RequestLoginOTP
+func LoginWithOTP(c *fiber.Ctx) error {
+	req := new(OTPVerificationRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if err := OTPs.Verify(req.Email, utils.OTPPurposeLogin, req.OTP); err != nil {
+		return otpError(c, err)
+	}
+
+	var user models.User
+	if err := database.DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid email or OTP"})
+	}
+	if user.Blocked || !user.Verified {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "user is not authorized to access"})
+	}
+
+	tokens, err := issueSession(c, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	mergeGuestCartOnLogin(c, user, tokens)
+	tokens["message"] = "Login successful"
+	return c.Status(fiber.StatusOK).JSON(tokens)
+}
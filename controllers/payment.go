@@ -1,15 +1,13 @@
 package controllers
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jung-kurt/gofpdf"
 	"gorm.io/gorm"
@@ -23,68 +21,92 @@ func VerfyRazorpayPayment(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"status": "error", "message": "Review your payload", "data": err})
 	}
 	//Verify Razorypay signature
-	secret := os.Getenv("RAZORPAY_SECRET")
-	body := payload.RazorpayOrderID + "|" + payload.RazorpayPaymentID
-	computedSignature := hmac.New(sha256.New, []byte(secret))
-	computedSignature.Write([]byte(body))
-	expectedSignature := hex.EncodeToString(computedSignature.Sum(nil))
-
-	if payload.RazorpaySignature != expectedSignature {
+	if !PaymentGateway.VerifyPayment(payload.RazorpayOrderID, payload.RazorpayPaymentID, payload.RazorpaySignature) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Signature mismatch"})
 	}
 	//set the payment status to success
+	tx := database.DB.Begin()
+	defer tx.Rollback()
 	var payment models.Payment
-	if err := database.DB.Where("razorpay_payment_id = ?", payload.RazorpayOrderID).First(&payment).Error; err != nil {
+	if err := tx.Where("razorpay_payment_id = ? AND user_id = ?", payload.RazorpayOrderID, userID).First(&payment).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment not found"})
 	}
-	payment.PaymentStatus = "paid"
-	database.DB.Save(&payment)
-
-	//get the users cart and clear it after payment
-	var cart models.Cart
-	if err := database.DB.Where("user_id = ?", userID).First(&cart).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	refunded, err := markPaymentPaid(tx, &payment, payload.RazorpayPaymentID, ctxActor(c, models.RoleCustomer))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update payment"})
 	}
-	if err := ReducestockandDeleteCart(database.DB, &cart); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cart not found"})
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update payment"})
+	}
+	if refunded {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Order has expired or was canceled, the payment will be refunded"})
 	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Order paid successfully"})
 
 }
 
+// errOrderClosed is returned when an order is canceled or otherwise final and
+// can no longer be paid
+var errOrderClosed = errors.New("order can no longer be paid")
+
 func RetryPayment(c *fiber.Ctx) error {
-	InitRazorpay()
+	userID := c.Locals("user_id")
 	orderID:= c.Params("order_id")
+	var order models.Order
+	if err := database.DB.Where("id = ? AND user_id = ?", orderID, userID).First(&order).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	if models.IsFinalStatus(order.Status) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("Order is %s and can no longer be paid", order.Status)})
+	}
 	var payment models.Payment
-	if err:=database.DB.Where("order_id = ?",orderID).First(&payment).Error;err!=nil{
+	if err:=database.DB.Where("order_id = ?",order.ID).First(&payment).Error;err!=nil{
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment not found"})
 	}
 	if payment.PaymentStatus=="paid"{
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Payment already completed"})
 	}
-
-	//Initalize the payment for the order retry
-	amount:=float64(payment.Amount)
-	amount=amount*100
-	options:=map[string]interface{}{
-		"amount":amount,
-		"currency":"INR",
-		"receipt":fmt.Sprintf("order_%d",payment.OrderID),
-		"payment_capture":1,
+	if payment.PaymentStatus==PaymentStatusExpired{
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Order has expired, please place a new order"})
 	}
-	razorpayOrder, err := razorpayClient.Order.Create(options,nil)
+
+	// Create the gateway order first so no lock is held during the call. An
+	// attempt that is refused below just leaves it unpaid.
+	gatewayOrder, err := PaymentGateway.CreateOrder(float64(payment.Amount), "INR", fmt.Sprintf("order_%d", payment.OrderID))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create Razorpay order"})
 	}
-	payment.RazorpayPaymentID=razorpayOrder["id"].(string)
-	if err:=database.DB.Save(&payment).Error;err!=nil{
+
+	// Hold the stock again for this attempt and switch the payment to the new
+	// gateway order. The order is locked and checked again so it cannot be
+	// paid, canceled or expired meanwhile.
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockOrderPayment(tx, &payment)
+		if err != nil {
+			return err
+		}
+		if models.IsFinalStatus(locked.Status) {
+			return errOrderClosed
+		}
+		if err := renewReservations(tx, payment.OrderID); err != nil {
+			return err
+		}
+		return attachGatewayOrder(tx, &payment, gatewayOrder, ctxActor(c, models.RoleCustomer),
+			fmt.Sprintf("Payment retried with Razorpay order %s", gatewayOrder.ID))
+	}); err != nil {
+		if errors.Is(err, errOrderClosed) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Order can no longer be paid"})
+		}
+		if errors.Is(err, errOutOfStock) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Some items of this order are no longer in stock"})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update payment"})
 	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message":"Order placed successfully",
 		"order_id":payment.OrderID,
 		"amount":payment.Amount,
-		"razorpay_order_id": razorpayOrder["id"],
+		"razorpay_order_id": gatewayOrder.ID,
 		"currency":"INR",
 	})
 
@@ -96,8 +118,29 @@ func RetryPayment(c *fiber.Ctx) error {
 
 
 
+// attachGatewayOrder points an unpaid payment at a new gateway order and
+// records what it charges. The
+// update only applies while the payment is pending or failed, so a payment
+// that was settled or voided meanwhile is left alone and errOrderClosed is
+// returned.
+func attachGatewayOrder(tx *gorm.DB, payment *models.Payment, gatewayOrder utils.GatewayOrder, actor models.Actor, note string) error {
+	result := tx.Model(&models.Payment{}).
+		Where("id = ? AND payment_status IN ?", payment.ID, []string{"pending", "failed"}).
+		Updates(map[string]interface{}{"razorpay_payment_id": gatewayOrder.ID, "gateway_amount": gatewayOrder.Amount})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errOrderClosed
+	}
+	payment.RazorpayPaymentID = gatewayOrder.ID
+	payment.GatewayAmount = gatewayOrder.Amount
+	return recordOrderEvent(tx, models.OrderEvent{OrderID: payment.OrderID, Type: models.OrderEventPayment, Note: note}, actor)
+}
+
 func GenerateInvoicePdf(c *fiber.Ctx) error {
 	orderID := c.Params("order_id")
+	userID := c.Locals("user_id")
 
 	//Retrieve the order infromation from the database
 	var order models.Order
@@ -105,10 +148,10 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 		return db.Preload("Product", func(db *gorm.DB) *gorm.DB {
 			return db.Preload("Images")
 		})
-	}).First(&order, orderID).Error; err != nil {
+	}).Where("id = ? AND user_id = ?", orderID, userID).First(&order).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
 	}
-	if order.Status != "completed" {
+	if !models.IsInvoiceEligible(order.Status) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invoice cannot be generated for incomplited status"})
 	}
 	var orderpaymentdetails models.OrderPaymentDetail
@@ -119,7 +162,96 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 	if err := database.DB.Model(&models.User{}).Select("name").Where("id = ?", order.UserID).First(&name).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
-	ShippingAddress := fmt.Sprintf("%s, %s, %s, %s, %s", order.ShippingStreet, order.ShippingCity, order.ShippingState, order.ShippingCountry, order.ShippingZipCode)
+	return writeInvoicePdf(c, invoiceData{
+		Number:          orderID,
+		OrderID:         orderID,
+		CustomerName:    name,
+		ShippingAddress: fmt.Sprintf("%s, %s, %s, %s, %s", order.ShippingStreet, order.ShippingCity, order.ShippingState, order.ShippingCountry, order.ShippingZipCode),
+		PaymentMode:     paymentModeLabel(order.PaymentMode, orderpaymentdetails.WalletAmount),
+		Items:           order.Items,
+		Subtotal:        orderpaymentdetails.OrderAmount,
+		Discount:        orderpaymentdetails.OrderDiscount,
+		CouponSavings:   orderpaymentdetails.CouponSavings,
+		FinalAmount:     orderpaymentdetails.FinalOrderAmount,
+	})
+}
+
+// GenerateSubOrderInvoicePdf generates the invoice for one store's part of an order
+func GenerateSubOrderInvoicePdf(c *fiber.Ctx) error {
+	userID := c.Locals("user_id")
+	var order models.Order
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Params("order_id"), userID).First(&order).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	var subOrder models.SubOrder
+	if err := database.DB.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Product")
+	}).Where("id = ? AND order_id = ?", c.Params("sub_order_id"), order.ID).First(&subOrder).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	return sendSubOrderInvoice(c, &subOrder)
+}
+
+// sendSubOrderInvoice writes the invoice of a sub-order. Items must have
+// their Product loaded.
+func sendSubOrderInvoice(c *fiber.Ctx, subOrder *models.SubOrder) error {
+	if !models.IsInvoiceEligible(subOrder.Status) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invoice cannot be generated for incomplited status"})
+	}
+	var order models.Order
+	if err := database.DB.First(&order, subOrder.OrderID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	var name string
+	if err := database.DB.Model(&models.User{}).Select("name").Where("id = ?", order.UserID).First(&name).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	var store models.Store
+	database.DB.Unscoped().First(&store, subOrder.StoreID)
+	var detail models.OrderPaymentDetail
+	database.DB.Where("order_id = ?", order.ID).First(&detail)
+
+	return writeInvoicePdf(c, invoiceData{
+		Number:          fmt.Sprintf("%d-%d", order.ID, subOrder.ID),
+		OrderID:         fmt.Sprintf("%d", order.ID),
+		CustomerName:    name,
+		StoreName:       store.Name,
+		ShippingAddress: fmt.Sprintf("%s, %s, %s, %s, %s", order.ShippingStreet, order.ShippingCity, order.ShippingState, order.ShippingCountry, order.ShippingZipCode),
+		PaymentMode:     paymentModeLabel(order.PaymentMode, detail.WalletAmount),
+		Items:           subOrder.Items,
+		Subtotal:        subOrder.ItemsTotal + subOrder.OrderDiscount,
+		Discount:        subOrder.OrderDiscount,
+		CouponSavings:   subOrder.CouponShare,
+		FinalAmount:     subOrder.PaymentAllocation,
+	})
+}
+
+// paymentModeLabel describes how an order was paid, including the wallet
+// share of a split payment
+func paymentModeLabel(mode string, walletAmount float64) string {
+	if walletAmount > 0 {
+		return fmt.Sprintf("%s + WALLET (%.2f)", mode, walletAmount)
+	}
+	return mode
+}
+
+// invoiceData holds everything printed on an invoice
+type invoiceData struct {
+	Number          string
+	OrderID         string
+	CustomerName    string
+	StoreName       string // Set when the invoice covers a single store
+	ShippingAddress string
+	PaymentMode     string
+	Items           []models.OrderItem
+	Subtotal        float64
+	Discount        float64
+	CouponSavings   float64
+	FinalAmount     float64
+}
+
+// writeInvoicePdf renders an invoice and sends it as the response
+func writeInvoicePdf(c *fiber.Ctx, invoice invoiceData) error {
 	//Initalize the pdf generator
 	pdf := gofpdf.New("P", "mm", "A4", "")
 	pdf.AddPage()
@@ -144,16 +276,20 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 
 	// Order and Customer Details Section
 	pdf.SetFont("Arial", "", 12)
-	pdf.Cell(100, 10, fmt.Sprintf("Invoice Number: INV-%s", orderID))
+	pdf.Cell(100, 10, fmt.Sprintf("Invoice Number: INV-%s", invoice.Number))
 	pdf.Cell(90, 10, fmt.Sprintf("Date: %s", time.Now().Format("2006-01-02")))
 	pdf.Ln(8)
 
 	// Customer Details
-	pdf.Cell(100, 10, fmt.Sprintf("Customer: %s", name))
+	pdf.Cell(100, 10, fmt.Sprintf("Customer: %s", invoice.CustomerName))
 	pdf.Ln(6)
-	pdf.Cell(100, 10, fmt.Sprintf("Shipping Address: %s", ShippingAddress))
+	pdf.Cell(100, 10, fmt.Sprintf("Shipping Address: %s", invoice.ShippingAddress))
 	pdf.Ln(6)
 
+	if invoice.StoreName != "" {
+		pdf.Cell(100, 10, fmt.Sprintf("Sold By: %s", invoice.StoreName))
+		pdf.Ln(6)
+	}
 	pdf.Cell(100, 10, "GSTIN: UNREGISTERED")
 
 	pdf.Ln(6)
@@ -162,8 +298,8 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 
 	// Shipping Details
 	pdf.SetFont("Arial", "", 10)
-	pdf.Cell(100, 6, fmt.Sprintf("Order ID: %s", orderID))
-	pdf.Cell(90, 6, fmt.Sprintf("Payment Mode: %s", order.PaymentMode))
+	pdf.Cell(100, 6, fmt.Sprintf("Order ID: %s", invoice.OrderID))
+	pdf.Cell(90, 6, fmt.Sprintf("Payment Mode: %s", invoice.PaymentMode))
 	pdf.Ln(6)
 	pdf.Cell(100, 6, fmt.Sprintf("Carrier: %s", "DELHIVERY"))
 	pdf.Cell(90, 6, fmt.Sprintf("AWB Number: %s", "123456789"))
@@ -183,7 +319,7 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 
 	// Populate Table with Item Data
 	pdf.SetFont("Arial", "", 10)
-	for _, item := range order.Items {
+	for _, item := range invoice.Items {
 		// First line: Product name
 		currentY := pdf.GetY()
 		pdf.MultiCell(60, 10, item.Product.Name, "1", "L", false)
@@ -204,23 +340,20 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 	pdf.Ln(10)
 	pdf.SetFont("Arial", "B", 12)
 	pdf.CellFormat(150, 10, "Subtotal:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", orderpaymentdetails.OrderAmount), "", 1, "C", false, 0, "")
+	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", invoice.Subtotal), "", 1, "C", false, 0, "")
 
 	pdf.CellFormat(150, 10, "Discount:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", orderpaymentdetails.OrderDiscount), "", 1, "C", false, 0, "")
+	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", invoice.Discount), "", 1, "C", false, 0, "")
 
 	pdf.CellFormat(150, 10, "Coupon Savings:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", orderpaymentdetails.CouponSavings), "", 1, "C", false, 0, "")
-
-	pdf.CellFormat(150, 10, "Shipping Charge:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", orderpaymentdetails.ShippingCost), "", 1, "C", false, 0, "")
+	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", invoice.CouponSavings), "", 1, "C", false, 0, "")
 
 	pdf.CellFormat(150, 10, "GST:", "", 0, "R", false, 0, "")
 	pdf.CellFormat(40, 10, "NIL", "", 1, "C", false, 0, "")
 
 	pdf.SetFont("Arial", "B", 14)
 	pdf.CellFormat(150, 10, "Final Total:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", orderpaymentdetails.FinalOrderAmount), "", 1, "C", false, 0, "")
+	pdf.CellFormat(40, 10, fmt.Sprintf("$%.2f", invoice.FinalAmount), "", 1, "C", false, 0, "")
 
 	// Footer notes
 	pdf.Ln(10)
@@ -230,7 +363,7 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 	pdf.MultiCell(0, 5, "An Electronic document issued in accordance with the provisions of the Information Technology Act, 2000", "", "", false)
 
 	// Save the PDF to a file
-	filename := fmt.Sprintf("invoice_%s.pdf", orderID)
+	filename := fmt.Sprintf("invoice_%s.pdf", invoice.Number)
 	if err := pdf.OutputFileAndClose(filename); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate invoice PDF"})
 	}
@@ -238,3 +371,23 @@ func GenerateInvoicePdf(c *fiber.Ctx) error {
 	return c.SendFile(filename)
 
 }
+
+// MockGatewayPay pays an order on the mock payment gateway and returns what
+// the checkout page would send to the verify endpoint. It is only routed when
+// PAYMENT_PROVIDER is "mock".
+func MockGatewayPay(c *fiber.Ctx) error {
+	mock, ok := PaymentGateway.(*utils.MockProvider)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Mock payments are disabled"})
+	}
+	orderID := c.Params("razorpay_order_id")
+	paymentID, signature, err := mock.Pay(orderID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Razorpay order not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"razorpay_order_id":   orderID,
+		"razorpay_payment_id": paymentID,
+		"razorpay_signature":  signature,
+	})
+}
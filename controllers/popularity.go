@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// activeFeatured is true for products that are featured right now
+const activeFeatured = `(products.is_featured AND (products.featured_from IS NULL OR products.featured_from <= NOW())
+	AND (products.featured_until IS NULL OR products.featured_until > NOW()))`
+
+// productViewGap is how long repeat visits from the same client count as one
+// view
+const productViewGap = 30 * time.Minute
+
+// Product views are queued and written in batches by the recorder. Views
+// arriving while the queue is full are dropped rather than slow the page.
+const (
+	productViewQueue = 4096
+	productViewBatch = 500
+)
+
+// visitorCookie identifies a browser across visits for counting views
+const visitorCookie = "visitor_id"
+
+// productViews queues views for the recorder, nil until it is started
+var productViews chan models.ProductView
+
+// PopularityConfig weighs the signals of the popularity score. Every signal
+// loses half its weight each HalfLife and is ignored after Window.
+type PopularityConfig struct {
+	OrderWeight    float64 // per unit ordered
+	WishlistWeight float64 // per wishlist add
+	ViewWeight     float64 // per product view
+	HalfLife       time.Duration
+	Window         time.Duration
+}
+
+// popularityConfig reads the popularity weights from the environment
+func popularityConfig() PopularityConfig {
+	return PopularityConfig{
+		OrderWeight:    config.GetFloat("POPULARITY_ORDER_WEIGHT", 10),
+		WishlistWeight: config.GetFloat("POPULARITY_WISHLIST_WEIGHT", 3),
+		ViewWeight:     config.GetFloat("POPULARITY_VIEW_WEIGHT", 0.5),
+		HalfLife:       config.GetDuration("POPULARITY_HALF_LIFE", 7*24*time.Hour),
+		Window:         config.GetDuration("POPULARITY_WINDOW", 90*24*time.Hour),
+	}
+}
+
+// visitorKey identifies the client of a request. Browsers are given a
+// visitor cookie and are known by its hash from then on; clients that do not
+// keep cookies are known by their address.
+func visitorKey(c *fiber.Ctx) string {
+	if id := c.Cookies(visitorCookie); id != "" {
+		return utils.HashToken(id)
+	}
+	if id, _, err := utils.GenerateRefreshToken(); err == nil {
+		c.Cookie(&fiber.Cookie{
+			Name:     visitorCookie,
+			Value:    id,
+			Path:     "/api/v1/user",
+			Expires:  time.Now().Add(365 * 24 * time.Hour),
+			HTTPOnly: true,
+			Secure:   c.Protocol() == "https",
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	return c.IP()
+}
+
+// visitorKeys returns every key the client of a request may have been
+// recorded under by visitorKey: its address, and the hash of its visitor
+// cookie when it has one
+func visitorKeys(c *fiber.Ctx) []string {
+	keys := []string{c.IP()}
+	if id := c.Cookies(visitorCookie); id != "" {
+		keys = append(keys, utils.HashToken(id))
+	}
+	return keys
+}
+
+// recordProductView queues a visit to a product page for the recorder. It
+// never blocks the request.
+func recordProductView(productID uint, viewer string) {
+	select {
+	case productViews <- models.ProductView{ProductID: productID, Viewer: viewer, CreatedAt: time.Now()}:
+	default:
+	}
+}
+
+// StartProductViewRecorder writes queued product views in the background,
+// every interval or once a batch is full. Repeat visits from the same client
+// within productViewGap are counted once.
+func StartProductViewRecorder(db *gorm.DB, interval time.Duration) {
+	productViews = make(chan models.ProductView, productViewQueue)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		seen := make(map[string]time.Time)
+		var batch []models.ProductView
+		for {
+			select {
+			case view := <-productViews:
+				key := fmt.Sprintf("%d|%s", view.ProductID, view.Viewer)
+				if last, ok := seen[key]; ok && view.CreatedAt.Sub(last) < productViewGap {
+					continue
+				}
+				seen[key] = view.CreatedAt
+				batch = append(batch, view)
+				if len(batch) < productViewBatch {
+					continue
+				}
+			case now := <-ticker.C:
+				for key, last := range seen {
+					if now.Sub(last) >= productViewGap {
+						delete(seen, key)
+					}
+				}
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			if err := db.CreateInBatches(batch, productViewBatch).Error; err != nil {
+				log.Printf("Failed to record %d product views: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}()
+}
+
+// RecomputePopularity sets the popularity score of every product from its
+// orders, wishlist adds and views, each weighted by how recent it is.
+// Canceled and returned items do not count. Views older than the window are
+// deleted.
+func RecomputePopularity(db *gorm.DB, cfg PopularityConfig) error {
+	args := map[string]interface{}{
+		"order_weight":    cfg.OrderWeight,
+		"wishlist_weight": cfg.WishlistWeight,
+		"view_weight":     cfg.ViewWeight,
+		"half_life":       cfg.HalfLife.Seconds(),
+		"since":           time.Now().Add(-cfg.Window),
+		"excluded":        []string{models.OrderStatusCanceled, models.OrderStatusReturned},
+	}
+	err := db.Exec(`WITH signals AS (
+			SELECT product_id, quantity * @order_weight * POWER(0.5, EXTRACT(EPOCH FROM NOW() - created_at) / @half_life) AS score
+			FROM order_items WHERE deleted_at IS NULL AND created_at > @since AND status NOT IN @excluded
+			UNION ALL
+			SELECT product_id, @wishlist_weight * POWER(0.5, EXTRACT(EPOCH FROM NOW() - created_at) / @half_life)
+			FROM wishlist_items WHERE deleted_at IS NULL AND created_at > @since
+			UNION ALL
+			SELECT product_id, @view_weight * POWER(0.5, EXTRACT(EPOCH FROM NOW() - created_at) / @half_life)
+			FROM product_views WHERE created_at > @since
+		), totals AS (
+			SELECT product_id, SUM(score) AS score FROM signals GROUP BY product_id
+		)
+		UPDATE products SET popularity_score = COALESCE((SELECT ROUND(score::numeric, 4) FROM totals WHERE totals.product_id = products.id), 0)
+		WHERE popularity_score <> 0 OR id IN (SELECT product_id FROM totals)`, args).Error
+	if err != nil {
+		return err
+	}
+	return db.Where("created_at <= ?", args["since"]).Delete(&models.ProductView{}).Error
+}
+
+// StartPopularityJob recomputes popularity scores now and then every
+// interval in the background
+func StartPopularityJob(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := RecomputePopularity(db, popularityConfig()); err != nil {
+				log.Printf("Failed to recompute product popularity: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// SetProductFeatured features a product or stops featuring it. featured_from
+// and featured_until (RFC 3339 or YYYY-MM-DD) limit when it is featured and
+// rank orders featured products, lowest first.
+func SetProductFeatured(c *fiber.Ctx) error {
+	var req struct {
+		Featured      bool   `json:"featured"`
+		FeaturedFrom  string `json:"featured_from"`
+		FeaturedUntil string `json:"featured_until"`
+		Rank          int    `json:"rank"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	from, err := parseFeaturedTime(req.FeaturedFrom)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid featured_from, use RFC 3339 or YYYY-MM-DD"})
+	}
+	until, err := parseFeaturedTime(req.FeaturedUntil)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid featured_until, use RFC 3339 or YYYY-MM-DD"})
+	}
+	if from != nil && until != nil && !until.After(*from) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "featured_until must be after featured_from"})
+	}
+
+	var product models.Product
+	if err := database.DB.First(&product, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
+	}
+	updates := map[string]interface{}{
+		"is_featured":    req.Featured,
+		"featured_from":  from,
+		"featured_until": until,
+		"featured_rank":  req.Rank,
+	}
+	if !req.Featured {
+		updates["featured_from"], updates["featured_until"], updates["featured_rank"] = nil, nil, 0
+	}
+	// UpdateColumns skips the Product hooks, which would act on a partial row
+	if err := database.DB.Model(&product).UpdateColumns(updates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update product"})
+	}
+	if err := database.DB.First(&product, product.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load product"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":        "Featured settings updated successfully",
+		"product_id":     product.ID,
+		"is_featured":    product.IsFeatured,
+		"featured_from":  product.FeaturedFrom,
+		"featured_until": product.FeaturedUntil,
+		"featured_rank":  product.FeaturedRank,
+	})
+}
+
+// parseFeaturedTime reads an optional RFC 3339 time or date
+func parseFeaturedTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", value); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// ListFeaturedProductsAdmin returns every product flagged as featured with
+// its schedule and whether it is featured right now
+func ListFeaturedProductsAdmin(c *fiber.Ctx) error {
+	var products []struct {
+		ID            uint       `json:"id"`
+		Name          string     `json:"name"`
+		FeaturedFrom  *time.Time `json:"featured_from"`
+		FeaturedUntil *time.Time `json:"featured_until"`
+		FeaturedRank  int        `json:"featured_rank"`
+		Active        bool       `json:"active"`
+	}
+	if err := database.DB.Model(&models.Product{}).
+		Select("id, name, featured_from, featured_until, featured_rank, " + activeFeatured + " AS active").
+		Where("is_featured").Order("featured_rank, id").Scan(&products).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch featured products"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"products": products})
+}
+
+// GetFeaturedProducts returns the products featured right now, in rank order
+func GetFeaturedProducts(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		limit = 20
+	}
+	var products []models.Product
+	if err := database.DB.Preload("Category").Preload("Store").Preload("Images", "variant_id IS NULL").
+		Where("is_active = ?", true).Where(activeFeatured).
+		Order("featured_rank, popularity_score DESC").Limit(limit).Find(&products).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch featured products"})
+	}
+	productResponses := make([]models.ProductResponse, len(products))
+	for i, product := range products {
+		productResponses[i] = models.ProductResponse{
+			ID:            product.ID,
+			Name:          product.Name,
+			Description:   product.Description,
+			Price:         product.Price,
+			StockQuantity: product.StockQuantity,
+			IsActive:      product.IsActive,
+			AverageRating: product.AverageRating,
+			RatingCount:   product.RatingCount,
+			Category: models.CategoryResponse{
+				ID:   product.Category.ID,
+				Name: product.Category.Name,
+			},
+			Store: models.StoreResponse{
+				ID:   product.Store.ID,
+				Name: product.Store.Name,
+			},
+			Images: make([]string, len(product.Images)),
+		}
+		for j, image := range product.Images {
+			productResponses[i].Images[j] = image.URL
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Featured products retrieved successfully", "products": productResponses})
+}
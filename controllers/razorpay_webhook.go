@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RazorpayWebhookEvent is the part of a Razorpay webhook body we act on
+type RazorpayWebhookEvent struct {
+	Event   string `json:"event"`
+	Payload struct {
+		Payment struct {
+			Entity struct {
+				ID               string `json:"id"`
+				OrderID          string `json:"order_id"`
+				Amount           int64  `json:"amount"`
+				Status           string `json:"status"`
+				ErrorDescription string `json:"error_description"`
+			} `json:"entity"`
+		} `json:"payment"`
+		Order struct {
+			Entity struct {
+				ID     string `json:"id"`
+				Status string `json:"status"`
+			} `json:"entity"`
+		} `json:"order"`
+		Refund struct {
+			Entity struct {
+				ID        string `json:"id"`
+				PaymentID string `json:"payment_id"`
+				Amount    int64  `json:"amount"`
+				Status    string `json:"status"`
+			} `json:"entity"`
+		} `json:"refund"`
+	} `json:"payload"`
+}
+
+// RazorpayWebhook receives payment and refund notifications from Razorpay.
+// The body is checked against the X-Razorpay-Signature header and every event
+// is processed at most once.
+func RazorpayWebhook(c *fiber.Ctx) error {
+	body := c.Body()
+	if !PaymentGateway.VerifyWebhook(body, c.Get("X-Razorpay-Signature")) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Signature mismatch"})
+	}
+
+	var event RazorpayWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payload"})
+	}
+	eventID := c.Get("X-Razorpay-Event-Id")
+	if eventID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing event id"})
+	}
+
+	processed, err := HandleRazorpayWebhook(database.DB, eventID, body, event)
+	if err != nil {
+		log.Printf("Failed to process razorpay webhook %s: %v", eventID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to process event"})
+	}
+	if !processed {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Event already processed"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Event processed"})
+}
+
+// HandleRazorpayWebhook processes a verified webhook event in a transaction.
+// It returns false when the event id has been seen before. Recorded payloads
+// can be replayed through it directly.
+func HandleRazorpayWebhook(db *gorm.DB, eventID string, body []byte, event RazorpayWebhookEvent) (bool, error) {
+	processed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		record := models.WebhookEvent{Provider: "razorpay", EventID: eventID, Event: event.Event, Payload: string(body)}
+		result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "event_id"}}, DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		processed = true
+		return processRazorpayEvent(tx, event)
+	})
+	return processed, err
+}
+
+func processRazorpayEvent(tx *gorm.DB, event RazorpayWebhookEvent) error {
+	payment := event.Payload.Payment.Entity
+	switch event.Event {
+	case "payment.captured", "order.paid":
+		orderID := payment.OrderID
+		if orderID == "" {
+			orderID = event.Payload.Order.Entity.ID
+		}
+		record, err := paymentByGatewayOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			topUp, err := topUpByGatewayOrder(tx, orderID)
+			if err != nil || topUp == nil {
+				return err
+			}
+			_, err = creditTopUp(tx, topUp, payment.ID)
+			return err
+		}
+		_, err = markPaymentPaid(tx, record, payment.ID, models.SystemActor)
+		return err
+
+	case "payment.failed":
+		record, err := paymentByGatewayOrder(tx, payment.OrderID)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return tx.Model(&models.WalletTopUp{}).
+				Where("gateway_order_id = ? AND status = ?", payment.OrderID, "pending").
+				Update("status", "failed").Error
+		}
+		if record.PaymentStatus != "pending" {
+			return nil
+		}
+		if err := tx.Model(record).Update("payment_status", "failed").Error; err != nil {
+			return err
+		}
+		// Free the stock, retrying the payment reserves it again
+		if err := releaseReservations(tx, record.OrderID); err != nil {
+			return err
+		}
+		return recordOrderEvent(tx, models.OrderEvent{
+			OrderID: record.OrderID,
+			Type:    models.OrderEventPayment,
+			Note:    fmt.Sprintf("Razorpay payment %s failed: %s", payment.ID, payment.ErrorDescription),
+		}, models.SystemActor)
+
+	case "refund.processed", "refund.failed":
+		refund := event.Payload.Refund.Entity
+		record, err := refundByGatewayID(tx, refund.ID)
+		if err != nil || record == nil {
+			return err
+		}
+		status := models.RefundStatusProcessed
+		if event.Event == "refund.failed" {
+			status = models.RefundStatusFailed
+		}
+		return settleRefund(tx, record, status)
+	}
+	return nil
+}
+
+// paymentByGatewayOrder finds the payment created for a Razorpay order. A
+// missing payment is not an error since the event may belong to another
+// integration on the same account.
+func paymentByGatewayOrder(tx *gorm.DB, gatewayOrderID string) (*models.Payment, error) {
+	if gatewayOrderID == "" {
+		return nil, nil
+	}
+	var payment models.Payment
+	if err := tx.Where("razorpay_payment_id = ?", gatewayOrderID).First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// lockOrderPayment locks the order of a payment and then the payment itself,
+// reloading both. Everything that changes the payment status of an order
+// locks in this order so they wait for each other without deadlocking.
+func lockOrderPayment(tx *gorm.DB, payment *models.Payment) (*models.Order, error) {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, payment.OrderID).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, payment.ID).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// chargedAmount is what the customer paid through the gateway for a payment.
+// Payments made before gateway amounts were recorded charged Amount.
+func chargedAmount(payment models.Payment) float64 {
+	if payment.GatewayAmount > 0 {
+		return payment.GatewayAmount
+	}
+	return payment.Amount
+}
+
+// voidPayment cancels the unpaid payment of an order that was canceled, so
+// a payment that still arrives for it is refunded. The caller must have
+// locked the order.
+func voidPayment(tx *gorm.DB, orderID uint, actor models.Actor) error {
+	result := tx.Model(&models.Payment{}).
+		Where("order_id = ? AND payment_status IN ?", orderID, []string{"pending", "failed"}).
+		Update("payment_status", PaymentStatusCanceled)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return recordOrderEvent(tx, models.OrderEvent{OrderID: orderID, Type: models.OrderEventPayment, Note: "Payment canceled with the order"}, actor)
+}
+
+// markPaymentPaid marks an online payment as paid, reduces the stock and
+// clears the customer's cart. Calling it again for a paid payment does
+// nothing, so the checkout callback and the webhook can both call it. A
+// payment that arrives after its order expired or was canceled, or after the
+// stock of a lapsed hold was sold, is refunded instead, which is reported by
+// returning true.
+func markPaymentPaid(tx *gorm.DB, payment *models.Payment, gatewayPaymentID string, actor models.Actor) (bool, error) {
+	// Lock the order and payment so the order cannot be canceled or expired
+	// meanwhile
+	order, err := lockOrderPayment(tx, payment)
+	if err != nil {
+		return false, err
+	}
+	if payment.PaymentStatus == "paid" {
+		return false, nil
+	}
+	reason := ""
+	switch {
+	case payment.PaymentStatus == PaymentStatusExpired:
+		reason = "Payment received after the order expired"
+	case payment.PaymentStatus == PaymentStatusCanceled || models.IsFinalStatus(order.Status):
+		reason = "Payment received after the order was canceled"
+	}
+	reserved := false
+	if reason == "" {
+		// Take the reserved stock. If a hold lapsed and its units were sold
+		// meanwhile, the order is canceled and the payment refunded instead.
+		reserved, err = convertReservations(tx, payment.OrderID)
+		if errors.Is(err, errOutOfStock) {
+			// The canceled items give back the wallet share of a split
+			// payment now, the gateway share is refunded once it is marked
+			// paid below
+			if err := transitionOrder(tx, order, models.OrderStatusCanceled, models.SystemActor, "Canceled, items sold out before the payment arrived", models.RefundMethodWallet); err != nil {
+				return false, err
+			}
+			reason = "Payment received after the items sold out"
+		} else if err != nil {
+			return false, err
+		}
+	}
+	payment.PaymentStatus = "paid"
+	payment.GatewayPaymentID = gatewayPaymentID
+	if err := tx.Model(payment).Updates(map[string]interface{}{
+		"payment_status":     payment.PaymentStatus,
+		"gateway_payment_id": payment.GatewayPaymentID,
+	}).Error; err != nil {
+		return false, err
+	}
+	if err := recordOrderEvent(tx, models.OrderEvent{
+		OrderID: payment.OrderID,
+		Type:    models.OrderEventPayment,
+		Note:    fmt.Sprintf("Razorpay payment %s received", gatewayPaymentID),
+	}, actor); err != nil {
+		return false, err
+	}
+	if reason != "" {
+		// The wallet share was returned when the order was canceled, only the
+		// late gateway payment is left to refund. Its stock was released and
+		// the cart may have been refilled since, so neither is touched.
+		_, err := refundTender(tx, *order, *payment, nil, chargedAmount(*payment), models.RefundMethodSource, reason)
+		return true, err
+	}
+	// Items canceled before the payment arrived lowered the amount due but
+	// not the gateway order, so the difference goes back
+	if excess := chargedAmount(*payment) - payment.Amount; excess >= 0.01 {
+		if _, err := refundTender(tx, *order, *payment, nil, excess, models.RefundMethodSource, "Items canceled before the payment arrived"); err != nil {
+			return false, err
+		}
+	}
+	notifyOrderConfirmed(tx, payment.OrderID)
+
+	//get the users cart and clear it after payment
+	var cart models.Cart
+	if err := tx.Where("user_id = ?", payment.UserID).First(&cart).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	// Orders placed before reservations take their stock from the cart
+	if !reserved {
+		return false, ReducestockandDeleteCart(tx, &cart)
+	}
+	return false, tx.Delete(&cart).Error
+}
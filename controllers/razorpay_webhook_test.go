@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Webhook bodies as Razorpay sends them, trimmed to the fields that matter.
+// {payment_id}, {order_id} and {refund_id} are filled in per test.
+const (
+	paymentCapturedPayload = `{"entity":"event","account_id":"acc_test","event":"payment.captured","contains":["payment"],"payload":{"payment":{"entity":{"id":"{payment_id}","entity":"payment","amount":100000,"currency":"INR","status":"captured","order_id":"{order_id}","method":"upi","captured":true,"error_description":null}}},"created_at":1718000000}`
+	paymentFailedPayload   = `{"entity":"event","account_id":"acc_test","event":"payment.failed","contains":["payment"],"payload":{"payment":{"entity":{"id":"{payment_id}","entity":"payment","amount":100000,"currency":"INR","status":"failed","order_id":"{order_id}","method":"card","captured":false,"error_code":"BAD_REQUEST_ERROR","error_description":"Payment was cancelled by the user"}}},"created_at":1718000000}`
+	refundProcessedPayload = `{"entity":"event","account_id":"acc_test","event":"refund.processed","contains":["refund","payment"],"payload":{"refund":{"entity":{"id":"{refund_id}","entity":"refund","amount":40000,"currency":"INR","payment_id":"{payment_id}","status":"processed","speed_processed":"normal"}},"payment":{"entity":{"id":"{payment_id}","entity":"payment","amount":100000,"currency":"INR","status":"refunded","order_id":"{order_id}"}}},"created_at":1718000000}`
+)
+
+// webhookFixture is an order placed with the mock gateway and paid there,
+// with the gateway not having told us yet
+type webhookFixture struct {
+	orderID        uint
+	gatewayOrderID string
+	paymentID      string
+	refundID       string
+}
+
+func newWebhookFixture(t *testing.T, db *gorm.DB, mock *utils.MockProvider) webhookFixture {
+	t.Helper()
+	f := newCheckoutFixture(t, db)
+	status, placed := postJSON(t, checkoutApp(f.user.ID), "/checkout", models.OrderRequest{AddressID: fmt.Sprint(f.address.ID), PaymentMode: "razorpay"})
+	if status != fiber.StatusOK {
+		t.Fatalf("place order: status %d, body %v", status, placed)
+	}
+	w := webhookFixture{orderID: uint(placed["order_id"].(float64))}
+	w.gatewayOrderID, _ = placed["razorpay_order_id"].(string)
+	paymentID, _, err := mock.Pay(w.gatewayOrderID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	w.paymentID = paymentID
+	return w
+}
+
+// payload fills the ids of the fixture into a recorded webhook body
+func (w webhookFixture) payload(recorded string) []byte {
+	return []byte(strings.NewReplacer("{payment_id}", w.paymentID, "{order_id}", w.gatewayOrderID, "{refund_id}", w.refundID).Replace(recorded))
+}
+
+func postWebhook(t *testing.T, app *fiber.App, eventID string, body []byte, signature string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Razorpay-Event-Id", eventID)
+	req.Header.Set("X-Razorpay-Signature", signature)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("POST /webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	message, _ := result["message"].(string)
+	return resp.StatusCode, message
+}
+
+func loadPayment(t *testing.T, db *gorm.DB, orderID uint) models.Payment {
+	t.Helper()
+	var payment models.Payment
+	if err := db.Where("order_id = ?", orderID).First(&payment).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	return payment
+}
+
+func loadReservation(t *testing.T, db *gorm.DB, orderID uint) models.StockReservation {
+	t.Helper()
+	var reservation models.StockReservation
+	if err := db.Where("order_id = ?", orderID).First(&reservation).Error; err != nil {
+		t.Fatalf("load reservation: %v", err)
+	}
+	return reservation
+}
+
+func TestRazorpayWebhookEvents(t *testing.T) {
+	db := setupCheckoutDB(t)
+	database.DB = db
+	mock := utils.NewMockProvider("test_secret")
+	PaymentGateway = mock
+	app := fiber.New()
+	app.Post("/webhook", RazorpayWebhook)
+
+	tests := []struct {
+		name     string
+		recorded string
+		// setup prepares what the event refers to beyond the paid order
+		setup      func(t *testing.T, w *webhookFixture)
+		badSig     bool
+		deliveries int // times the same event is delivered
+		status     int
+		message    string // message of the last delivery
+		check      func(t *testing.T, w webhookFixture)
+	}{
+		{
+			name:     "payment.captured marks the payment paid",
+			recorded: paymentCapturedPayload,
+			status:   fiber.StatusOK,
+			message:  "Event processed",
+			check: func(t *testing.T, w webhookFixture) {
+				payment := loadPayment(t, db, w.orderID)
+				if payment.PaymentStatus != "paid" || payment.GatewayPaymentID != w.paymentID {
+					t.Fatalf("payment = %s by %q, want paid by %s", payment.PaymentStatus, payment.GatewayPaymentID, w.paymentID)
+				}
+				if reservation := loadReservation(t, db, w.orderID); reservation.Status != models.ReservationConverted {
+					t.Fatalf("reservation = %s, want converted", reservation.Status)
+				}
+			},
+		},
+		{
+			name:     "payment.failed releases the stock",
+			recorded: paymentFailedPayload,
+			status:   fiber.StatusOK,
+			message:  "Event processed",
+			check: func(t *testing.T, w webhookFixture) {
+				if payment := loadPayment(t, db, w.orderID); payment.PaymentStatus != "failed" {
+					t.Fatalf("payment = %s, want failed", payment.PaymentStatus)
+				}
+				if reservation := loadReservation(t, db, w.orderID); reservation.Status != models.ReservationReleased {
+					t.Fatalf("reservation = %s, want released", reservation.Status)
+				}
+			},
+		},
+		{
+			name:       "a duplicate event id is processed once",
+			recorded:   paymentCapturedPayload,
+			deliveries: 2,
+			status:     fiber.StatusOK,
+			message:    "Event already processed",
+			check: func(t *testing.T, w webhookFixture) {
+				if payment := loadPayment(t, db, w.orderID); payment.PaymentStatus != "paid" {
+					t.Fatalf("payment = %s, want paid", payment.PaymentStatus)
+				}
+				var events int64
+				db.Model(&models.OrderEvent{}).Where("order_id = ? AND note = ?", w.orderID, fmt.Sprintf("Razorpay payment %s received", w.paymentID)).Count(&events)
+				if events != 1 {
+					t.Fatalf("payment recorded %d times, want once", events)
+				}
+			},
+		},
+		{
+			name:     "refund.processed settles the refund",
+			recorded: refundProcessedPayload,
+			setup: func(t *testing.T, w *webhookFixture) {
+				payment := loadPayment(t, db, w.orderID)
+				w.refundID = fmt.Sprintf("rfnd_test_%d", time.Now().UnixNano())
+				refund := models.Refund{OrderID: w.orderID, PaymentID: payment.ID, UserID: payment.UserID, Amount: 400, Method: models.RefundMethodSource, GatewayRefundID: w.refundID, Status: models.RefundStatusPending}
+				if err := db.Create(&refund).Error; err != nil {
+					t.Fatalf("create refund: %v", err)
+				}
+			},
+			status:  fiber.StatusOK,
+			message: "Event processed",
+			check: func(t *testing.T, w webhookFixture) {
+				var refund models.Refund
+				if err := db.Where("gateway_refund_id = ?", w.refundID).First(&refund).Error; err != nil {
+					t.Fatalf("load refund: %v", err)
+				}
+				if refund.Status != models.RefundStatusProcessed || refund.ProcessedAt == nil {
+					t.Fatalf("refund = %s, want processed", refund.Status)
+				}
+			},
+		},
+		{
+			name:     "a bad signature is rejected",
+			recorded: paymentCapturedPayload,
+			badSig:   true,
+			status:   fiber.StatusUnauthorized,
+			check: func(t *testing.T, w webhookFixture) {
+				if payment := loadPayment(t, db, w.orderID); payment.PaymentStatus != "pending" {
+					t.Fatalf("payment = %s, want pending", payment.PaymentStatus)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWebhookFixture(t, db, mock)
+			if tt.setup != nil {
+				tt.setup(t, &w)
+			}
+			body := w.payload(tt.recorded)
+			signature := mock.Sign(body)
+			if tt.badSig {
+				signature = utils.NewMockProvider("other_secret").Sign(body)
+			}
+			eventID := fmt.Sprintf("evt_test_%d", time.Now().UnixNano())
+			deliveries := tt.deliveries
+			if deliveries == 0 {
+				deliveries = 1
+			}
+			var status int
+			var message string
+			for i := 0; i < deliveries; i++ {
+				status, message = postWebhook(t, app, eventID, body, signature)
+			}
+			if status != tt.status || message != tt.message {
+				t.Fatalf("webhook = %d %q, want %d %q", status, message, tt.status, tt.message)
+			}
+			tt.check(t, w)
+		})
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
 	"github.com/gofiber/fiber/v2"
-	
+	"gorm.io/gorm"
 )
 
 func GenerateReferralLink(c *fiber.Ctx) error {
@@ -32,48 +32,16 @@ func ClaimReferral(referralName string, referralCode string, reffere uint) error
 		return err
 	}
 
-	// Get the wallet of the referrer
-	referrerWallet := new(models.Wallet)
-	err := database.DB.Where("user_id = ?", user.ID).First(&referrerWallet).Error
-	if err != nil {
-		return err
-	}
-
-	// Get the wallet of the referred user
-	referredWallet := new(models.Wallet)
-	err = database.DB.Where("user_id = ?", reffere).First(&referredWallet).Error
-	if err != nil {
-		return err
-	}
-
 	// Define the reward amount
 	rewardAmount := 100.0
-
-	// Update referrer's wallet balance and create history entry
-	referrerWallet.Balance += rewardAmount
-	history := models.WalletHistory{
-		WalletID:  referrerWallet.ID,
-		UserID:   user.ID,
-		Amount:   rewardAmount,
-		Operation: "credit",
-		Balance:  referrerWallet.Balance,
-		Reason:   "Referral reward",
-	}
-	database.DB.Model(&referrerWallet).Updates(referrerWallet)
-	database.DB.Create(&history)
-
-	// Update referred user's wallet balance and create history entry
-	referredWallet.Balance += rewardAmount
-	history = models.WalletHistory{
-		WalletID:  referredWallet.ID,
-		UserID:   reffere,
-		Amount:   rewardAmount,
-		Operation: "credit",
-		Balance:  referredWallet.Balance,
-		Reason:   "Referral bonus",
-	}
-	database.DB.Model(&referredWallet).Updates(referredWallet)
-	database.DB.Create(&history)
-
-	return nil
-}
\ No newline at end of file
+	reference := fmt.Sprintf("referral:%d:%d", user.ID, reffere)
+
+	// Credit both wallets together so a failure leaves neither rewarded
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := creditWallet(tx, user.ID, rewardAmount, models.LedgerAccountReferrals, "Referral reward", reference); err != nil {
+			return err
+		}
+		_, err := creditWallet(tx, reffere, rewardAmount, models.LedgerAccountReferrals, "Referral bonus", reference)
+		return err
+	})
+}
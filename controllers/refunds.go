@@ -0,0 +1,434 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RefundRequest lets the customer pick where a refund goes when canceling
+type RefundRequest struct {
+	RefundMethod string `json:"refund_method"` // "wallet" (default) or "source"
+}
+
+// refundMethod reads the optional refund method from the request body
+func refundMethod(c *fiber.Ctx) (string, error) {
+	req := RefundRequest{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return "", err
+		}
+	}
+	return parseRefundMethod(req.RefundMethod)
+}
+
+func parseRefundMethod(method string) (string, error) {
+	switch method {
+	case "", models.RefundMethodWallet:
+		return models.RefundMethodWallet, nil
+	case models.RefundMethodSource:
+		return models.RefundMethodSource, nil
+	}
+	return "", fmt.Errorf("invalid refund method %q", method)
+}
+
+// paymentSettled reports whether the customer has actually paid. COD orders
+// are only paid once delivered and online orders once the gateway confirms.
+func paymentSettled(payment models.Payment) bool {
+	return payment.PaymentStatus == "paid" || payment.PaymentStatus == "success"
+}
+
+// refundOrder refunds amount of an order to its customer. A split payment is
+// refunded in the proportions it was paid: the wallet share goes back to the
+// wallet and the rest to the other tender. Only tenders that were actually
+// paid are refunded, so it returns no refunds for an unpaid order.
+func refundOrder(tx *gorm.DB, order models.Order, itemID *uint, amount float64, method, reason string) ([]models.Refund, error) {
+	var payment models.Payment
+	if err := tx.Where("order_id = ?", order.ID).First(&payment).Error; err != nil {
+		return nil, err
+	}
+	roundAmount(&amount)
+	walletShare, tenderShare := splitRefund(payment, amount)
+
+	var refunds []models.Refund
+	if walletShare > 0 {
+		refund, err := refundToWallet(tx, order, payment, itemID, walletShare, reason)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, *refund)
+	}
+	if tenderShare > 0 && paymentSettled(payment) {
+		refund, err := refundTender(tx, order, payment, itemID, tenderShare, method, reason)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, *refund)
+	}
+	if len(refunds) == 0 {
+		err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, OrderItemID: itemID, Type: models.OrderEventRefund, Note: "Nothing refunded, the order was not paid"}, models.SystemActor)
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// splitRefund splits amount in the proportions a payment was made in: the
+// wallet share and the share of the other tender
+func splitRefund(payment models.Payment, amount float64) (float64, float64) {
+	walletShare := 0.0
+	if payment.WalletAmount > 0 && amount > 0 {
+		walletShare = amount * payment.WalletAmount / (payment.WalletAmount + payment.Amount)
+		roundAmount(&walletShare)
+	}
+	tenderShare := amount - walletShare
+	roundAmount(&tenderShare)
+	return walletShare, tenderShare
+}
+
+// refundCanceledItem takes a canceled item out of the amounts of its order
+// and refunds its share. The coupon is dropped when the rest of the order no
+// longer qualifies for it, and the last item left takes whatever remains of
+// the order total. On an order that is not paid yet the tender share is taken
+// off the amount due instead; a gateway order created for more is refunded
+// the difference once it is paid. It is a side effect of canceling an item,
+// which locks the order first.
+func refundCanceledItem(tx *gorm.DB, order *models.Order, item models.OrderItem, method string) ([]models.Refund, error) {
+	// Orders placed before payment details were kept have none to update
+	var detail models.OrderPaymentDetail
+	if err := tx.Where("order_id = ?", order.ID).First(&detail).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ?", order.ID).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	remaining := 0.0
+	for _, other := range items {
+		if other.ID != item.ID && !models.IsFinalStatus(other.Status) {
+			remaining += other.TotalPrice
+		}
+	}
+
+	// Check if the rest of the order still meets the coupon requirement
+	savings := 0.0
+	if remaining > 0 && detail.CouponCode != "" {
+		var coupon models.Coupon
+		err := tx.Where("code = ?", detail.CouponCode).First(&coupon).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// The coupon is gone, keep its discount on the rest of the order
+			savings = detail.CouponSavings * remaining / (remaining + item.TotalPrice)
+		case err != nil:
+			return nil, err
+		case remaining >= coupon.MinPurchaseAmount:
+			savings = remaining * coupon.Discount / 100
+		}
+	}
+	roundAmount(&savings)
+	total := remaining - savings
+	roundAmount(&total)
+	refundAmount := math.Max(order.TotalAmount-total, 0)
+	roundAmount(&refundAmount)
+
+	var product models.Product
+	if err := tx.Unscoped().Select("price").First(&product, item.ProductID).Error; err != nil {
+		return nil, err
+	}
+	detail.OrderAmount -= product.Price
+	detail.OrderDiscount -= (product.Price * float64(item.Quantity)) - item.TotalPrice
+	detail.CouponSavings = savings
+	if savings == 0 {
+		detail.CouponCode = ""
+	}
+	detail.FinalOrderAmount = order.TotalAmount - refundAmount
+	if detail.ID != 0 {
+		if err := tx.Save(&detail).Error; err != nil {
+			return nil, err
+		}
+	}
+	order.TotalAmount = detail.FinalOrderAmount
+	if err := tx.Model(order).Update("total_amount", order.TotalAmount).Error; err != nil {
+		return nil, err
+	}
+	if err := reduceSubOrderAmounts(tx, item, refundAmount); err != nil {
+		return nil, err
+	}
+
+	var payment models.Payment
+	if err := tx.Where("order_id = ?", order.ID).First(&payment).Error; err != nil {
+		return nil, err
+	}
+	refunds, err := refundOrder(tx, *order, &item.ID, refundAmount, method, "Order cancellation refund")
+	if err != nil {
+		return nil, err
+	}
+	if paymentSettled(payment) || refundAmount == 0 {
+		return refunds, nil
+	}
+	// The wallet share was given back above, the rest is no longer due
+	walletShare, tenderShare := splitRefund(payment, refundAmount)
+	if err := tx.Model(&payment).Updates(map[string]interface{}{
+		"amount":        gorm.Expr("GREATEST(amount - ?, 0)", tenderShare),
+		"wallet_amount": gorm.Expr("GREATEST(wallet_amount - ?, 0)", walletShare),
+	}).Error; err != nil {
+		return nil, err
+	}
+	return refunds, recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, OrderItemID: &item.ID, Type: models.OrderEventPayment, Note: fmt.Sprintf("Amount due lowered by %.2f", tenderShare)}, models.SystemActor)
+}
+
+// itemRefunds returns the refunds made for the given order items
+func itemRefunds(tx *gorm.DB, itemIDs []uint) ([]models.Refund, error) {
+	refunds := []models.Refund{}
+	if len(itemIDs) == 0 {
+		return refunds, nil
+	}
+	err := tx.Where("order_item_id IN ?", itemIDs).Order("id").Find(&refunds).Error
+	return refunds, err
+}
+
+// refundTender refunds amount of the non-wallet part of a payment. With the
+// "source" method an online payment is refunded through the gateway, anything
+// else is credited to the wallet. Gateway refunds are only queued here and
+// sent by IssueQueuedRefunds once tx has committed, so a rolled back
+// transaction never leaves money refunded without a record of it.
+func refundTender(tx *gorm.DB, order models.Order, payment models.Payment, itemID *uint, amount float64, method, reason string) (*models.Refund, error) {
+	// Only gateway payments can go back to source, the rest go to the wallet
+	if method != models.RefundMethodSource || payment.PaymentType != "razorpay" || payment.GatewayPaymentID == "" {
+		return refundToWallet(tx, order, payment, itemID, amount, reason)
+	}
+	refund := models.Refund{
+		OrderID:     order.ID,
+		OrderItemID: itemID,
+		PaymentID:   payment.ID,
+		UserID:      order.UserID,
+		Amount:      amount,
+		Method:      models.RefundMethodSource,
+		Status:      models.RefundStatusPending,
+		Reason:      reason,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, err
+	}
+	if err := recordOrderEvent(tx, models.OrderEvent{OrderID: order.ID, OrderItemID: itemID, Type: models.OrderEventRefund, Note: fmt.Sprintf("Refund of %.2f to original payment method queued", amount)}, models.SystemActor); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// refundKey is the idempotency key a refund is issued with on the gateway
+func refundKey(refund *models.Refund) string {
+	return fmt.Sprintf("refund_%d", refund.ID)
+}
+
+// issueRefund sends a queued refund to source to the gateway. The refund row
+// is locked with SKIP LOCKED so only one instance issues it; no order or
+// payment row is locked during the gateway call. The refund id is the
+// idempotency key, so a refund issued before its gateway id could be saved is
+// picked up again rather than refunded twice.
+func issueRefund(db *gorm.DB, refundID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var refund models.Refund
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id = ? AND status = ? AND gateway_refund_id = ''", refundID, models.RefundStatusPending).
+			First(&refund).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		var payment models.Payment
+		if err := tx.First(&payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		gatewayRefund, err := PaymentGateway.Refund(payment.GatewayPaymentID, refund.Amount, refundKey(&refund))
+		if errors.Is(err, utils.ErrGatewayNotFound) {
+			// The gateway does not know the payment, credit the wallet instead
+			return settleRefund(tx, &refund, models.RefundStatusFailed)
+		}
+		if err != nil {
+			return err
+		}
+		refund.GatewayRefundID = gatewayRefund.ID
+		if err := tx.Model(&refund).Update("gateway_refund_id", refund.GatewayRefundID).Error; err != nil {
+			return err
+		}
+		if err := recordOrderEvent(tx, models.OrderEvent{OrderID: refund.OrderID, OrderItemID: refund.OrderItemID, Type: models.OrderEventRefund, Note: fmt.Sprintf("Refund %s of %.2f to original payment method initiated", gatewayRefund.ID, refund.Amount)}, models.SystemActor); err != nil {
+			return err
+		}
+		if gatewayRefund.Status == models.RefundStatusProcessed {
+			return settleRefund(tx, &refund, models.RefundStatusProcessed)
+		}
+		return nil
+	})
+}
+
+// IssueQueuedRefunds sends every queued refund to source to the gateway
+func IssueQueuedRefunds(db *gorm.DB) error {
+	var ids []uint
+	if err := db.Model(&models.Refund{}).
+		Where("method = ? AND status = ? AND gateway_refund_id = ''", models.RefundMethodSource, models.RefundStatusPending).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := issueRefund(db, id); err != nil {
+			log.Printf("Failed to issue refund %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// StartRefundIssuer sends queued gateway refunds every interval in the
+// background
+func StartRefundIssuer(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := IssueQueuedRefunds(db); err != nil {
+				log.Printf("Failed to issue queued refunds: %v", err)
+			}
+		}
+	}()
+}
+
+// refundToWallet records a refund of amount into the customer's wallet and
+// credits it straight away
+func refundToWallet(tx *gorm.DB, order models.Order, payment models.Payment, itemID *uint, amount float64, reason string) (*models.Refund, error) {
+	refund := models.Refund{
+		OrderID:     order.ID,
+		OrderItemID: itemID,
+		PaymentID:   payment.ID,
+		UserID:      order.UserID,
+		Amount:      amount,
+		Method:      models.RefundMethodWallet,
+		Status:      models.RefundStatusPending,
+		Reason:      reason,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, err
+	}
+	if err := creditRefundToWallet(tx, &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// creditRefundToWallet puts a refund into the customer's wallet and marks it
+// processed
+func creditRefundToWallet(tx *gorm.DB, refund *models.Refund) error {
+	if _, err := creditWallet(tx, refund.UserID, refund.Amount, models.LedgerAccountRefunds, refund.Reason, fmt.Sprintf("refund:%d", refund.ID)); err != nil {
+		return err
+	}
+	now := time.Now()
+	refund.Status = models.RefundStatusProcessed
+	refund.ProcessedAt = &now
+	if err := tx.Model(refund).Updates(map[string]interface{}{"status": refund.Status, "processed_at": now}).Error; err != nil {
+		return err
+	}
+	notifyRefundProcessed(tx, refund)
+	return recordOrderEvent(tx, models.OrderEvent{OrderID: refund.OrderID, OrderItemID: refund.OrderItemID, Type: models.OrderEventRefund, Note: fmt.Sprintf("Refunded %.2f to wallet", refund.Amount)}, models.SystemActor)
+}
+
+// settleRefund records the final gateway status of a refund to source. A
+// failed refund is credited to the wallet instead so the customer is not left
+// without their money.
+func settleRefund(tx *gorm.DB, refund *models.Refund, status string) error {
+	if refund.Status != models.RefundStatusPending {
+		return nil
+	}
+	switch status {
+	case models.RefundStatusProcessed:
+		now := time.Now()
+		refund.Status = status
+		refund.ProcessedAt = &now
+		if err := tx.Model(refund).Updates(map[string]interface{}{"status": status, "processed_at": now}).Error; err != nil {
+			return err
+		}
+		notifyRefundProcessed(tx, refund)
+		return recordOrderEvent(tx, models.OrderEvent{OrderID: refund.OrderID, OrderItemID: refund.OrderItemID, Type: models.OrderEventRefund, Note: fmt.Sprintf("Refund %s of %.2f processed", refund.GatewayRefundID, refund.Amount)}, models.SystemActor)
+
+	case models.RefundStatusFailed:
+		refund.Status = status
+		if err := tx.Model(refund).Update("status", status).Error; err != nil {
+			return err
+		}
+		if err := recordOrderEvent(tx, models.OrderEvent{OrderID: refund.OrderID, OrderItemID: refund.OrderItemID, Type: models.OrderEventRefund, Note: fmt.Sprintf("Refund %s of %.2f failed at the gateway", refund.GatewayRefundID, refund.Amount)}, models.SystemActor); err != nil {
+			return err
+		}
+		fallback := models.Refund{
+			OrderID:     refund.OrderID,
+			OrderItemID: refund.OrderItemID,
+			PaymentID:   refund.PaymentID,
+			UserID:      refund.UserID,
+			Amount:      refund.Amount,
+			Method:      models.RefundMethodWallet,
+			Status:      models.RefundStatusPending,
+			Reason:      refund.Reason,
+		}
+		if err := tx.Create(&fallback).Error; err != nil {
+			return err
+		}
+		return creditRefundToWallet(tx, &fallback)
+	}
+	return nil
+}
+
+// PollPendingRefunds asks the gateway for the status of every refund to
+// source that was issued and is still pending
+func PollPendingRefunds(db *gorm.DB) error {
+	var refunds []models.Refund
+	if err := db.Where("method = ? AND status = ? AND gateway_refund_id <> ''", models.RefundMethodSource, models.RefundStatusPending).Find(&refunds).Error; err != nil {
+		return err
+	}
+	for i := range refunds {
+		gatewayRefund, err := PaymentGateway.FetchRefund(refunds[i].GatewayRefundID)
+		if err != nil {
+			log.Printf("Failed to fetch refund %s: %v", refunds[i].GatewayRefundID, err)
+			continue
+		}
+		if gatewayRefund.Status == models.RefundStatusPending {
+			continue
+		}
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return settleRefund(tx, &refunds[i], gatewayRefund.Status)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRefundPoller polls pending gateway refunds every interval in the
+// background, for refunds whose webhook never arrives
+func StartRefundPoller(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := PollPendingRefunds(db); err != nil {
+				log.Printf("Failed to poll pending refunds: %v", err)
+			}
+		}
+	}()
+}
+
+// refundByGatewayID finds a refund to source by its gateway refund id
+func refundByGatewayID(tx *gorm.DB, gatewayRefundID string) (*models.Refund, error) {
+	var refund models.Refund
+	if err := tx.Where("gateway_refund_id = ?", gatewayRefundID).First(&refund).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &refund, nil
+}
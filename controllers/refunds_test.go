@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+)
+
+func TestSplitRefund(t *testing.T) {
+	tests := []struct {
+		name                 string
+		walletPaid, tendered float64
+		amount               float64
+		wallet, tender       float64
+	}{
+		{"no wallet share", 0, 1000, 400, 0, 400},
+		{"wallet only", 1000, 0, 400, 400, 0},
+		{"split in the paid proportions", 250, 750, 400, 100, 300},
+		{"rounded to paise", 100, 200, 100, 33.33, 66.67},
+		{"full refund", 333.33, 666.67, 1000, 333.33, 666.67},
+		{"nothing", 250, 750, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		payment := models.Payment{WalletAmount: tt.walletPaid, Amount: tt.tendered}
+		wallet, tender := splitRefund(payment, tt.amount)
+		if wallet != tt.wallet || tender != tt.tender {
+			t.Errorf("%s: split %.2f into %.2f wallet and %.2f tender, want %.2f and %.2f", tt.name, tt.amount, wallet, tender, tt.wallet, tt.tender)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errOutOfStock is returned when a reservation cannot be made
+var errOutOfStock = errors.New("not enough stock available")
+
+// activeReservation matches the reservations, aliased sr, that hold stock
+const activeReservation = `sr.status = 'active' AND sr.expires_at > NOW() AND sr.deleted_at IS NULL`
+
+// openReservations are the statuses of holds that a payment can still renew
+// or convert. Holds of canceled items are left out.
+var openReservations = []string{models.ReservationActive, models.ReservationReleased}
+
+// reservationTTL is how long checkout holds stock for an unpaid online order,
+// the payment window by default
+func reservationTTL() time.Duration {
+	return config.GetDuration("STOCK_RESERVATION_TTL", config.GetDuration("ORDER_PAYMENT_WINDOW", 30*time.Minute))
+}
+
+// reservedStock is how many units of a product, or of one of its variants,
+// active reservations hold
+func reservedStock(tx *gorm.DB, productID uint, variantID *uint) (int, error) {
+	var reserved int
+	query := tx.Model(&models.StockReservation{}).Select("COALESCE(SUM(quantity), 0)").
+		Where("product_id = ? AND status = ? AND expires_at > ?", productID, models.ReservationActive, time.Now())
+	if variantID != nil {
+		query = query.Where("variant_id = ?", *variantID)
+	} else {
+		query = query.Where("variant_id IS NULL")
+	}
+	err := query.Scan(&reserved).Error
+	return reserved, err
+}
+
+// lockedStock locks the stock row of a product, or of one of its variants,
+// until the transaction ends and returns how many units are left to sell.
+// Checkouts of the same product wait for each other here, so two customers
+// cannot both get the last unit.
+func lockedStock(tx *gorm.DB, productID uint, variantID *uint) (int, error) {
+	var stock int
+	query := tx.Model(&models.Product{}).Where("id = ?", productID)
+	if variantID != nil {
+		query = tx.Model(&models.ProductVariant{}).Unscoped().Where("id = ?", *variantID)
+	}
+	if err := query.Clauses(clause.Locking{Strength: "UPDATE"}).Select("stock_quantity").Scan(&stock).Error; err != nil {
+		return 0, err
+	}
+	reserved, err := reservedStock(tx, productID, variantID)
+	if err != nil {
+		return 0, err
+	}
+	return stock - reserved, nil
+}
+
+// stockRowLess orders lines by the stock row they lock. Sorting by it makes
+// concurrent checkouts lock in the same order so they cannot deadlock.
+func stockRowLess(productA uint, variantA *uint, productB uint, variantB *uint) bool {
+	if productA != productB {
+		return productA < productB
+	}
+	if variantA == nil || variantB == nil {
+		return variantA == nil && variantB != nil
+	}
+	return *variantA < *variantB
+}
+
+// reserveOrderStock holds the stock of the items of an unpaid online order.
+// The caller must have locked the stock rows with lockedStock.
+func reserveOrderStock(tx *gorm.DB, orderID uint, items []models.OrderItem) error {
+	expires := time.Now().Add(reservationTTL())
+	for _, item := range items {
+		reservation := models.StockReservation{
+			OrderID:     orderID,
+			OrderItemID: item.ID,
+			ProductID:   item.ProductID,
+			VariantID:   item.VariantID,
+			Quantity:    item.Quantity,
+			Status:      models.ReservationActive,
+			ExpiresAt:   expires,
+		}
+		if err := tx.Create(&reservation).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewReservations holds the stock of an order again for a new payment
+// attempt. Reservations released after a failed payment or past their expiry
+// are only renewed when the stock is still there.
+func renewReservations(tx *gorm.DB, orderID uint) error {
+	var reservations []models.StockReservation
+	if err := tx.Where("order_id = ? AND status IN ?", orderID, openReservations).Find(&reservations).Error; err != nil {
+		return err
+	}
+	// Let go of the old holds so they do not count against the new ones
+	if err := tx.Model(&models.StockReservation{}).Where("order_id = ? AND status IN ?", orderID, openReservations).
+		Updates(map[string]interface{}{"status": models.ReservationReleased, "resolved_at": time.Now()}).Error; err != nil {
+		return err
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return stockRowLess(reservations[i].ProductID, reservations[i].VariantID, reservations[j].ProductID, reservations[j].VariantID)
+	})
+	expires := time.Now().Add(reservationTTL())
+	for _, reservation := range reservations {
+		stock, err := lockedStock(tx, reservation.ProductID, reservation.VariantID)
+		if err != nil {
+			return err
+		}
+		if stock < reservation.Quantity {
+			return errOutOfStock
+		}
+		if err := tx.Model(&reservation).Updates(map[string]interface{}{
+			"status":      models.ReservationActive,
+			"expires_at":  expires,
+			"resolved_at": nil,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertReservations takes the reserved stock of a paid order out of
+// inventory. A hold that timed out or was released no longer kept the units
+// aside, so they are only taken if they are still there; otherwise nothing is
+// converted and errOutOfStock is returned. It reports whether the order had
+// reservations at all; orders placed before reservations existed have none.
+func convertReservations(tx *gorm.DB, orderID uint) (bool, error) {
+	var reservations []models.StockReservation
+	if err := tx.Where("order_id = ? AND status IN ?", orderID, openReservations).Find(&reservations).Error; err != nil {
+		return false, err
+	}
+	if len(reservations) == 0 {
+		var converted int64
+		err := tx.Model(&models.StockReservation{}).Where("order_id = ?", orderID).Count(&converted).Error
+		return converted > 0, err
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return stockRowLess(reservations[i].ProductID, reservations[i].VariantID, reservations[j].ProductID, reservations[j].VariantID)
+	})
+	now := time.Now()
+	for _, reservation := range reservations {
+		stock, err := lockedStock(tx, reservation.ProductID, reservation.VariantID)
+		if err != nil {
+			return true, err
+		}
+		// lockedStock already counts an active hold as sold, so only a hold
+		// that lapsed needs its units to still be there
+		lapsed := reservation.Status != models.ReservationActive || !reservation.ExpiresAt.After(now)
+		if lapsed && stock < reservation.Quantity {
+			return true, errOutOfStock
+		}
+	}
+	for _, reservation := range reservations {
+		if err := reduceStock(tx, reservation.ProductID, reservation.VariantID, reservation.Quantity); err != nil {
+			return true, err
+		}
+		if err := tx.Model(&reservation).Updates(map[string]interface{}{"status": models.ReservationConverted, "resolved_at": now}).Error; err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// releaseReservations lets go of the active reservations of an order after
+// a failed payment. A new attempt can renew them.
+func releaseReservations(tx *gorm.DB, orderID uint) error {
+	query := tx.Model(&models.StockReservation{}).Where("order_id = ? AND status = ?", orderID, models.ReservationActive)
+	return query.Updates(map[string]interface{}{"status": models.ReservationReleased, "resolved_at": time.Now()}).Error
+}
+
+// cancelReservations drops the hold of a canceled order item for good, so a
+// later payment attempt neither renews nor converts it
+func cancelReservations(tx *gorm.DB, orderID, itemID uint) error {
+	return tx.Model(&models.StockReservation{}).
+		Where("order_id = ? AND order_item_id = ? AND status IN ?", orderID, itemID, openReservations).
+		Updates(map[string]interface{}{"status": models.ReservationCanceled, "resolved_at": time.Now()}).Error
+}
+
+// ReleaseExpiredReservations marks active reservations past their expiry as
+// released and returns how many there were. They stopped holding stock when
+// they expired; this only keeps their status accurate.
+func ReleaseExpiredReservations(db *gorm.DB) (int64, error) {
+	result := db.Model(&models.StockReservation{}).
+		Where("status = ? AND expires_at <= ?", models.ReservationActive, time.Now()).
+		Updates(map[string]interface{}{"status": models.ReservationReleased, "resolved_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
+
+// StartReservationExpiryJob releases expired reservations every interval in
+// the background
+func StartReservationExpiryJob(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			count, err := ReleaseExpiredReservations(db)
+			if err != nil {
+				log.Printf("Failed to release expired stock reservations: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Released %d expired stock reservations", count)
+			}
+		}
+	}()
+}
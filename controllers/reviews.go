@@ -0,0 +1,520 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxReviewImages is how many photos one review can have
+const maxReviewImages = 5
+
+// reviewImageDir is where review photos are saved
+const reviewImageDir = "./uploads/review_images/"
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// violation
+func isUniqueViolation(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == "23505"
+}
+
+// refreshProductRating recomputes the average rating and review count kept
+// on a product from its published reviews
+func refreshProductRating(tx *gorm.DB, productID uint) error {
+	// Raw SQL keeps the Product update hooks out of it
+	return tx.Exec(`UPDATE products SET
+		average_rating = COALESCE((SELECT ROUND(AVG(rating), 2) FROM reviews WHERE product_id = @id AND status = @status), 0),
+		rating_count = (SELECT COUNT(*) FROM reviews WHERE product_id = @id AND status = @status)
+		WHERE id = @id`,
+		map[string]interface{}{"id": productID, "status": models.ReviewStatusPublished}).Error
+}
+
+// purchasedItem returns the user's delivered or completed order item for a
+// product, which is what allows them to review it
+func purchasedItem(tx *gorm.DB, userID, productID uint) (*models.OrderItem, error) {
+	var item models.OrderItem
+	err := tx.Joins("JOIN orders ON orders.id = order_items.order_id").
+		Where("orders.user_id = ? AND order_items.product_id = ? AND order_items.status IN ?", userID, productID, models.ReviewableItemStatuses).
+		Order("order_items.id DESC").First(&item).Error
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// parseReviewForm reads the rating and comment of a review form. The rating
+// is required unless partial is set.
+func parseReviewForm(c *fiber.Ctx, partial bool) (rating int, comment *string, err error) {
+	if raw := strings.TrimSpace(c.FormValue("rating")); raw != "" || !partial {
+		rating, err = strconv.Atoi(raw)
+		if err != nil || rating < 1 || rating > 5 {
+			return 0, nil, errors.New("Rating must be a whole number from 1 to 5")
+		}
+	}
+	if text, ok := formField(c, "comment"); ok {
+		if len(text) > 2000 {
+			return 0, nil, errors.New("Comment can be at most 2000 characters")
+		}
+		comment = &text
+	}
+	return rating, comment, nil
+}
+
+// formField returns a form field and whether it was sent at all
+func formField(c *fiber.Ctx, key string) (string, bool) {
+	if form, err := c.MultipartForm(); err == nil {
+		return formValue(form, key)
+	}
+	if c.Request().PostArgs().Has(key) {
+		return strings.TrimSpace(c.FormValue(key)), true
+	}
+	return "", false
+}
+
+// reviewPhotos returns the photos uploaded with a review
+func reviewPhotos(c *fiber.Ctx) ([]*multipart.FileHeader, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, nil
+	}
+	files := form.File["images"]
+	for _, file := range files {
+		if !strings.HasPrefix(file.Header.Get(fiber.HeaderContentType), "image/") {
+			return nil, errors.New("Only image files can be attached")
+		}
+	}
+	return files, nil
+}
+
+// saveReviewPhotos stores photos uploaded by a user and returns them with
+// the paths of the saved files. The files are saved before the review is
+// written and must be removed if that fails.
+func saveReviewPhotos(c *fiber.Ctx, userID uint, files []*multipart.FileHeader) ([]models.ReviewImage, []string, error) {
+	if len(files) == 0 {
+		return nil, nil, nil
+	}
+	if err := os.MkdirAll(reviewImageDir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	var images []models.ReviewImage
+	var paths []string
+	for _, file := range files {
+		fileName := fmt.Sprintf("%d_%d_%s", userID, time.Now().UnixNano(), file.Filename)
+		if err := c.SaveFile(file, reviewImageDir+fileName); err != nil {
+			utils.RemoveFiles(paths)
+			return nil, nil, err
+		}
+		paths = append(paths, reviewImageDir+fileName)
+		images = append(images, models.ReviewImage{URL: utils.UploadURL("review_images", fileName)})
+	}
+	return images, paths, nil
+}
+
+// attachReviewPhotos adds saved photos to a review
+func attachReviewPhotos(tx *gorm.DB, review *models.Review, images []models.ReviewImage) error {
+	for _, image := range images {
+		image.ReviewID = review.ID
+		if err := tx.Create(&image).Error; err != nil {
+			return err
+		}
+		review.Images = append(review.Images, image)
+	}
+	return nil
+}
+
+// reviewResponse is a review as shown on a product page
+func reviewResponse(review models.Review) fiber.Map {
+	images := make([]string, len(review.Images))
+	for i, image := range review.Images {
+		images[i] = image.URL
+	}
+	response := fiber.Map{
+		"id":                review.ID,
+		"product_id":        review.ProductID,
+		"rating":            review.Rating,
+		"comment":           review.Comment,
+		"images":            images,
+		"verified_purchase": true,
+		"created_at":        review.CreatedAt,
+		"updated_at":        review.UpdatedAt,
+	}
+	if review.User != nil {
+		response["reviewer"] = review.User.Name
+	}
+	if review.VendorReply != "" {
+		response["vendor_reply"] = review.VendorReply
+		response["replied_at"] = review.RepliedAt
+	}
+	return response
+}
+
+// CreateReview lets a customer rate a product they received. It takes a
+// form with rating (1-5), an optional comment and up to 5 images.
+func CreateReview(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	productID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid product ID"})
+	}
+	rating, comment, err := parseReviewForm(c, false)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	files, err := reviewPhotos(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(files) > maxReviewImages {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("A review can have at most %d images", maxReviewImages)})
+	}
+
+	var product models.Product
+	if err := database.DB.First(&product, productID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
+	}
+	item, err := purchasedItem(database.DB, userID, product.ID)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only customers who received this product can review it"})
+	}
+	var existing int64
+	if err := database.DB.Model(&models.Review{}).Where("product_id = ? AND user_id = ?", product.ID, userID).Count(&existing).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add review"})
+	}
+	if existing > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "You already reviewed this product, edit your review instead"})
+	}
+
+	review := models.Review{
+		ProductID:   product.ID,
+		UserID:      userID,
+		OrderItemID: item.ID,
+		Rating:      rating,
+		Status:      models.ReviewStatusPublished,
+	}
+	if comment != nil {
+		review.Comment = *comment
+	}
+	images, paths, err := saveReviewPhotos(c, userID, files)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save images"})
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+		if err := attachReviewPhotos(tx, &review, images); err != nil {
+			return err
+		}
+		return refreshProductRating(tx, product.ID)
+	})
+	if err != nil {
+		utils.RemoveFiles(paths)
+		// A review posted twice at the same time passes the check above once
+		// for each request, the unique index stops the second one
+		if isUniqueViolation(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "You already reviewed this product, edit your review instead"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add review"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Review added successfully", "review": review})
+}
+
+// UpdateReview lets a customer change the rating, comment or photos of their
+// review. New images are added to the existing ones; send remove_image_ids
+// to drop some.
+func UpdateReview(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	var review models.Review
+	if err := database.DB.Preload("Images").Where("id = ? AND user_id = ?", c.Params("id"), userID).First(&review).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Review not found"})
+	}
+	rating, comment, err := parseReviewForm(c, true)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	files, err := reviewPhotos(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	var removeIDs []uint
+	if raw, ok := formField(c, "remove_image_ids"); ok {
+		for _, part := range strings.Split(raw, ",") {
+			if id, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+				removeIDs = append(removeIDs, uint(id))
+			}
+		}
+	}
+	kept := 0
+	for _, image := range review.Images {
+		removed := false
+		for _, id := range removeIDs {
+			removed = removed || image.ID == id
+		}
+		if !removed {
+			kept++
+		}
+	}
+	if kept+len(files) > maxReviewImages {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("A review can have at most %d images", maxReviewImages)})
+	}
+
+	updates := map[string]interface{}{}
+	if rating != 0 {
+		updates["rating"] = rating
+	}
+	if comment != nil {
+		updates["comment"] = *comment
+	}
+	images, paths, err := saveReviewPhotos(c, userID, files)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save images"})
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&review).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if len(removeIDs) > 0 {
+			if err := tx.Where("review_id = ? AND id IN ?", review.ID, removeIDs).Delete(&models.ReviewImage{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := attachReviewPhotos(tx, &review, images); err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		utils.RemoveFiles(paths)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update review"})
+	}
+	if err := database.DB.Preload("Images").First(&review, review.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load review"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Review updated successfully", "review": review})
+}
+
+// DeleteReview removes the customer's own review
+func DeleteReview(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	var review models.Review
+	if err := database.DB.Where("id = ? AND user_id = ?", c.Params("id"), userID).First(&review).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Review not found"})
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("review_id = ?", review.ID).Delete(&models.ReviewImage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&review).Error; err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete review"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Review deleted successfully"})
+}
+
+// ListProductReviews returns the published reviews of a product with a
+// summary of its ratings. Query parameters are rating (only that many
+// stars), sort (recent, rating_high or rating_low), page and limit.
+func ListProductReviews(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Select("id", "average_rating", "rating_count").First(&product, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Product not found"})
+	}
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 10)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+
+	query := database.DB.Model(&models.Review{}).Where("product_id = ? AND status = ?", product.ID, models.ReviewStatusPublished)
+	if rating := c.QueryInt("rating"); rating >= 1 && rating <= 5 {
+		query = query.Where("rating = ?", rating)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+	switch c.Query("sort") {
+	case "rating_high":
+		query = query.Order("rating DESC, id DESC")
+	case "rating_low":
+		query = query.Order("rating ASC, id DESC")
+	default:
+		query = query.Order("id DESC")
+	}
+	var reviews []models.Review
+	if err := query.Preload("User", func(db *gorm.DB) *gorm.DB { return db.Select("id", "name") }).Preload("Images").
+		Offset((page - 1) * limit).Limit(limit).Find(&reviews).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+
+	// How many reviews gave each number of stars
+	var counts []struct {
+		Rating int
+		Count  int
+	}
+	if err := database.DB.Model(&models.Review{}).Select("rating, COUNT(*) AS count").
+		Where("product_id = ? AND status = ?", product.ID, models.ReviewStatusPublished).
+		Group("rating").Scan(&counts).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+	distribution := fiber.Map{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0}
+	for _, count := range counts {
+		distribution[strconv.Itoa(count.Rating)] = count.Count
+	}
+
+	responses := make([]fiber.Map, len(reviews))
+	for i, review := range reviews {
+		responses[i] = reviewResponse(review)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"reviews":        responses,
+		"average_rating": product.AverageRating,
+		"rating_count":   product.RatingCount,
+		"distribution":   distribution,
+		"page":           page,
+		"limit":          limit,
+		"total":          total,
+	})
+}
+
+// ListStoreReviews returns the reviews of a seller's products, newest first.
+// Pass unreplied=true for the ones still waiting for a reply.
+func ListStoreReviews(c *fiber.Ctx) error {
+	storeID, err := GetStoreIDByUserID(uint(c.Locals("user_id").(float64)))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Store not found"})
+	}
+	query := database.DB.Joins("JOIN products ON products.id = reviews.product_id").
+		Where("products.store_id = ? AND reviews.status = ?", storeID, models.ReviewStatusPublished)
+	if c.QueryBool("unreplied") {
+		query = query.Where("reviews.vendor_reply = ''")
+	}
+	var reviews []models.Review
+	if err := query.Preload("User", func(db *gorm.DB) *gorm.DB { return db.Select("id", "name") }).Preload("Images").
+		Order("reviews.id DESC").Find(&reviews).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+	responses := make([]fiber.Map, len(reviews))
+	for i, review := range reviews {
+		responses[i] = reviewResponse(review)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"reviews": responses})
+}
+
+// ReplyToReview sets the seller's public reply to a review of one of their
+// products. Replying again replaces the earlier reply.
+func ReplyToReview(c *fiber.Ctx) error {
+	storeID, err := GetStoreIDByUserID(uint(c.Locals("user_id").(float64)))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Store not found"})
+	}
+	var req struct {
+		Reply string `json:"reply"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Reply = strings.TrimSpace(req.Reply)
+	if req.Reply == "" || len(req.Reply) > 2000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Reply must be between 1 and 2000 characters"})
+	}
+
+	var review models.Review
+	if err := database.DB.Joins("JOIN products ON products.id = reviews.product_id").
+		Where("reviews.id = ? AND products.store_id = ?", c.Params("id"), storeID).First(&review).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Review not found"})
+	}
+	now := time.Now()
+	if err := database.DB.Model(&review).Updates(map[string]interface{}{"vendor_reply": req.Reply, "replied_at": now}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save reply"})
+	}
+	if err := database.DB.Preload("Images").First(&review, review.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load review"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Reply saved successfully", "review": review})
+}
+
+// ListReviewsAdmin returns reviews for moderation, newest first. Filter with
+// status and product_id.
+func ListReviewsAdmin(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	query := database.DB.Model(&models.Review{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if productID := c.QueryInt("product_id"); productID > 0 {
+		query = query.Where("product_id = ?", productID)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+	var reviews []models.Review
+	if err := query.Preload("Images").Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&reviews).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reviews"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"reviews": reviews, "page": page, "limit": limit, "total": total})
+}
+
+// ModerateReview hides a review from the product page or publishes it
+// again. Hidden reviews do not count towards the product rating.
+func ModerateReview(c *fiber.Ctx) error {
+	var req struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Status != models.ReviewStatusPublished && req.Status != models.ReviewStatusHidden {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Status must be published or hidden"})
+	}
+	var review models.Review
+	if err := database.DB.First(&review, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Review not found"})
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&review).Updates(map[string]interface{}{
+			"status":          req.Status,
+			"moderation_note": strings.TrimSpace(req.Note),
+			"moderated_at":    time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to moderate review"})
+	}
+	if err := database.DB.Preload("Images").First(&review, review.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load review"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Review " + req.Status, "review": review})
+}
@@ -6,21 +6,60 @@ import (
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/clause"
 )
 
+// productMinPrice is the lowest price a product sells for, the cheapest
+// active variant for products with variants and the product price otherwise
+const productMinPrice = `COALESCE((SELECT MIN(COALESCE(pv.price, products.price)) FROM product_variants pv
+	WHERE pv.product_id = products.id AND pv.deleted_at IS NULL AND pv.is_active), products.price)`
+
+// productVariantMatch matches products with a variant whose SKU or option
+// values contain the query text
+const productVariantMatch = `EXISTS (SELECT 1 FROM product_variants pv
+	LEFT JOIN product_variant_values pvv ON pvv.product_variant_id = pv.id
+	LEFT JOIN product_option_values pov ON pov.id = pvv.product_option_value_id
+	WHERE pv.product_id = products.id AND pv.deleted_at IS NULL AND pv.is_active
+	AND (pv.sku ILIKE @pattern OR pov.value ILIKE @pattern))`
+
+// productTextMatch matches products whose search vector matches the query
+// text, or with a variant whose SKU or option values contain it
+const productTextMatch = `(products.search_vector @@ websearch_to_tsquery('english', @text) OR ` + productVariantMatch + `)`
+
+// productTextRank orders full-text matches, name hits weigh most
+const productTextRank = `ts_rank_cd(products.search_vector, websearch_to_tsquery('english', @text))`
+
+// productFuzzyMatch matches product names that look like the query text
+const productFuzzyMatch = `(products.name % @text OR @text <% products.name)`
+
+// productFuzzyRank orders fuzzy matches by how close the name is
+const productFuzzyRank = `GREATEST(similarity(products.name, @text), word_similarity(@text, products.name))`
+
+// productPlainMatch matches products whose name or description contains the
+// query text, for when full-text search is not set up
+const productPlainMatch = `(products.name ILIKE @pattern OR products.description ILIKE @pattern OR ` + productVariantMatch + `)`
+
+// productPlainRank puts plain matches on the name first
+const productPlainRank = `(products.name ILIKE @pattern)::int`
+
 // SearchProducts handles the search query and returns a list of products
 // that match the query parameters.
 //
 // Query parameters:
 //
-//	q (string): Search query (e.g., product name, description)
-//	sort (string): Sorting criteria (e.g., popularity, price, ratings, featured, new_arrivals, alphabetical)
-//	order (string): Sorting order (asc or desc)
-//	category_id (int): Category ID (optional)
-//	min_price (float): Minimum price (optional)
-//	max_price (float): Maximum price (optional)
+//	q (string): Search query (e.g., product name, description, variant SKU or option value)
+//	sort (string): Sorting criteria (e.g., relevance, popularity, price, ratings, featured, new_arrivals, alphabetical), relevance when q is given
+//	order (string): Sorting order (asc or desc, popularity and featured default to desc)
+//	category_ids (int list): Categories, with their subcategories (optional, category_id also works)
+//	store_id (int list): Stores (optional)
+//	has_offer (bool): Only products with (true) or without (false) an offer (optional)
+//	in_stock (bool): Only products in (true) or out of (false) stock (optional)
+//	min_price (float): Minimum price (optional), compared with the cheapest variant
+//	max_price (float): Maximum price (optional), compared with the cheapest variant
+//	min_rating (float): Minimum average rating from 1 to 5 (optional)
 //	page (int): Page number (default is 1)
 //	limit (int): Number of items per page (default is 20)
+//	facets (bool): Include facet counts (default is true)
 //
 // Returns a JSON response with the following structure:
 //
@@ -29,17 +68,35 @@ import (
 //	  "data": [...],
 //	  "page": 1,
 //	  "limit": 20,
-//	  "total": 100,
-//	  "total_pages": 5
+//	  "total_products": 100,
+//	  "total_pages": 5,
+//	  "fuzzy_match": false,
+//	  "search_id": 42,
+//	  "facets": {"categories": [...], "stores": [...], "price_ranges": [...], "discounts": [...], "availability": {...}, "ratings": [...]}
 //	}
 func SearchProducts(c *fiber.Ctx) error {
 	// Parse query parameters
 	query := c.Query("q", "")               // Search query (e.g., product name, description)
 	sort := c.Query("sort", "new_arrivals") // Default sorting is by new arrivals
+	// Searches are ranked by how well products match
+	if query != "" && c.Query("sort") == "" {
+		sort = "relevance"
+	}
+	if query == "" && sort == "relevance" {
+		sort = "new_arrivals"
+	}
 	order := c.Query("order", "asc")        // Default order is ascending
-	categoryID := c.QueryInt("category_id", 0)
-	minPrice := c.QueryFloat("min_price", 0)
-	maxPrice := c.QueryFloat("max_price", 0)
+	// Popularity and featured rank best first unless asked otherwise
+	if (sort == "popularity" || sort == "featured") && c.Query("order") == "" {
+		order = "desc"
+	}
+	if order != "desc" {
+		order = "asc"
+	}
+	filters, err := parseSearchFilters(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
 	page := c.QueryInt("page", 1)
 	limit := c.QueryInt("limit", 20) // Default to 20 items per page
 
@@ -51,37 +108,47 @@ func SearchProducts(c *fiber.Ctx) error {
         })
     }
 
-	// Base query to search products
-	db := database.DB.Model(&models.Product{}).Where("is_active = ?", true)
-
-	// Apply search query (if provided)
+	// Apply search query (if provided). Full-text search goes first, when it
+	// finds nothing the name is matched by trigram similarity to get past
+	// typos. Without the search setup the text is matched as it is.
+	fuzzy := false
+	relevance := ""
+	searchArgs := map[string]interface{}{"text": query, "pattern": "%" + query + "%"}
 	if query != "" {
-		db = db.Where("name ILIKE ? OR description ILIKE ?", "%"+query+"%", "%"+query+"%")
-	}
-
-	// Apply category filter (if provided)
-	if categoryID != 0 {
-		db = db.Where("category_id = ?", categoryID)
+		filters.TextMatch, filters.TextArgs = productTextMatch, searchArgs
+		relevance = productTextRank
+		if !database.ProductSearchReady {
+			filters.TextMatch, relevance = productPlainMatch, productPlainRank
+		}
 	}
 
-	// Apply price range filter (if provided)
-	if minPrice > 0 {
-		db = db.Where("price >= ?", minPrice)
+	// Count every match for the pagination
+	var totalCount int64
+	if err := filters.query("").Count(&totalCount).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search products"})
 	}
-	if maxPrice > 0 {
-		db = db.Where("price <= ?", maxPrice)
+	if query != "" && totalCount == 0 && database.ProductSearchReady {
+		fuzzy = true
+		filters.TextMatch = productFuzzyMatch
+		relevance = productFuzzyRank
+		if err := filters.query("").Count(&totalCount).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to search products"})
+		}
 	}
+	db := filters.query("")
 
 	// Sorting
 	switch sort {
+	case "relevance":
+		db = db.Order(clause.OrderBy{Expression: clause.NamedExpr{SQL: relevance + " DESC, popularity_score DESC", Vars: []interface{}{searchArgs}}})
 	case "popularity":
-		db = db.Order("popularity_score " + order) // Assume there's a popularity score field
+		db = db.Order("popularity_score " + order)
 	case "price":
-		db = db.Order("price " + order)
+		db = db.Order(productMinPrice + " " + order)
 	case "ratings":
-		db = db.Order("average_ratings " + order) // Assume there's an average ratings field
+		db = db.Order("average_rating " + order + ", rating_count " + order)
 	case "featured":
-		db = db.Order("is_featured " + order) // Assume there's a featured flag
+		db = db.Order(activeFeatured + " " + order + ", featured_rank, popularity_score DESC")
 	case "new_arrivals":
 		db = db.Order("created_at " + order)
 	case "alphabetical":
@@ -110,6 +177,8 @@ func SearchProducts(c *fiber.Ctx) error {
 			Price:         product.Price,
 			StockQuantity: product.StockLeft,
 			IsActive:      product.IsActive,
+			AverageRating: product.AverageRating,
+			RatingCount:   product.RatingCount,
 			Category: models.CategoryResponse{
 				ID:   product.Category.ID,
 				Name: product.Category.Name,
@@ -129,9 +198,20 @@ func SearchProducts(c *fiber.Ctx) error {
 		// Add the product response to the list
 		productResponses = append(productResponses, productResponse)
 	}
-	// Calculate total count of products
-	var totalCount int64
-	db.Model(&models.Product{}).Where("is_active = ?", true).Count(&totalCount)
+	// Searches that found something on their first page become suggestions
+	if Suggestions != nil && query != "" && totalCount > 0 && page == 1 {
+		Suggestions.RecordQuery(query)
+	}
+
+	searchID := logSearch(visitorKey(c), query, sort, page, filters, totalCount, fuzzy)
+
+	// Count the results by category, store, price, discount, stock and rating
+	var facets fiber.Map
+	if c.QueryBool("facets", true) {
+		if facets, err = filters.searchFacets(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to count search facets"})
+		}
+	}
 
 	// Calculate total number of pages
 	totalPages := int(math.Ceil(float64(totalCount) / float64(limit)))
@@ -143,6 +223,9 @@ func SearchProducts(c *fiber.Ctx) error {
 		"page":    page,
 		"limit":   limit,
 		"total_products":   totalCount,
+		"fuzzy_match":      fuzzy,
+		"search_id":        searchID,
+		"facets":           facets,
         "total_pages": totalPages,
 	})
 }
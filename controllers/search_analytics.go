@@ -0,0 +1,306 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// searchAttributionWindow is how long after a search clicks and add-to-carts
+// are credited to it
+const searchAttributionWindow = 24 * time.Hour
+
+// searchMinClients is how many different clients must have run a search
+// before it is shown to others as trending or as a suggestion, so a single
+// client cannot push a query there
+func searchMinClients() int {
+	return int(config.GetFloat("SEARCH_MIN_CLIENTS", 3))
+}
+
+// publicSearches narrows search logs grouped by query to those that may be
+// shown to other customers: run by enough different clients and not on the
+// SEARCH_BLOCKLIST
+func publicSearches(query *gorm.DB) *gorm.DB {
+	query = query.Having("COUNT(DISTINCT client_key) >= ?", searchMinClients())
+	if blocked := config.GetList("SEARCH_BLOCKLIST"); len(blocked) > 0 {
+		for i, term := range blocked {
+			blocked[i] = utils.NormalizeQuery(term)
+		}
+		query = query.Where("normalized_query NOT IN ?", blocked)
+	}
+	return query
+}
+
+// logSearch records a product search by client and returns its ID, or nil
+// when it could not be saved. Logging never fails the search.
+func logSearch(client, query, sort string, page int, filters *searchFilters, results int64, fuzzy bool) *uint {
+	filtersJSON, err := json.Marshal(filters)
+	if err != nil {
+		filtersJSON = []byte("{}")
+	}
+	query = utils.TruncateRunes(query, 200)
+	normalized := utils.TruncateRunes(utils.NormalizeQuery(query), 100)
+	entry := models.SearchLog{
+		ClientKey:       client,
+		Query:           query,
+		NormalizedQuery: normalized,
+		Filters:         string(filtersJSON),
+		Sort:            sort,
+		Page:            page,
+		ResultCount:     results,
+		Fuzzy:           fuzzy,
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		log.Printf("Failed to log search %q: %v", query, err)
+		return nil
+	}
+	return &entry.ID
+}
+
+// markSearchAddToCart credits an add-to-cart to the search it came from.
+// userID is nil for guests.
+func markSearchAddToCart(tx *gorm.DB, searchID uint, userID *uint) {
+	updates := map[string]interface{}{"added_to_cart_at": time.Now()}
+	if userID != nil {
+		updates["user_id"] = *userID
+	}
+	if err := tx.Model(&models.SearchLog{}).
+		Where("id = ? AND added_to_cart_at IS NULL AND created_at > ?", searchID, time.Now().Add(-searchAttributionWindow)).
+		Updates(updates).Error; err != nil {
+		log.Printf("Failed to record add to cart for search %d: %v", searchID, err)
+	}
+}
+
+// RecordSearchClick counts a click on a product in the results of a search.
+// The search_id comes from the search response and only counts for the
+// client that searched.
+func RecordSearchClick(c *fiber.Ctx) error {
+	searchID, err := c.ParamsInt("search_id")
+	if err != nil || searchID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid search ID"})
+	}
+	now := time.Now()
+	result := database.DB.Model(&models.SearchLog{}).
+		Where("id = ? AND client_key IN ? AND created_at > ?", searchID, visitorKeys(c), now.Add(-searchAttributionWindow)).
+		Updates(map[string]interface{}{
+			"click_count":      gorm.Expr("click_count + 1"),
+			"first_clicked_at": gorm.Expr("COALESCE(first_clicked_at, ?)", now),
+		})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to record click"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Search not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Click recorded"})
+}
+
+// searchReportRange reads the from and to dates (YYYY-MM-DD) of a report,
+// the last 30 days by default
+func searchReportRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	if raw := c.Query("from"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return from, to, err
+		}
+		from = parsed
+	}
+	if raw := c.Query("to"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return from, to, err
+		}
+		to = parsed.Add(24 * time.Hour) // Include the full end date
+	}
+	return from, to, nil
+}
+
+// searchReportQuery returns the first pages of searches with a query in the
+// report range. Later pages of the same search are not counted again.
+func searchReportQuery(c *fiber.Ctx) (*gorm.DB, int, error) {
+	from, to, err := searchReportRange(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	limit := c.QueryInt("limit", 20)
+	if limit < 1 || limit > 200 {
+		limit = 20
+	}
+	return database.DB.Model(&models.SearchLog{}).
+		Where("created_at >= ? AND created_at < ? AND page = 1 AND normalized_query <> ''", from, to).
+		Session(&gorm.Session{}), limit, nil
+}
+
+// searchQueryStats is one row of the search reports
+type searchQueryStats struct {
+	Query          string    `json:"query"`
+	Searches       int64     `json:"searches"`
+	AverageResults float64   `json:"average_results"`
+	ZeroResults    int64     `json:"zero_results"`
+	Clicks         int64     `json:"searches_with_click"`
+	AddToCarts     int64     `json:"searches_with_add_to_cart"`
+	ClickRate      float64   `json:"click_rate"`       // Share of searches with a click
+	ConversionRate float64   `json:"conversion_rate"`  // Share of searches with an add to cart
+	LastSearchedAt time.Time `json:"last_searched_at"` // Most recent search
+}
+
+const searchQueryStatsColumns = `normalized_query AS query, COUNT(*) AS searches,
+	ROUND(AVG(result_count), 2) AS average_results,
+	COUNT(*) FILTER (WHERE result_count = 0) AS zero_results,
+	COUNT(*) FILTER (WHERE click_count > 0) AS clicks,
+	COUNT(*) FILTER (WHERE added_to_cart_at IS NOT NULL) AS add_to_carts,
+	ROUND(COUNT(*) FILTER (WHERE click_count > 0)::numeric / COUNT(*), 4) AS click_rate,
+	ROUND(COUNT(*) FILTER (WHERE added_to_cart_at IS NOT NULL)::numeric / COUNT(*), 4) AS conversion_rate,
+	MAX(created_at) AS last_searched_at`
+
+// SearchTopQueries reports the most run searches in a date range (from and
+// to, YYYY-MM-DD, last 30 days by default)
+func SearchTopQueries(c *fiber.Ctx) error {
+	query, limit, err := searchReportQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid date format, use YYYY-MM-DD"})
+	}
+	var stats []searchQueryStats
+	if err := query.Select(searchQueryStatsColumns).Group("normalized_query").
+		Order("searches DESC, query").Limit(limit).Scan(&stats).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to build report"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"queries": stats})
+}
+
+// SearchZeroResultQueries reports the searches that found nothing, most
+// frequent first, so missing products or synonyms can be spotted
+func SearchZeroResultQueries(c *fiber.Ctx) error {
+	query, limit, err := searchReportQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid date format, use YYYY-MM-DD"})
+	}
+	var stats []searchQueryStats
+	if err := query.Where("result_count = 0").Select(searchQueryStatsColumns).Group("normalized_query").
+		Order("searches DESC, last_searched_at DESC").Limit(limit).Scan(&stats).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to build report"})
+	}
+	// Typos answered by the fuzzy fallback are not zero-result searches
+	var fuzzy int64
+	if err := query.Where("fuzzy AND result_count > 0").Count(&fuzzy).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to build report"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"queries": stats, "rescued_by_fuzzy_match": fuzzy})
+}
+
+// SearchConversionReport reports clicks and add-to-carts per search query.
+// Queries run fewer than min_searches times (default 5) are left out.
+func SearchConversionReport(c *fiber.Ctx) error {
+	query, limit, err := searchReportQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid date format, use YYYY-MM-DD"})
+	}
+	minSearches := c.QueryInt("min_searches", 5)
+	order := "conversion_rate DESC, searches DESC"
+	if c.Query("sort") == "worst" {
+		order = "conversion_rate ASC, searches DESC"
+	}
+	var stats []searchQueryStats
+	if err := query.Select(searchQueryStatsColumns).Group("normalized_query").Having("COUNT(*) >= ?", minSearches).
+		Order(order).Limit(limit).Scan(&stats).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to build report"})
+	}
+
+	var overall struct {
+		Searches       int64   `json:"searches"`
+		ClickRate      float64 `json:"click_rate"`
+		ConversionRate float64 `json:"conversion_rate"`
+	}
+	if err := query.Select(`COUNT(*) AS searches,
+		COALESCE(ROUND(COUNT(*) FILTER (WHERE click_count > 0)::numeric / NULLIF(COUNT(*), 0), 4), 0) AS click_rate,
+		COALESCE(ROUND(COUNT(*) FILTER (WHERE added_to_cart_at IS NOT NULL)::numeric / NULLIF(COUNT(*), 0), 4), 0) AS conversion_rate`).
+		Scan(&overall).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to build report"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"overall": overall, "queries": stats})
+}
+
+// TrendingSearches returns searches that are run much more in the last day
+// than usual. A query needs a few searches with results, from different
+// clients, to show up.
+func TrendingSearches(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 10)
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+	now := time.Now()
+	day := now.Add(-24 * time.Hour)
+	var trending []struct {
+		Query    string  `json:"query"`
+		Searches int64   `json:"searches"`
+		Score    float64 `json:"-"`
+	}
+	// Searches in the last day against the daily average of the week before
+	query := database.DB.Model(&models.SearchLog{}).
+		Select(`normalized_query AS query,
+			COUNT(*) FILTER (WHERE created_at > ?) AS searches,
+			COUNT(*) FILTER (WHERE created_at > ?) / (COUNT(*) FILTER (WHERE created_at <= ?) / 7.0 + 1) AS score`,
+			day, day, day).
+		Where("created_at > ? AND page = 1 AND result_count > 0 AND normalized_query <> ''", now.AddDate(0, 0, -8)).
+		Group("normalized_query").
+		Having("COUNT(*) FILTER (WHERE created_at > ?) >= ?", day, 3)
+	if err := publicSearches(query).Order("score DESC, searches DESC").Limit(limit).Scan(&trending).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch trending searches"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"trending": trending})
+}
+
+// popularQuerySuggestions returns searches with results from the last 30
+// days with how often they were run, for the suggestion index
+func popularQuerySuggestions(db *gorm.DB) ([]utils.Suggestion, error) {
+	var rows []struct {
+		Query    string
+		Searches int64
+	}
+	query := db.Model(&models.SearchLog{}).Select("normalized_query AS query, COUNT(*) AS searches").
+		Where("created_at > ? AND page = 1 AND result_count > 0 AND NOT fuzzy AND normalized_query <> ''", time.Now().AddDate(0, 0, -30)).
+		Group("normalized_query")
+	if err := publicSearches(query).Order("searches DESC").Limit(5000).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	suggestions := make([]utils.Suggestion, len(rows))
+	for i, row := range rows {
+		suggestions[i] = utils.Suggestion{Kind: utils.SuggestionQuery, Text: row.Query, Weight: float64(row.Searches)}
+	}
+	return suggestions, nil
+}
+
+// PurgeSearchLogs deletes search logs older than retention and returns how
+// many were deleted
+func PurgeSearchLogs(db *gorm.DB, retention time.Duration) (int64, error) {
+	result := db.Where("created_at <= ?", time.Now().Add(-retention)).Delete(&models.SearchLog{})
+	return result.RowsAffected, result.Error
+}
+
+// StartSearchLogCleanup purges search logs older than retention every
+// interval in the background
+func StartSearchLogCleanup(db *gorm.DB, retention, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			count, err := PurgeSearchLogs(db, retention)
+			if err != nil {
+				log.Printf("Failed to purge search logs: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Purged %d search logs", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Facets of a product search. Each facet is counted with every filter
+// applied except its own, so shoppers see what else they can pick.
+const (
+	facetCategory = "category"
+	facetStore    = "store"
+	facetPrice    = "price"
+	facetOffer    = "offer"
+	facetStock    = "stock"
+	facetRating   = "rating"
+)
+
+// productCategoryTree matches products in the given categories or any of
+// their subcategories
+const productCategoryTree = `products.category_id IN (WITH RECURSIVE tree AS (
+	SELECT id FROM categories WHERE id IN ?
+	UNION SELECT c.id FROM categories c JOIN tree ON c.parent_category_id = tree.id WHERE c.deleted_at IS NULL
+) SELECT id FROM tree)`
+
+// productMaxDiscount is the best offer on a product or any of its variants
+const productMaxDiscount = `COALESCE((SELECT MAX(o.discount_percentage) FROM offers o
+	WHERE o.product_id = products.id AND o.deleted_at IS NULL), 0)`
+
+// productStock is how many units of a product can be bought, the stock of its
+// active variants for products with variants, less what reservations hold
+const productStock = `CASE WHEN EXISTS (SELECT 1 FROM product_variants pv WHERE pv.product_id = products.id AND pv.deleted_at IS NULL)
+	THEN COALESCE((SELECT SUM(pv.stock_quantity - COALESCE((SELECT SUM(sr.quantity) FROM stock_reservations sr
+			WHERE sr.variant_id = pv.id AND ` + activeReservation + `), 0)) FROM product_variants pv
+		WHERE pv.product_id = products.id AND pv.deleted_at IS NULL AND pv.is_active), 0)
+	ELSE products.stock_quantity - COALESCE((SELECT SUM(sr.quantity) FROM stock_reservations sr
+		WHERE sr.product_id = products.id AND sr.variant_id IS NULL AND ` + activeReservation + `), 0) END`
+
+// facetRange is one bucket of a range facet. Max 0 means no upper bound.
+type facetRange struct {
+	Label string  `json:"label"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max,omitempty"`
+	Count int64   `json:"count"`
+}
+
+// priceFacetRanges are the price buckets shown with search results
+var priceFacetRanges = []facetRange{
+	{Label: "Under 500", Min: 0, Max: 500},
+	{Label: "500 - 1000", Min: 500, Max: 1000},
+	{Label: "1000 - 2500", Min: 1000, Max: 2500},
+	{Label: "2500 - 5000", Min: 2500, Max: 5000},
+	{Label: "5000 and above", Min: 5000},
+}
+
+// discountFacetRanges are the discount bands shown with search results
+var discountFacetRanges = []facetRange{
+	{Label: "No offer", Min: 0, Max: 0},
+	{Label: "Up to 10%", Min: 0, Max: 10},
+	{Label: "10% - 25%", Min: 10, Max: 25},
+	{Label: "25% - 50%", Min: 25, Max: 50},
+	{Label: "50% and above", Min: 50},
+}
+
+// ratingFacetThresholds are the "n stars and up" options
+var ratingFacetThresholds = []int{4, 3, 2, 1}
+
+// searchFilters are the filters of a product search
+type searchFilters struct {
+	CategoryIDs []uint                 `json:"category_ids,omitempty"`
+	StoreIDs    []uint                 `json:"store_ids,omitempty"`
+	MinPrice    float64                `json:"min_price,omitempty"`
+	MaxPrice    float64                `json:"max_price,omitempty"`
+	MinRating   float64                `json:"min_rating,omitempty"`
+	HasOffer    *bool                  `json:"has_offer,omitempty"`
+	InStock     *bool                  `json:"in_stock,omitempty"`
+	TextMatch   string                 `json:"-"` // productTextMatch, productFuzzyMatch, productPlainMatch or empty
+	TextArgs    map[string]interface{} `json:"-"`
+}
+
+// parseSearchFilters reads the filter query parameters. IDs can be given as
+// a comma separated list or by repeating the parameter.
+func parseSearchFilters(c *fiber.Ctx) (*searchFilters, error) {
+	filters := &searchFilters{
+		MinPrice:  c.QueryFloat("min_price", 0),
+		MaxPrice:  c.QueryFloat("max_price", 0),
+		MinRating: c.QueryFloat("min_rating", 0),
+	}
+	var err error
+	if filters.CategoryIDs, err = queryIDs(c, "category_ids", "category_id"); err != nil {
+		return nil, fmt.Errorf("invalid category_ids")
+	}
+	if filters.StoreIDs, err = queryIDs(c, "store_id", "store_ids"); err != nil {
+		return nil, fmt.Errorf("invalid store_id")
+	}
+	if filters.HasOffer, err = queryBool(c, "has_offer"); err != nil {
+		return nil, fmt.Errorf("invalid has_offer")
+	}
+	if filters.InStock, err = queryBool(c, "in_stock"); err != nil {
+		return nil, fmt.Errorf("invalid in_stock")
+	}
+	return filters, nil
+}
+
+// queryIDs collects the IDs given in any of the keys
+func queryIDs(c *fiber.Ctx, keys ...string) ([]uint, error) {
+	var ids []uint
+	for _, key := range keys {
+		for _, raw := range c.Context().QueryArgs().PeekMulti(key) {
+			for _, part := range strings.Split(string(raw), ",") {
+				part = strings.TrimSpace(part)
+				if part == "" {
+					continue
+				}
+				id, err := strconv.ParseUint(part, 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				ids = append(ids, uint(id))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// queryBool reads an optional true/false query parameter
+func queryBool(c *fiber.Ctx, key string) (*bool, error) {
+	raw := c.Query(key)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// query returns the active products matching every filter except the facet
+// named by except
+func (f *searchFilters) query(except string) *gorm.DB {
+	db := database.DB.Model(&models.Product{}).Where("products.is_active = ?", true)
+	if f.TextMatch != "" {
+		db = db.Where(f.TextMatch, f.TextArgs)
+	}
+	if len(f.CategoryIDs) > 0 && except != facetCategory {
+		db = db.Where(productCategoryTree, f.CategoryIDs)
+	}
+	if len(f.StoreIDs) > 0 && except != facetStore {
+		db = db.Where("products.store_id IN ?", f.StoreIDs)
+	}
+	if except != facetPrice {
+		if f.MinPrice > 0 {
+			db = db.Where(productMinPrice+" >= ?", f.MinPrice)
+		}
+		if f.MaxPrice > 0 {
+			db = db.Where(productMinPrice+" <= ?", f.MaxPrice)
+		}
+	}
+	if f.MinRating > 0 && except != facetRating {
+		db = db.Where("products.average_rating >= ?", f.MinRating)
+	}
+	if f.HasOffer != nil && except != facetOffer {
+		if *f.HasOffer {
+			db = db.Where(productMaxDiscount + " > 0")
+		} else {
+			db = db.Where(productMaxDiscount + " = 0")
+		}
+	}
+	if f.InStock != nil && except != facetStock {
+		if *f.InStock {
+			db = db.Where(productStock + " > 0")
+		} else {
+			db = db.Where(productStock + " <= 0")
+		}
+	}
+	return db
+}
+
+// rangeBucket is a CASE expression giving the index of the range value falls
+// in. The first range of discountFacetRanges only holds 0.
+func rangeBucket(value string, ranges []facetRange, zeroBucket bool) string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i, r := range ranges {
+		switch {
+		case zeroBucket && i == 0:
+			fmt.Fprintf(&b, " WHEN %s <= 0 THEN %d", value, i)
+		case r.Max > 0:
+			fmt.Fprintf(&b, " WHEN %s < %g THEN %d", value, r.Max, i)
+		default:
+			fmt.Fprintf(&b, " ELSE %d", i)
+		}
+	}
+	b.WriteString(" END")
+	return b.String()
+}
+
+// countRanges counts the products in each range of value
+func (f *searchFilters) countRanges(except, value string, ranges []facetRange, zeroBucket bool) ([]facetRange, error) {
+	var rows []struct {
+		Bucket int
+		Count  int64
+	}
+	if err := f.query(except).Select(rangeBucket(value, ranges, zeroBucket) + " AS bucket, COUNT(*) AS count").
+		Group("bucket").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counted := make([]facetRange, len(ranges))
+	copy(counted, ranges)
+	for _, row := range rows {
+		if row.Bucket >= 0 && row.Bucket < len(counted) {
+			counted[row.Bucket].Count = row.Count
+		}
+	}
+	return counted, nil
+}
+
+// searchFacets counts the search results by category, store, price,
+// discount, availability and rating
+func (f *searchFilters) searchFacets() (fiber.Map, error) {
+	categories, err := f.categoryFacet()
+	if err != nil {
+		return nil, err
+	}
+
+	var stores []struct {
+		ID    uint   `json:"id"`
+		Name  string `json:"name"`
+		Count int64  `json:"count"`
+	}
+	if err := f.query(facetStore).Joins("JOIN stores ON stores.id = products.store_id").
+		Select("stores.id, stores.name, COUNT(*) AS count").Group("stores.id, stores.name").
+		Order("count DESC, stores.name").Scan(&stores).Error; err != nil {
+		return nil, err
+	}
+
+	prices, err := f.countRanges(facetPrice, productMinPrice, priceFacetRanges, false)
+	if err != nil {
+		return nil, err
+	}
+	discounts, err := f.countRanges(facetOffer, productMaxDiscount, discountFacetRanges, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var stock struct {
+		InStock    int64 `json:"in_stock"`
+		OutOfStock int64 `json:"out_of_stock"`
+	}
+	if err := f.query(facetStock).Select(fmt.Sprintf("COUNT(*) FILTER (WHERE %s > 0) AS in_stock, COUNT(*) FILTER (WHERE %s <= 0) AS out_of_stock", productStock, productStock)).
+		Scan(&stock).Error; err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(ratingFacetThresholds))
+	for i, threshold := range ratingFacetThresholds {
+		columns[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE products.average_rating >= %d) AS r%d", threshold, threshold)
+	}
+	ratingCounts := map[string]interface{}{}
+	if err := f.query(facetRating).Select(strings.Join(columns, ", ")).Take(&ratingCounts).Error; err != nil {
+		return nil, err
+	}
+	ratings := make([]fiber.Map, len(ratingFacetThresholds))
+	for i, threshold := range ratingFacetThresholds {
+		ratings[i] = fiber.Map{"min_rating": threshold, "count": ratingCounts[fmt.Sprintf("r%d", threshold)]}
+	}
+
+	return fiber.Map{
+		"categories":   categories,
+		"stores":       stores,
+		"price_ranges": prices,
+		"discounts":    discounts,
+		"availability": stock,
+		"ratings":      ratings,
+	}, nil
+}
+
+// categoryFacet counts results per category. A parent category counts the
+// products of all its subcategories too.
+func (f *searchFilters) categoryFacet() ([]fiber.Map, error) {
+	var rows []struct {
+		CategoryID uint
+		Count      int64
+	}
+	if err := f.query(facetCategory).Select("products.category_id, COUNT(*) AS count").
+		Group("products.category_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	var categories []models.Category
+	if err := database.DB.Select("id", "name", "parent_category_id").Find(&categories).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+
+	counts := make(map[uint]int64)
+	for _, row := range rows {
+		// Walk up to the root, the seen set guards against loops
+		seen := make(map[uint]bool)
+		for id := row.CategoryID; id != 0 && !seen[id]; {
+			seen[id] = true
+			counts[id] += row.Count
+			category, ok := byID[id]
+			if !ok || category.ParentCategoryID == nil {
+				break
+			}
+			id = *category.ParentCategoryID
+		}
+	}
+
+	facet := make([]fiber.Map, 0, len(counts))
+	for id, count := range counts {
+		category, ok := byID[id]
+		if !ok {
+			continue
+		}
+		facet = append(facet, fiber.Map{
+			"id":                 id,
+			"name":               category.Name,
+			"parent_category_id": category.ParentCategoryID,
+			"count":              count,
+		})
+	}
+	sort.Slice(facet, func(i, j int) bool {
+		if facet[i]["count"].(int64) != facet[j]["count"].(int64) {
+			return facet[i]["count"].(int64) > facet[j]["count"].(int64)
+		}
+		return facet[i]["name"].(string) < facet[j]["name"].(string)
+	})
+	return facet, nil
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tokenTTLs returns how long access tokens and sessions last
+func tokenTTLs() (access, refresh time.Duration) {
+	return config.GetDuration("ACCESS_TOKEN_TTL", utils.AccessTokenTTL),
+		config.GetDuration("REFRESH_TOKEN_TTL", utils.RefreshTokenTTL)
+}
+
+// issueSession starts a new session for the user and returns the token pair
+// the login handlers send back
+func issueSession(c *fiber.Ctx, user models.User) (fiber.Map, error) {
+	accessTTL, refreshTTL := tokenTTLs()
+	refreshToken, refreshHash, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: refreshHash,
+		UserAgent:        c.Get(fiber.HeaderUserAgent),
+		IPAddress:        c.IP(),
+		ExpiresAt:        now.Add(refreshTTL),
+		LastUsedAt:       now,
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	token, err := utils.GenerateJWT(user, session.ID, accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTTL.Seconds()),
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token. The refresh
+// token is rotated, so each one can be used only once. Presenting an old one
+// again revokes the whole session.
+func RefreshToken(c *fiber.Ctx) error {
+	var req models.RefreshTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	accessTTL, refreshTTL := tokenTTLs()
+	hash := utils.HashToken(req.RefreshToken)
+	var (
+		user         models.User
+		session      models.Session
+		refreshToken string
+		reused       bool
+	)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("refresh_token_hash = ?", hash).First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// A token that was already rotated away means someone else holds a
+			// copy, end the session for both of them
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("previous_token_hash = ?", hash).First(&session).Error; err != nil {
+				return err
+			}
+			reused = true
+			if session.RevokedAt != nil {
+				return nil
+			}
+			return tx.Model(&session).Update("revoked_at", time.Now()).Error
+		}
+		if err != nil {
+			return err
+		}
+		if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.First(&user, session.UserID).Error; err != nil {
+			return err
+		}
+		if user.Blocked {
+			return gorm.ErrRecordNotFound
+		}
+
+		var newHash string
+		refreshToken, newHash, err = utils.GenerateRefreshToken()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Model(&session).Updates(map[string]interface{}{
+			"refresh_token_hash":  newHash,
+			"previous_token_hash": hash,
+			"expires_at":          now.Add(refreshTTL),
+			"last_used_at":        now,
+		}).Error
+	})
+	if err == nil && reused {
+		log.Printf("Refresh token reused for session %d, session revoked", session.ID)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Refresh token was already used, please log in again"})
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired refresh token"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to refresh token"})
+	}
+
+	token, err := utils.GenerateJWT(user, session.ID, accessTTL)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTTL.Seconds()),
+	})
+}
+
+// Logout revokes the session of the access token. With all=true every
+// session of the user is revoked, logging them out on all devices.
+func Logout(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+	sessionID := c.Locals("session_id").(uint)
+
+	if c.QueryBool("all") {
+		if err := revokeUserSessions(database.DB, userID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to log out"})
+		}
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Logged out from all devices"})
+	}
+
+	if err := database.DB.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to log out"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Logged out successfully"})
+}
+
+// revokeUserSessions ends every open session of a user. Their access tokens
+// stop working on the next request.
+func revokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -95,7 +96,7 @@ func UpdateStoreProfile(c *fiber.Ctx) error {
 		}
 
 		// Store the file path in the database
-		dbUser.StoreImage = fmt.Sprintf("https://jijoshibuukken.website/uploads/store_images/%s", storeImageName)
+		dbUser.StoreImage = utils.UploadURL("store_images", storeImageName)
 	}
 
 	// Save the updated user to the database
@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"fmt"
 	"log"
 	"net/url"
 
@@ -63,7 +62,7 @@ func AddProduct(c *fiber.Ctx) error {
 		}
 
 		// Store the image URL (assuming you're serving the images statically)
-		imageURL := fmt.Sprintf("https://jijoshibuukken.website/uploads/product_images/%s", fileName)
+		imageURL := utils.UploadURL("product_images", fileName)
 
 		// Append each image URL to the product's Images array
 		image := models.Image{
@@ -99,6 +98,7 @@ func EditProduct(c *fiber.Ctx) error {
 			"error": "Product not found",
 		})
 	}
+	oldPrice := effectivePrice(database.DB, *product)
 
 	// Parse multipart form data
 	form, err := c.MultipartForm()
@@ -135,7 +135,7 @@ func EditProduct(c *fiber.Ctx) error {
 		}
 
 		// Store the image URL (assuming you're serving the images statically)
-		imageURL := fmt.Sprintf("https://jijoshibuukken.website/uploads/product_images/%s", url.PathEscape(fileName))
+		imageURL := utils.UploadURL("product_images", url.PathEscape(fileName))
 
 		// Append each image URL to the product's Images array
 		image := models.Image{
@@ -155,6 +155,7 @@ func EditProduct(c *fiber.Ctx) error {
 			"error": "Failed to update product",
 		})
 	}
+	notifyPriceDrop(database.DB, *product, oldPrice, effectivePrice(database.DB, *product))
 
 	return c.Status(fiber.StatusCreated).JSON(product)
 }
@@ -245,7 +246,7 @@ func GetProductbyId(c *fiber.Ctx) error {
 	var productResponse models.ProductResponse
 
 	// Query to fetch all products with related Category, Store, and Images
-	if err := database.DB.Preload("Category").Preload("Store").Preload("Images").First(&product, id).Error; err != nil {
+	if err := database.DB.Preload("Category").Preload("Store").Preload("Images", "variant_id IS NULL").First(&product, id).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch product",
 		})
@@ -258,6 +259,8 @@ func GetProductbyId(c *fiber.Ctx) error {
 		Price:         product.Price,
 		StockQuantity: product.StockQuantity,
 		IsActive:      product.IsActive,
+		AverageRating: product.AverageRating,
+		RatingCount:   product.RatingCount,
 		Category: models.CategoryResponse{
 			ID:   product.Category.ID,
 			Name: product.Category.Name,
@@ -274,7 +277,19 @@ func GetProductbyId(c *fiber.Ctx) error {
 		productResponse.Images[i] = image.URL
 	}
 
-	
+	recordProductView(product.ID, visitorKey(c))
+
+	// Products with variants are sold per variant, their stock is the
+	// stock of all variants together. Stock held for unpaid orders is left out.
+	productResponse.Variants, productResponse.Options = variantResponses(database.DB, product)
+	if len(productResponse.Options) == 0 {
+		productResponse.StockQuantity = availableStock(database.DB, product, nil)
+	} else {
+		productResponse.StockQuantity = 0
+		for _, variant := range productResponse.Variants {
+			productResponse.StockQuantity += variant.StockQuantity
+		}
+	}
 
 	// Return the list of products with the custom response struct
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -445,6 +460,13 @@ func ReducestockandDeleteCart(tx *gorm.DB, cart *models.Cart) error {
 		return err
 	}
 	for _, cartItem := range cartItems {
+		// Variants keep their own stock
+		if cartItem.VariantID != nil {
+			if err := reduceStock(tx, cartItem.ProductID, cartItem.VariantID, cartItem.Quantity); err != nil {
+				return err
+			}
+			continue
+		}
 		var product models.Product
 		if err := tx.Where("id = ?", cartItem.ProductID).First(&product).Error; err != nil {
 			return err
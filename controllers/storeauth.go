@@ -63,7 +63,7 @@ func StoreSignup(c *fiber.Ctx) error {
 	
 	
     // Store the image URL in the database
-    imageURL := fmt.Sprintf("https://jijoshibuukken.website/uploads/certificates/%s", filename)
+    imageURL := utils.UploadURL("certificates", filename)
 
 	// Save the file on the server
 	if err := c.SaveFile(file, uploadDir+filename); err != nil {
@@ -104,18 +104,10 @@ func StoreSignup(c *fiber.Ctx) error {
 	}
 
 	// Generate OTP and send to user's email
-	otp, err := utils.GenerateOTP()
-	log.Println(otp)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
-	}
-	if err := utils.SendOTPEmail(email, otp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
+	if ok, err := sendOTP(c, email, utils.OTPPurposeSignup); !ok {
+		return err
 	}
 
-	// Store OTP with expiration of 5 minutes
-	utils.StoreOTP(email, otp, 5*time.Minute)
-
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "OTP sent to email"})
 
 }
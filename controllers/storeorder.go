@@ -5,7 +5,9 @@ import (
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 func ListSellerOrders(c *fiber.Ctx) error {
@@ -14,25 +16,30 @@ func ListSellerOrders(c *fiber.Ctx) error {
 	// Get store id from user id
 	storeId, _ := GetStoreIDByUserID(uint(userId.(float64)))
 
-	// Fetch the orders that contain the store id
-	var orders []models.Order
-	if err := database.DB.Preload("Items", "product_id IN (SELECT id FROM products WHERE store_id = ?)", storeId).Find(&orders).Error; err != nil {
+	// Fetch the store's part of every order
+	var subOrders []models.SubOrder
+	if err := database.DB.Preload("Items").Where("store_id = ?", storeId).Order("created_at desc").Find(&subOrders).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve orders"})
 	}
 
-	// Create a response for each order including its items
+	// Create a response for each sub-order including its items
 	var orderResponses []fiber.Map
-	for _, order := range orders {
+	for _, subOrder := range subOrders {
+		var order models.Order
+		if err := database.DB.First(&order, subOrder.OrderID).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve orders"})
+		}
 		orderResponse := fiber.Map{
-			"order_id":       order.ID,
-			"user_id":        order.UserID,
-			"total_amount":   fmt.Sprintf("%.2f", order.TotalAmount),
-			"status":         order.Status,
-			"shipping_city":  order.ShippingCity,
-			"shipping_state": order.ShippingState,
-			"payment_mode":   order.PaymentMode,
-			"items":          make([]fiber.Map, len(order.Items)),
-			"payment_status": make([]fiber.Map, len(orders)),
+			"order_id":           order.ID,
+			"sub_order_id":       subOrder.ID,
+			"user_id":            order.UserID,
+			"total_amount":       fmt.Sprintf("%.2f", subOrder.ItemsTotal),
+			"payment_allocation": fmt.Sprintf("%.2f", subOrder.PaymentAllocation),
+			"status":             subOrder.Status,
+			"shipping_city":      order.ShippingCity,
+			"shipping_state":     order.ShippingState,
+			"payment_mode":       order.PaymentMode,
+			"items":              make([]fiber.Map, len(subOrder.Items)),
 		}
 
 		// Add the payment status of each order
@@ -42,8 +49,9 @@ func ListSellerOrders(c *fiber.Ctx) error {
 		}
 		orderResponse["payment_status"] = payment.PaymentStatus
 
-		for i, item := range order.Items {
+		for i, item := range subOrder.Items {
 			orderResponse["items"].([]fiber.Map)[i] = fiber.Map{
+				"item_id":     item.ID,
 				"product_id":  item.ProductID,
 				"quantity":    item.Quantity,
 				"total_price": fmt.Sprintf("%.2f", item.TotalPrice),
@@ -59,6 +67,46 @@ func ListSellerOrders(c *fiber.Ctx) error {
 	})
 }
 
+// sellerSubOrder loads the logged in seller's part of an order
+func sellerSubOrder(c *fiber.Ctx, tx *gorm.DB) (*models.SubOrder, error) {
+	storeId, _ := GetStoreIDByUserID(uint(c.Locals("user_id").(float64)))
+	var subOrder models.SubOrder
+	if err := tx.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Product")
+	}).Where("order_id = ? AND store_id = ?", c.Params("order_id"), storeId).First(&subOrder).Error; err != nil {
+		return nil, err
+	}
+	return &subOrder, nil
+}
+
+// UpdateSubOrderStatus moves the seller's whole part of an order to a new status
+func UpdateSubOrderStatus(c *fiber.Ctx) error {
+	req := new(models.StatusRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	tx := database.DB.Begin()
+	defer tx.Rollback()
+	subOrder, err := sellerSubOrder(c, tx)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	if err := transitionSubOrder(tx, subOrder, req.Status, ctxActor(c, models.RoleSeller), "", models.RefundMethodWallet); err != nil {
+		return transitionError(c, err, "Failed to update order")
+	}
+	var store models.Store
+	tx.Select("name").First(&store, subOrder.StoreID)
+	pushOrderStatus(tx, subOrder.OrderID, fmt.Sprintf("Your items from %s", store.Name), subOrder.Status)
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Order status updated successfully", "status": subOrder.Status})
+}
+
 func UpdateOrderItemStatus(c *fiber.Ctx) error {
 	//get the order id
 	orderId := c.Params("order_id")
@@ -74,16 +122,81 @@ func UpdateOrderItemStatus(c *fiber.Ctx) error {
 	}
 
 	//Fetch the order item from the order
+	tx := database.DB.Begin()
+	defer tx.Rollback()
 	var orderItem models.OrderItem
-	if err := database.DB.Where("order_id = ? AND id = ?", orderId, itemId).Where("product_id IN (SELECT id FROM products WHERE store_id = ?)", storeId).First(&orderItem).Error; err != nil {
+	if err := tx.Where("order_id = ? AND id = ?", orderId, itemId).Where("product_id IN (SELECT id FROM products WHERE store_id = ?)", storeId).First(&orderItem).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve order item"})
 	}
 
-	//Update the order item status
-	orderItem.Status = req.Status
-	if err := database.DB.Save(&orderItem).Error; err != nil {
+	//Update the order item status and roll it up to the order
+	if err := transitionOrderItem(tx, &orderItem, req.Status, ctxActor(c, models.RoleSeller), "", models.RefundMethodWallet); err != nil {
+		return transitionError(c, err, "Failed to update order item")
+	}
+	if err := syncOrderStatus(tx, orderItem.OrderID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order status"})
+	}
+	var product models.Product
+	tx.Select("name").First(&product, orderItem.ProductID)
+	pushOrderStatus(tx, orderItem.OrderID, fmt.Sprintf("%s in your order", product.Name), orderItem.Status)
+	if err := tx.Commit().Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update order item"})
 	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Order item status updated successfully"})
 
 }
+
+// GetSellerOrderDetails returns the seller's part of an order along with the
+// order timeline for it
+func GetSellerOrderDetails(c *fiber.Ctx) error {
+	subOrder, err := sellerSubOrder(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	var order models.Order
+	if err := database.DB.First(&order, subOrder.OrderID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+
+	items := make([]fiber.Map, len(subOrder.Items))
+	for i, item := range subOrder.Items {
+		items[i] = fiber.Map{
+			"item_id":      item.ID,
+			"product_id":   item.ProductID,
+			"product_name": item.Product.Name,
+			"quantity":     item.Quantity,
+			"total_price":  fmt.Sprintf("%.2f", item.TotalPrice),
+			"status":       item.Status,
+		}
+	}
+
+	timeline, err := orderTimeline(database.DB, order.ID, &subOrder.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve order timeline"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Order details retrieved successfully",
+		"data": fiber.Map{
+			"order_id":           order.ID,
+			"sub_order_id":       subOrder.ID,
+			"status":             subOrder.Status,
+			"items_total":        fmt.Sprintf("%.2f", subOrder.ItemsTotal),
+			"payment_allocation": fmt.Sprintf("%.2f", subOrder.PaymentAllocation),
+			"shipping_city":      order.ShippingCity,
+			"shipping_state":     order.ShippingState,
+			"payment_mode":       order.PaymentMode,
+			"items":              items,
+			"timeline":           timeline,
+		},
+	})
+}
+
+// GenerateSellerInvoicePdf generates the invoice for the seller's part of an order
+func GenerateSellerInvoicePdf(c *fiber.Ctx) error {
+	subOrder, err := sellerSubOrder(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Order not found"})
+	}
+	return sendSubOrderInvoice(c, subOrder)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+)
+
+// buildSubOrders groups the order items by store and splits the coupon
+// discount and the order payment between the stores in proportion to their
+// items total. storeOf maps a product to the store selling it.
+func buildSubOrders(orderID uint, items []models.OrderItem, storeOf map[uint]uint, couponSavings, finalAmount float64) (map[uint]*models.SubOrder, []uint) {
+	subOrders := make(map[uint]*models.SubOrder)
+	var storeIDs []uint
+	var itemsTotal float64
+	for _, item := range items {
+		storeID := storeOf[item.ProductID]
+		subOrder, ok := subOrders[storeID]
+		if !ok {
+			subOrder = &models.SubOrder{OrderID: orderID, StoreID: storeID}
+			subOrders[storeID] = subOrder
+			storeIDs = append(storeIDs, storeID)
+		}
+		subOrder.ItemsTotal += item.TotalPrice
+		subOrder.OrderDiscount += item.Product.Price*float64(item.Quantity) - item.TotalPrice
+		itemsTotal += item.TotalPrice
+	}
+	sort.Slice(storeIDs, func(i, j int) bool { return storeIDs[i] < storeIDs[j] })
+
+	// The last store takes the rounding remainder so the allocations add up
+	// to the amount actually paid
+	allocated, couponAllocated := 0.0, 0.0
+	for i, storeID := range storeIDs {
+		subOrder := subOrders[storeID]
+		roundAmount(&subOrder.ItemsTotal)
+		subOrder.OrderDiscount = math.Max(0, subOrder.OrderDiscount)
+		roundAmount(&subOrder.OrderDiscount)
+		if i == len(storeIDs)-1 {
+			subOrder.CouponShare = couponSavings - couponAllocated
+			subOrder.PaymentAllocation = finalAmount - allocated
+		} else if itemsTotal > 0 {
+			subOrder.CouponShare = couponSavings * subOrder.ItemsTotal / itemsTotal
+			subOrder.PaymentAllocation = finalAmount * subOrder.ItemsTotal / itemsTotal
+		}
+		roundAmount(&subOrder.CouponShare)
+		roundAmount(&subOrder.PaymentAllocation)
+		couponAllocated += subOrder.CouponShare
+		allocated += subOrder.PaymentAllocation
+	}
+	return subOrders, storeIDs
+}
+
+// createSubOrders saves one sub-order per store and links the order items to
+// them. The items must already exist and have their Product loaded.
+func createSubOrders(tx *gorm.DB, orderID uint, items []models.OrderItem, couponSavings, finalAmount float64) ([]models.SubOrder, error) {
+	storeOf := make(map[uint]uint)
+	for _, item := range items {
+		storeOf[item.ProductID] = item.Product.StoreID
+	}
+	subOrders, storeIDs := buildSubOrders(orderID, items, storeOf, couponSavings, finalAmount)
+
+	created := make([]models.SubOrder, 0, len(storeIDs))
+	for _, storeID := range storeIDs {
+		subOrder := subOrders[storeID]
+		var storeItems []models.OrderItem
+		var itemIDs []uint
+		for _, item := range items {
+			if storeOf[item.ProductID] == storeID {
+				storeItems = append(storeItems, item)
+				itemIDs = append(itemIDs, item.ID)
+			}
+		}
+		subOrder.Status = rollupStatus(storeItems)
+		if err := tx.Create(subOrder).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Model(&models.OrderItem{}).Where("id IN ?", itemIDs).Update("sub_order_id", subOrder.ID).Error; err != nil {
+			return nil, err
+		}
+		created = append(created, *subOrder)
+	}
+	return created, nil
+}
+
+// reduceSubOrderAmounts takes a canceled or returned item out of the totals
+// of its sub-order
+func reduceSubOrderAmounts(tx *gorm.DB, item models.OrderItem, refundAmount float64) error {
+	if item.SubOrderID == nil {
+		return nil
+	}
+	return tx.Model(&models.SubOrder{}).Where("id = ?", *item.SubOrderID).Updates(map[string]interface{}{
+		"items_total":        gorm.Expr("GREATEST(items_total - ?, 0)", item.TotalPrice),
+		"payment_allocation": gorm.Expr("GREATEST(payment_allocation - ?, 0)", refundAmount),
+	}).Error
+}
+
+// BackfillSubOrders splits orders placed before sub-orders existed so that
+// vendors keep seeing their part of them
+func BackfillSubOrders(db *gorm.DB) error {
+	var orders []models.Order
+	if err := db.Where("id NOT IN (SELECT order_id FROM sub_orders)").Find(&orders).Error; err != nil {
+		return err
+	}
+	for _, order := range orders {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var items []models.OrderItem
+			if err := tx.Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).Where("order_id = ?", order.ID).Find(&items).Error; err != nil {
+				return err
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			var detail models.OrderPaymentDetail
+			tx.Where("order_id = ?", order.ID).First(&detail)
+			_, err := createSubOrders(tx, order.ID, items, detail.CouponSavings, order.TotalAmount)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+)
+
+func TestBuildSubOrders(t *testing.T) {
+	// Products 1 and 2 are sold by store 10, product 3 by store 20
+	storeOf := map[uint]uint{1: 10, 2: 10, 3: 20}
+	items := []models.OrderItem{
+		{ProductID: 3, Quantity: 1, TotalPrice: 400, Product: models.Product{Price: 400}},
+		{ProductID: 1, Quantity: 2, TotalPrice: 500, Product: models.Product{Price: 300}},
+		{ProductID: 2, Quantity: 1, TotalPrice: 100, Product: models.Product{Price: 100}},
+	}
+	subOrders, storeIDs := buildSubOrders(7, items, storeOf, 100, 900)
+
+	if len(storeIDs) != 2 || storeIDs[0] != 10 || storeIDs[1] != 20 {
+		t.Fatalf("stores = %v, want [10 20]", storeIDs)
+	}
+	tests := []struct {
+		storeID                                                   uint
+		itemsTotal, orderDiscount, couponShare, paymentAllocation float64
+	}{
+		{10, 600, 100, 60, 540},
+		{20, 400, 0, 40, 360},
+	}
+	for _, tt := range tests {
+		subOrder := subOrders[tt.storeID]
+		if subOrder.OrderID != 7 || subOrder.StoreID != tt.storeID {
+			t.Fatalf("store %d: sub-order of order %d for store %d", tt.storeID, subOrder.OrderID, subOrder.StoreID)
+		}
+		if subOrder.ItemsTotal != tt.itemsTotal || subOrder.OrderDiscount != tt.orderDiscount ||
+			subOrder.CouponShare != tt.couponShare || subOrder.PaymentAllocation != tt.paymentAllocation {
+			t.Errorf("store %d: items %.2f, discount %.2f, coupon %.2f, payment %.2f; want %.2f, %.2f, %.2f, %.2f",
+				tt.storeID, subOrder.ItemsTotal, subOrder.OrderDiscount, subOrder.CouponShare, subOrder.PaymentAllocation,
+				tt.itemsTotal, tt.orderDiscount, tt.couponShare, tt.paymentAllocation)
+		}
+	}
+}
+
+func TestBuildSubOrdersLastStoreTakesRemainder(t *testing.T) {
+	storeOf := map[uint]uint{1: 1, 2: 2, 3: 3}
+	var items []models.OrderItem
+	for productID := uint(1); productID <= 3; productID++ {
+		items = append(items, models.OrderItem{ProductID: productID, Quantity: 1, TotalPrice: 100, Product: models.Product{Price: 100}})
+	}
+	subOrders, storeIDs := buildSubOrders(1, items, storeOf, 10, 290)
+
+	var coupon, paid float64
+	for _, storeID := range storeIDs {
+		coupon += subOrders[storeID].CouponShare
+		paid += subOrders[storeID].PaymentAllocation
+	}
+	if math.Abs(coupon-10) > 0.001 || math.Abs(paid-290) > 0.001 {
+		t.Fatalf("allocated coupon %.2f and payment %.2f, want 10 and 290", coupon, paid)
+	}
+	if last := subOrders[3]; last.CouponShare != 3.34 || last.PaymentAllocation != 96.66 {
+		t.Fatalf("last store: coupon %.2f, payment %.2f, want 3.34 and 96.66", last.CouponShare, last.PaymentAllocation)
+	}
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Suggestions is the in-memory type-ahead index. When it is nil the suggest
+// endpoint returns nothing.
+var Suggestions *utils.SuggestIndex
+
+// suggestionTables are the tables whose changes make the index stale
+var suggestionTables = map[string]bool{"products": true, "categories": true, "stores": true}
+
+// InitSuggestions builds the suggestion index from db and keeps it fresh.
+// Any create, update or delete of a product, category or store through GORM
+// schedules a rebuild; a full rebuild also runs every interval.
+func InitSuggestions(db *gorm.DB, interval time.Duration) {
+	Suggestions = utils.NewSuggestIndex(func() ([]utils.Suggestion, error) {
+		return loadSuggestions(db)
+	})
+	invalidate := func(tx *gorm.DB) {
+		if tx.Error == nil && suggestionTables[tx.Statement.Table] {
+			Suggestions.Invalidate()
+		}
+	}
+	callbacks := []error{
+		db.Callback().Create().After("gorm:create").Register("suggestions:invalidate", invalidate),
+		db.Callback().Update().After("gorm:update").Register("suggestions:invalidate", invalidate),
+		db.Callback().Delete().After("gorm:delete").Register("suggestions:invalidate", invalidate),
+	}
+	for _, err := range callbacks {
+		if err != nil {
+			log.Printf("Failed to watch changes for suggestions: %v", err)
+		}
+	}
+	Suggestions.Start(interval)
+}
+
+// loadSuggestions returns the names of active products, categories and
+// stores and the popular searches. Products are weighted by popularity.
+func loadSuggestions(db *gorm.DB) ([]utils.Suggestion, error) {
+	var products []models.Product
+	if err := db.Select("id", "name", "popularity_score").Where("is_active = ?", true).Find(&products).Error; err != nil {
+		return nil, err
+	}
+	var categories []models.Category
+	if err := db.Select("id", "name").Where("is_active = ?", true).Find(&categories).Error; err != nil {
+		return nil, err
+	}
+	var stores []models.Store
+	if err := db.Select("id", "name").Find(&stores).Error; err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]utils.Suggestion, 0, len(products)+len(categories)+len(stores))
+	for _, product := range products {
+		suggestions = append(suggestions, utils.Suggestion{Kind: utils.SuggestionProduct, ID: product.ID, Text: product.Name, Weight: product.PopularityScore})
+	}
+	for _, category := range categories {
+		suggestions = append(suggestions, utils.Suggestion{Kind: utils.SuggestionCategory, ID: category.ID, Text: category.Name})
+	}
+	for _, store := range stores {
+		suggestions = append(suggestions, utils.Suggestion{Kind: utils.SuggestionStore, ID: store.ID, Text: store.Name})
+	}
+	queries, err := popularQuerySuggestions(db)
+	if err != nil {
+		return nil, err
+	}
+	return append(suggestions, queries...), nil
+}
+
+// SearchSuggestions returns type-ahead suggestions for q: product, category
+// and store names that start with it or look like it, and popular past
+// searches. Without q only popular searches are returned.
+func SearchSuggestions(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 5)
+	if limit < 1 || limit > 20 {
+		limit = 5
+	}
+	q := c.Query("q")
+	q = utils.TruncateRunes(q, 100)
+	if Suggestions == nil {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"query": q, "products": []utils.Suggestion{}, "categories": []utils.Suggestion{}, "stores": []utils.Suggestion{}, "queries": []utils.Suggestion{}})
+	}
+	result := Suggestions.Suggest(q, limit, config.GetFloat("SUGGEST_MIN_QUERY_COUNT", 3))
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"query":      q,
+		"products":   result[utils.SuggestionProduct],
+		"categories": result[utils.SuggestionCategory],
+		"stores":     result[utils.SuggestionStore],
+		"queries":    result[utils.SuggestionQuery],
+	})
+}
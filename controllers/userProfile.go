@@ -7,6 +7,7 @@ import (
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
@@ -81,7 +82,7 @@ func UpdateProfile(c *fiber.Ctx) error {
 		}
 
 		// Store the file path in the database
-		dbUser.ProfilePicture = fmt.Sprintf("https://jijoshibuukken.website/uploads/profile_pictures/%s", fileName)
+		dbUser.ProfilePicture = utils.UploadURL("profile_pictures", fileName)
 	}
 
 	// Save the updated user to the database
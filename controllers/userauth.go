@@ -2,7 +2,6 @@ package controllers
 
 import (
 	"log"
-	"time"
 
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
@@ -76,65 +75,42 @@ func Signup(c *fiber.Ctx) error {
 
 
 	// Generate OTP and send to user's email
-	otp, err := utils.GenerateOTP()
-	log.Println(otp)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
-	}
-	if err := utils.SendOTPEmail(req.Email, otp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
+	if ok, err := sendOTP(c, req.Email, utils.OTPPurposeSignup); !ok {
+		return err
 	}
 
-	// Store OTP with expiration of 5 minutes
-	utils.StoreOTP(req.Email, otp, 5*time.Minute)
-
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "OTP sent to email"})
 }
 
-var otpCooldown = make(map[string]time.Time) // To track the cooldown of each email
-
-// ResendOTP handles resending the OTP to the user's email
+// ResendOTP handles resending the OTP to the user's email. The purpose
+// defaults to signup.
 func ResendOTP(c *fiber.Ctx) error {
-	type ResendOTPRequest struct {
-		Email string `json:"email"`
-	}
-
-	req := new(ResendOTPRequest)
+	req := new(models.OTPRequest)
 	if err := c.BodyParser(req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
 	}
-
-	// Check if the email is on cooldown
-	if lastSentTime, exists := otpCooldown[req.Email]; exists {
-		timeSinceLastSent := time.Since(lastSentTime)
-		if timeSinceLastSent < 1*time.Minute {
-			remainingTime := 1*time.Minute - timeSinceLastSent
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error":         "Please wait before requesting another OTP",
-				"cooldown_time": remainingTime.Seconds(),
-			})
-		}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	// Generate a new OTP
-	otp, err := utils.GenerateOTP()
-	log.Println("Generated OTP:", otp) // Log the generated OTP (for debugging)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate OTP"})
+	purpose := utils.OTPPurpose(req.Purpose)
+	if purpose == "" {
+		purpose = utils.OTPPurposeSignup
 	}
-
-	// Send the OTP via email
-	if err := utils.SendOTPEmail(req.Email, otp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
+	if !utils.ValidOTPPurpose(purpose) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid OTP purpose"})
 	}
 
-	// Store the OTP with an expiration of 5 minutes
-	utils.StoreOTP(req.Email, otp, 5*time.Minute)
-
-	// Update the last sent time in cooldown map (start the cooldown)
-	otpCooldown[req.Email] = time.Now()
+	// Apply the same account checks as the endpoint that sent the first
+	// code, answering the same way either way so the endpoint does not
+	// reveal who has an account. The service enforces the cooldown.
+	var user models.User
+	if err := database.DB.Where("email = ?", req.Email).First(&user).Error; err == nil && canReceiveOTP(user, purpose) {
+		if ok, err := sendOTP(c, req.Email, purpose); !ok {
+			return err
+		}
+	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "OTP resent to email"})
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "If the account can use it, an OTP was resent to the email"})
 }
 
 func VerifyOTP(c *fiber.Ctx) error {
@@ -146,8 +122,8 @@ func VerifyOTP(c *fiber.Ctx) error {
 	}
 
 	// Verify OTP
-	if !utils.VerifyOTP(req.Email, req.OTP) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired OTP"})
+	if err := OTPs.Verify(req.Email, utils.OTPPurposeSignup, req.OTP); err != nil {
+		return otpError(c, err)
 	}
 
 	// Find the user by email
@@ -201,8 +177,8 @@ func Login(c *fiber.Ctx) error {
 
 	}
 
-	// Generate JWT token
-	token, err := utils.GenerateJWT(user)
+	// Start a session and generate its tokens
+	tokens, err := issueSession(c, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
 	}
@@ -219,11 +195,12 @@ func Login(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save user"})
 	}
 
-	// Return the token and user info
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"message": "Login successful",
-		"token":   token,
-	})
+	// Move the cart built before logging in into the user's cart
+	mergeGuestCartOnLogin(c, user, tokens)
+
+	// Return the tokens
+	tokens["message"] = "Login successful"
+	return c.Status(fiber.StatusOK).JSON(tokens)
 }
 
 func ForgetPassword(c *fiber.Ctx) error {
@@ -244,17 +221,9 @@ func ForgetPassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User with this  email not found!"})
 	}
 
-	otp, err := utils.GenerateOTP()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate OTP"})
-	}
-
-	// Store OTP with expiration of 5 minutes
-	utils.StoreOTP(email.Email, otp, 5*time.Minute)
-	log.Println(otp)
 	// send the otp to the email
-	if err := utils.SendOTPEmail(email.Email, otp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to send OTP"})
+	if ok, err := sendOTP(c, email.Email, utils.OTPPurposePasswordReset); !ok {
+		return err
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"messsage": "Password reset email send"})
@@ -269,8 +238,8 @@ func ResetPassword(c *fiber.Ctx) error {
 	}
 
 	// Verify OTP
-	if !utils.VerifyOTP(req.Email, req.OTP) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired OTP"})
+	if err := OTPs.Verify(req.Email, utils.OTPPurposePasswordReset, req.OTP); err != nil {
+		return otpError(c, err)
 	}
 
 	// Fetch the user by email
@@ -292,6 +261,10 @@ func ResetPassword(c *fiber.Ctx) error {
 	if err := database.DB.Save(&user).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update user password"})
 	}
+	// Sessions started with the old password are no longer trusted
+	if err := revokeUserSessions(database.DB, user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to revoke user sessions"})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Password reset successfully"})
 }
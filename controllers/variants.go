@@ -0,0 +1,535 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	// errVariantRequired is returned when a product with variants is added
+	// to the cart without choosing one
+	errVariantRequired = errors.New("choose a variant of this product")
+	// errVariantNotFound is returned for a variant that does not belong to
+	// the product or is no longer sold
+	errVariantNotFound = errors.New("variant not found")
+)
+
+// resolveVariant returns the variant of product a cart or order line is for.
+// Products without variants return nil.
+func resolveVariant(tx *gorm.DB, product models.Product, variantID *uint) (*models.ProductVariant, error) {
+	var count int64
+	if err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		if variantID != nil {
+			return nil, errVariantNotFound
+		}
+		return nil, nil
+	}
+	if variantID == nil {
+		return nil, errVariantRequired
+	}
+	var variant models.ProductVariant
+	if err := tx.Preload("Values").Preload("Images").Where("id = ? AND product_id = ? AND is_active = ?", *variantID, product.ID, true).
+		First(&variant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errVariantNotFound
+		}
+		return nil, err
+	}
+	return &variant, nil
+}
+
+// variantError maps a resolveVariant error to a response
+func variantError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errVariantRequired):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Please choose a variant of this product"})
+	case errors.Is(err, errVariantNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Variant not found"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load variant"})
+}
+
+// offerFor returns the discount percentage that applies to a product or one
+// of its variants. An offer on the variant wins over one on the product.
+func offerFor(tx *gorm.DB, productID uint, variantID *uint) *float64 {
+	var offer models.Offer
+	query := tx.Where("product_id = ?", productID)
+	if variantID != nil {
+		query = query.Where("variant_id = ? OR variant_id IS NULL", *variantID).Order("variant_id IS NULL")
+	} else {
+		query = query.Where("variant_id IS NULL")
+	}
+	if err := query.First(&offer).Error; err != nil || offer.DiscountPercentage <= 0 {
+		return nil
+	}
+	return &offer.DiscountPercentage
+}
+
+// linePrice returns the unit price of a product or variant, the price after
+// its offer and the offer percentage
+func linePrice(tx *gorm.DB, product models.Product, variant *models.ProductVariant) (price, discounted float64, discountPercentage *float64) {
+	price = product.Price
+	var variantID *uint
+	if variant != nil {
+		price = variant.UnitPrice(product.Price)
+		variantID = &variant.ID
+	}
+	discounted = price
+	if discountPercentage = offerFor(tx, product.ID, variantID); discountPercentage != nil {
+		discounted = price * (1 - *discountPercentage/100)
+	}
+	return price, discounted, discountPercentage
+}
+
+// availableStock is how many units of a product or variant can be sold, the
+// stock less what active reservations hold
+func availableStock(tx *gorm.DB, product models.Product, variant *models.ProductVariant) int {
+	stock := product.StockQuantity
+	if variant != nil {
+		stock = variant.StockQuantity
+	}
+	reserved, err := reservedStock(tx, product.ID, variantID(variant))
+	if err != nil {
+		log.Printf("Failed to count reserved stock of product %d: %v", product.ID, err)
+	}
+	return stock - reserved
+}
+
+// reduceStock takes quantity units of a product or variant out of stock.
+// Products are saved through the model so their update hook can deactivate
+// them when they sell out.
+func reduceStock(tx *gorm.DB, productID uint, variantID *uint, quantity int) error {
+	if variantID != nil {
+		return restoreStock(tx, productID, variantID, -quantity)
+	}
+	var product models.Product
+	if err := tx.First(&product, productID).Error; err != nil {
+		return err
+	}
+	product.StockQuantity -= quantity
+	return tx.Save(&product).Error
+}
+
+// variantOwnedProduct loads a product of the logged in seller
+func variantOwnedProduct(c *fiber.Ctx, tx *gorm.DB) (*models.Product, error) {
+	storeID, err := GetStoreIDByUserID(uint(c.Locals("user_id").(float64)))
+	if err != nil {
+		return nil, err
+	}
+	var product models.Product
+	if err := tx.Where("id = ? AND store_id = ?", c.Params("id"), storeID).First(&product).Error; err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// saveVariantImages stores uploaded images of a variant and returns them
+// with the paths of the saved files. The files are saved before the images
+// are added to the database and must be removed if that fails.
+func saveVariantImages(c *fiber.Ctx, product *models.Product, files []*multipart.FileHeader) ([]models.Image, []string, error) {
+	var images []models.Image
+	var paths []string
+	for _, file := range files {
+		fileName := fmt.Sprintf("%d_%d_%s", product.StoreID, time.Now().UnixNano(), file.Filename)
+		path := "./uploads/product_images/" + fileName
+		if err := c.SaveFile(file, path); err != nil {
+			utils.RemoveFiles(paths)
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+		productID := product.ID
+		images = append(images, models.Image{
+			URL:       utils.UploadURL("product_images", fileName),
+			ProductID: &productID,
+		})
+	}
+	return images, paths, nil
+}
+
+// formValue returns the first value of a multipart form field
+func formValue(form *multipart.Form, key string) (string, bool) {
+	values := form.Value[key]
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.TrimSpace(values[0]), true
+}
+
+// parseOptionValueIDs reads option_value_ids given either as repeated fields
+// or as a comma separated list
+func parseOptionValueIDs(form *multipart.Form) ([]uint, error) {
+	var ids []uint
+	for _, field := range form.Value["option_value_ids"] {
+		for _, part := range strings.Split(field, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids, nil
+}
+
+// checkVariantValues makes sure a variant has exactly one value of every
+// option type of its product and that no other variant has the same values
+func checkVariantValues(tx *gorm.DB, productID uint, valueIDs []uint, variantID uint) ([]models.ProductOptionValue, error) {
+	var options []models.ProductOption
+	if err := tx.Where("product_id = ?", productID).Find(&options).Error; err != nil {
+		return nil, err
+	}
+	if len(options) == 0 {
+		return nil, errors.New("add option types to the product before adding variants")
+	}
+	var values []models.ProductOptionValue
+	if err := tx.Where("id IN ? AND option_id IN (SELECT id FROM product_options WHERE product_id = ?)", valueIDs, productID).
+		Find(&values).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[uint]bool)
+	for _, value := range values {
+		if seen[value.OptionID] {
+			return nil, errors.New("choose one value for each option")
+		}
+		seen[value.OptionID] = true
+	}
+	if len(values) != len(valueIDs) || len(seen) != len(options) {
+		return nil, errors.New("choose one value for each option")
+	}
+
+	// Compare the combination with the other variants of the product
+	key := variantKey(values)
+	var variants []models.ProductVariant
+	if err := tx.Preload("Values").Where("product_id = ? AND id <> ?", productID, variantID).Find(&variants).Error; err != nil {
+		return nil, err
+	}
+	for _, other := range variants {
+		if variantKey(other.Values) == key {
+			return nil, fmt.Errorf("variant %s already has these options", other.SKU)
+		}
+	}
+	return values, nil
+}
+
+// variantKey identifies a combination of option values
+func variantKey(values []models.ProductOptionValue) string {
+	ids := make([]int, len(values))
+	for i, value := range values {
+		ids[i] = int(value.ID)
+	}
+	sort.Ints(ids)
+	return fmt.Sprint(ids)
+}
+
+// AddProductOption adds an option type with its values to a seller's product
+func AddProductOption(c *fiber.Ctx) error {
+	product, err := variantOwnedProduct(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
+	}
+	req := new(models.ProductOptionRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Variants made before the option would not have a value for it
+	var variants int64
+	if err := database.DB.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&variants).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add option"})
+	}
+	if variants > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Remove the product's variants before adding option types"})
+	}
+
+	var position int64
+	database.DB.Model(&models.ProductOption{}).Where("product_id = ?", product.ID).Count(&position)
+	option := models.ProductOption{ProductID: product.ID, Name: strings.TrimSpace(req.Name), Position: int(position)}
+	seen := make(map[string]bool)
+	for _, value := range req.Values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[strings.ToLower(value)] {
+			continue
+		}
+		seen[strings.ToLower(value)] = true
+		option.Values = append(option.Values, models.ProductOptionValue{Value: value, Position: len(option.Values)})
+	}
+	if len(option.Values) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "An option needs at least one value"})
+	}
+	if err := database.DB.Create(&option).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add option"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Option added successfully", "option": option})
+}
+
+// DeleteProductOption removes an option type that no variant uses
+func DeleteProductOption(c *fiber.Ctx) error {
+	product, err := variantOwnedProduct(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
+	}
+	var option models.ProductOption
+	if err := database.DB.Where("id = ? AND product_id = ?", c.Params("option_id"), product.ID).First(&option).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Option not found"})
+	}
+	var variants int64
+	if err := database.DB.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&variants).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete option"})
+	}
+	if variants > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Remove the product's variants before deleting option types"})
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("option_id = ?", option.ID).Delete(&models.ProductOptionValue{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&option).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete option"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Option deleted successfully"})
+}
+
+// AddProductVariant adds a variant to a seller's product. It takes a
+// multipart form with sku, stock_quantity, option_value_ids, an optional
+// price overriding the product price and optional images.
+func AddProductVariant(c *fiber.Ctx) error {
+	product, err := variantOwnedProduct(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to parse multipart form"})
+	}
+
+	sku, _ := formValue(form, "sku")
+	if sku == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "SKU is required"})
+	}
+	variant := models.ProductVariant{ProductID: product.ID, SKU: sku, IsActive: true}
+	if raw, ok := formValue(form, "stock_quantity"); ok {
+		if variant.StockQuantity, err = strconv.Atoi(raw); err != nil || variant.StockQuantity < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid stock quantity"})
+		}
+	}
+	if raw, ok := formValue(form, "price"); ok && raw != "" {
+		price, err := strconv.ParseFloat(raw, 64)
+		if err != nil || price <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid price"})
+		}
+		variant.Price = &price
+	}
+	valueIDs, err := parseOptionValueIDs(form)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid option value IDs"})
+	}
+	images, paths, err := saveVariantImages(c, product, form.File["images"])
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save images"})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		values, err := checkVariantValues(tx, product.ID, valueIDs, 0)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		var taken int64
+		if err := tx.Model(&models.ProductVariant{}).Unscoped().Where("sku = ?", sku).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fiber.NewError(fiber.StatusConflict, "SKU is already in use")
+		}
+		variant.Values = values
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		for i := range images {
+			images[i].VariantID = &variant.ID
+		}
+		if len(images) > 0 {
+			if err := tx.Create(&images).Error; err != nil {
+				return err
+			}
+		}
+		variant.Images = images
+		return nil
+	})
+	if err != nil {
+		utils.RemoveFiles(paths)
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to add variant"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Variant added successfully", "variant": variant})
+}
+
+// UpdateProductVariant changes the SKU, price, stock or active flag of a
+// variant and adds images to it. Send an empty price to go back to the
+// product price.
+func UpdateProductVariant(c *fiber.Ctx) error {
+	product, err := variantOwnedProduct(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
+	}
+	var variant models.ProductVariant
+	if err := database.DB.Where("id = ? AND product_id = ?", c.Params("variant_id"), product.ID).First(&variant).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Variant not found"})
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to parse multipart form"})
+	}
+
+	oldPrice := effectiveVariantPrice(database.DB, *product, variant)
+	updates := map[string]interface{}{}
+	if sku, ok := formValue(form, "sku"); ok && sku != "" && sku != variant.SKU {
+		var taken int64
+		database.DB.Model(&models.ProductVariant{}).Unscoped().Where("sku = ? AND id <> ?", sku, variant.ID).Count(&taken)
+		if taken > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "SKU is already in use"})
+		}
+		updates["sku"] = sku
+	}
+	if raw, ok := formValue(form, "price"); ok {
+		if raw == "" {
+			updates["price"] = nil
+		} else {
+			price, err := strconv.ParseFloat(raw, 64)
+			if err != nil || price <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid price"})
+			}
+			updates["price"] = price
+		}
+	}
+	if raw, ok := formValue(form, "stock_quantity"); ok {
+		stock, err := strconv.Atoi(raw)
+		if err != nil || stock < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid stock quantity"})
+		}
+		updates["stock_quantity"] = stock
+	}
+	if raw, ok := formValue(form, "is_active"); ok {
+		active, err := strconv.ParseBool(raw)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid is_active value"})
+		}
+		updates["is_active"] = active
+	}
+
+	images, paths, err := saveVariantImages(c, product, form.File["images"])
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save images"})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&variant).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		for i := range images {
+			images[i].VariantID = &variant.ID
+		}
+		if len(images) > 0 {
+			return tx.Create(&images).Error
+		}
+		return nil
+	})
+	if err != nil {
+		utils.RemoveFiles(paths)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update variant"})
+	}
+	if err := database.DB.Preload("Values").Preload("Images").First(&variant, variant.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load variant"})
+	}
+	notifyPriceDrop(database.DB, *product, oldPrice, effectiveVariantPrice(database.DB, *product, variant))
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Variant updated successfully", "variant": variant})
+}
+
+// DeleteProductVariant removes a variant from sale. Past orders keep their
+// SKU and option values.
+func DeleteProductVariant(c *fiber.Ctx) error {
+	product, err := variantOwnedProduct(c, database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Product not found or not authorized"})
+	}
+	result := database.DB.Where("id = ? AND product_id = ?", c.Params("variant_id"), product.ID).Delete(&models.ProductVariant{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete variant"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Variant not found"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Variant deleted successfully"})
+}
+
+// effectiveVariantPrice is what a variant sells for after offers
+func effectiveVariantPrice(tx *gorm.DB, product models.Product, variant models.ProductVariant) float64 {
+	_, discounted, _ := linePrice(tx, product, &variant)
+	roundAmount(&discounted)
+	return discounted
+}
+
+// variantResponses lists the active variants of a product for shoppers
+func variantResponses(tx *gorm.DB, product models.Product) ([]models.VariantResponse, []models.ProductOption) {
+	var options []models.ProductOption
+	tx.Preload("Values", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Where("product_id = ?", product.ID).Order("position").Find(&options)
+	var variants []models.ProductVariant
+	tx.Preload("Values").Preload("Images").Where("product_id = ? AND is_active = ?", product.ID, true).Order("id").Find(&variants)
+
+	responses := make([]models.VariantResponse, 0, len(variants))
+	for i := range variants {
+		variant := variants[i]
+		price, discounted, percentage := linePrice(tx, product, &variant)
+		response := models.VariantResponse{
+			ID:                 variant.ID,
+			SKU:                variant.SKU,
+			Label:              variant.Label(),
+			Price:              price,
+			DiscountPercentage: percentage,
+			StockQuantity:      availableStock(tx, product, &variant),
+			Images:             make([]string, len(variant.Images)),
+		}
+		if percentage != nil {
+			response.DiscountedPrice = &discounted
+		}
+		for _, value := range variant.Values {
+			response.OptionValueIDs = append(response.OptionValueIDs, value.ID)
+		}
+		for j, image := range variant.Images {
+			response.Images[j] = image.URL
+		}
+		responses = append(responses, response)
+	}
+	return responses, options
+}
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"time"
+
 	"github.com/Ukkenjijo/trendtrek/database"
 	"github.com/Ukkenjijo/trendtrek/models"
 	"github.com/gofiber/fiber/v2"
@@ -24,9 +26,30 @@ func GetWalletBallance(c *fiber.Ctx) error {
 func GetWalletHistory(c *fiber.Ctx) error {
 	userID := c.Locals("user_id")
 
+	query := database.DB.Where("user_id = ?", userID)
+	// Optional filters: operation (e.g. "deposit", "credit", "debit") and a
+	// from/to date range in YYYY-MM-DD format
+	if operation := c.Query("operation"); operation != "" {
+		query = query.Where("LOWER(operation) = LOWER(?)", operation)
+	}
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid date format"})
+		}
+		query = query.Where("created_at >= ?", fromDate)
+	}
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid date format"})
+		}
+		query = query.Where("created_at < ?", toDate.Add(24*time.Hour)) // Include the full end date
+	}
+
 	// Find the user's walletHistory
 	var walletHistory []models.WalletHistory
-	if err := database.DB.Where("user_id = ?", userID).Find(&walletHistory).Error; err != nil {
+	if err := query.Order("created_at DESC").Find(&walletHistory).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve walletHistory"})
 	}
 
@@ -37,4 +60,4 @@ func GetWalletHistory(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"walletHistory": walletHistory,
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"errors"
+	"math"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInsufficientBalance is returned when a wallet cannot cover a debit
+var ErrInsufficientBalance = errors.New("insufficient wallet balance")
+
+// walletEntry describes a movement of money into or out of a wallet
+type walletEntry struct {
+	UserID    uint
+	Amount    float64 // positive credits the wallet, negative debits it
+	Account   string  // the system account on the other side
+	Operation string  // shown on the wallet history, e.g. "credit"
+	Reason    string
+	Reference string
+}
+
+// postWalletEntry locks the wallet row, posts a balanced ledger transaction
+// between the wallet and entry.Account, updates the cached balance and adds
+// the wallet history line. It must run inside a transaction.
+func postWalletEntry(tx *gorm.DB, entry walletEntry) (*models.WalletHistory, error) {
+	var wallet models.Wallet
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", entry.UserID).First(&wallet).Error; err != nil {
+		return nil, err
+	}
+	amount := entry.Amount
+	roundAmount(&amount)
+	balance := wallet.Balance + amount
+	roundAmount(&balance)
+	if balance < 0 {
+		return nil, ErrInsufficientBalance
+	}
+
+	walletID := wallet.ID
+	ledgerTx := models.LedgerTransaction{
+		Reference:   entry.Reference,
+		Description: entry.Reason,
+		Postings: []models.LedgerPosting{
+			{Account: models.WalletAccount(wallet.ID), WalletID: &walletID, Amount: amount},
+			{Account: entry.Account, Amount: -amount},
+		},
+	}
+	if err := tx.Create(&ledgerTx).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&wallet).Update("balance", balance).Error; err != nil {
+		return nil, err
+	}
+
+	history := models.WalletHistory{
+		WalletID:            wallet.ID,
+		UserID:              entry.UserID,
+		Amount:              math.Abs(amount),
+		Operation:           entry.Operation,
+		Balance:             balance,
+		Reason:              entry.Reason,
+		LedgerTransactionID: &ledgerTx.ID,
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+// creditWallet adds amount to a user's wallet from a system account
+func creditWallet(tx *gorm.DB, userID uint, amount float64, account, reason, reference string) (*models.WalletHistory, error) {
+	return postWalletEntry(tx, walletEntry{UserID: userID, Amount: amount, Account: account, Operation: "credit", Reason: reason, Reference: reference})
+}
+
+// debitWallet takes amount out of a user's wallet into a system account. It
+// returns ErrInsufficientBalance when the wallet cannot cover it.
+func debitWallet(tx *gorm.DB, userID uint, amount float64, account, reason, reference string) (*models.WalletHistory, error) {
+	return postWalletEntry(tx, walletEntry{UserID: userID, Amount: -amount, Account: account, Operation: "debit", Reason: reason, Reference: reference})
+}
+
+// WalletMismatch is a wallet whose balance does not match its ledger
+type WalletMismatch struct {
+	WalletID      uint    `json:"wallet_id"`
+	UserID        uint    `json:"user_id"`
+	Balance       float64 `json:"balance"`
+	LedgerBalance float64 `json:"ledger_balance"`
+	Difference    float64 `json:"difference"`
+}
+
+// reconcileWallets compares every wallet balance with the sum of its ledger
+// postings and lists the ledger transactions that do not balance
+func reconcileWallets(db *gorm.DB) ([]WalletMismatch, []uint, int64, error) {
+	var mismatches []WalletMismatch
+	if err := db.Table("wallets").
+		Select("wallets.id AS wallet_id, wallets.user_id, wallets.balance, COALESCE(SUM(ledger_postings.amount), 0) AS ledger_balance").
+		Joins("LEFT JOIN ledger_postings ON ledger_postings.wallet_id = wallets.id").
+		Where("wallets.deleted_at IS NULL").
+		Group("wallets.id, wallets.user_id, wallets.balance").
+		Having("ROUND(CAST(wallets.balance AS numeric), 2) <> COALESCE(SUM(ledger_postings.amount), 0)").
+		Order("wallets.id").
+		Scan(&mismatches).Error; err != nil {
+		return nil, nil, 0, err
+	}
+	for i := range mismatches {
+		mismatches[i].Difference = mismatches[i].Balance - mismatches[i].LedgerBalance
+		roundAmount(&mismatches[i].Difference)
+	}
+
+	var unbalanced []uint
+	if err := db.Model(&models.LedgerPosting{}).
+		Group("transaction_id").
+		Having("SUM(amount) <> 0").
+		Pluck("transaction_id", &unbalanced).Error; err != nil {
+		return nil, nil, 0, err
+	}
+
+	var checked int64
+	if err := db.Model(&models.Wallet{}).Count(&checked).Error; err != nil {
+		return nil, nil, 0, err
+	}
+	return mismatches, unbalanced, checked, nil
+}
+
+// WalletReconciliationReport lists wallets whose balance differs from their
+// ledger and ledger transactions whose postings do not add up to zero
+func WalletReconciliationReport(c *fiber.Ctx) error {
+	mismatches, unbalanced, checked, err := reconcileWallets(database.DB)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reconcile wallets"})
+	}
+	if mismatches == nil {
+		mismatches = []WalletMismatch{}
+	}
+	if unbalanced == nil {
+		unbalanced = []uint{}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"wallets_checked":         checked,
+		"mismatched_wallets":      mismatches,
+		"unbalanced_transactions": unbalanced,
+		"consistent":              len(mismatches) == 0 && len(unbalanced) == 0,
+	})
+}
+
+// BackfillWalletLedger posts an opening balance for wallets that hold money
+// from before the ledger existed, so they reconcile
+func BackfillWalletLedger(db *gorm.DB) error {
+	var wallets []models.Wallet
+	if err := db.Where("balance <> 0 AND id NOT IN (SELECT wallet_id FROM ledger_postings WHERE wallet_id IS NOT NULL)").
+		Find(&wallets).Error; err != nil {
+		return err
+	}
+	for _, wallet := range wallets {
+		walletID := wallet.ID
+		roundAmount(&wallet.Balance)
+		ledgerTx := models.LedgerTransaction{
+			Reference:   "opening_balance",
+			Description: "Opening balance",
+			Postings: []models.LedgerPosting{
+				{Account: models.WalletAccount(wallet.ID), WalletID: &walletID, Amount: wallet.Balance},
+				{Account: models.LedgerAccountOpening, Amount: -wallet.Balance},
+			},
+		}
+		if err := db.Create(&ledgerTx).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/Ukkenjijo/trendtrek/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// topUpLimits returns the smallest and largest single top-up and the most a
+// customer can top up in a day
+func topUpLimits() (min, max, daily float64) {
+	return config.GetFloat("WALLET_TOPUP_MIN", 100),
+		config.GetFloat("WALLET_TOPUP_MAX", 10000),
+		config.GetFloat("WALLET_TOPUP_DAILY_CAP", 20000)
+}
+
+// errTopUpCap is returned when a top-up would go over the daily cap
+var errTopUpCap = errors.New("daily top-up limit reached")
+
+// toppedUpToday sums the customer's top-ups started or credited today.
+// Pending top-ups count towards the cap so it cannot be beaten by opening
+// several gateway orders at once.
+func toppedUpToday(tx *gorm.DB, userID uint) (float64, error) {
+	var toppedUp float64
+	now := time.Now()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	err := tx.Model(&models.WalletTopUp{}).
+		Where("user_id = ? AND ((status = ? AND created_at >= ?) OR (status = ? AND COALESCE(credited_at, created_at) >= ?))", userID, "pending", startOfDay, "paid", startOfDay).
+		Select("COALESCE(SUM(amount), 0)").Scan(&toppedUp).Error
+	return toppedUp, err
+}
+
+// topUpCapError answers a top-up that would go over the daily cap
+func topUpCapError(c *fiber.Ctx, daily, toppedUp float64) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Daily top-up limit of %.2f reached, %.2f left today", daily, math.Max(daily-toppedUp, 0))})
+}
+
+// CreateWalletTopUp starts a wallet top-up by creating a gateway order the
+// customer pays against
+func CreateWalletTopUp(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+
+	var req models.WalletTopUpRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := utils.ValidateStruct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	roundAmount(&req.Amount)
+
+	min, max, daily := topUpLimits()
+	if req.Amount < min || req.Amount > max {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Top-up amount must be between %.2f and %.2f", min, max)})
+	}
+
+	// Check the cap before creating the gateway order, then again with the
+	// wallet locked so concurrent requests cannot each pass it
+	toppedUp, err := toppedUpToday(database.DB, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check top-up limit"})
+	}
+	if toppedUp+req.Amount > daily {
+		return topUpCapError(c, daily, toppedUp)
+	}
+
+	gatewayOrder, err := PaymentGateway.CreateOrder(req.Amount, "INR", fmt.Sprintf("topup_%d_%d", userID, time.Now().Unix()))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create Razorpay order"})
+	}
+	topUp := models.WalletTopUp{UserID: userID, Amount: req.Amount, GatewayOrderID: gatewayOrder.ID, Status: "pending"}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var wallet models.Wallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).First(&wallet).Error; err != nil {
+			return err
+		}
+		total, err := toppedUpToday(tx, userID)
+		if err != nil {
+			return err
+		}
+		toppedUp = total
+		if toppedUp+req.Amount > daily {
+			return errTopUpCap
+		}
+		return tx.Create(&topUp).Error
+	})
+	switch {
+	case errors.Is(err, errTopUpCap):
+		return topUpCapError(c, daily, toppedUp)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Wallet not found"})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create top-up"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":           "Top-up created, complete the payment to credit your wallet",
+		"top_up_id":         topUp.ID,
+		"razorpay_order_id": gatewayOrder.ID,
+		"amount":            req.Amount,
+		"currency":          "INR",
+	})
+}
+
+// VerifyWalletTopUp checks the gateway signature of a top-up payment and
+// credits the wallet
+func VerifyWalletTopUp(c *fiber.Ctx) error {
+	userID := uint(c.Locals("user_id").(float64))
+
+	var payload models.RAZORPAY_Payment
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if !PaymentGateway.VerifyPayment(payload.RazorpayOrderID, payload.RazorpayPaymentID, payload.RazorpaySignature) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Signature mismatch"})
+	}
+
+	var history *models.WalletHistory
+	refused := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		topUp, err := topUpByGatewayOrder(tx, payload.RazorpayOrderID)
+		if err != nil {
+			return err
+		}
+		if topUp == nil || topUp.UserID != userID {
+			return gorm.ErrRecordNotFound
+		}
+		history, err = creditTopUp(tx, topUp, payload.RazorpayPaymentID)
+		refused = topUp.Status == "refunding" || topUp.Status == "refunded"
+		return err
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Top-up not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to credit wallet"})
+	}
+	if refused {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The top-up expired and the daily top-up limit is reached, the payment will be refunded"})
+	}
+	if history == nil {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "Top-up already credited"})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Wallet topped up successfully",
+		"amount":  history.Amount,
+		"balance": history.Balance,
+	})
+}
+
+// topUpByGatewayOrder loads and locks the top-up paid through a gateway order
+func topUpByGatewayOrder(tx *gorm.DB, gatewayOrderID string) (*models.WalletTopUp, error) {
+	if gatewayOrderID == "" {
+		return nil, nil
+	}
+	var topUp models.WalletTopUp
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("gateway_order_id = ?", gatewayOrderID).First(&topUp).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &topUp, nil
+}
+
+// creditTopUp credits a paid top-up to the wallet as a deposit. It returns
+// nil when the top-up was already credited or refused, so the verify endpoint
+// and the webhook can both call it. A payment for a top-up that expired or
+// failed no longer counts towards the daily cap, so it is only credited if
+// the cap still allows it with the wallet locked; otherwise it is marked for
+// a refund.
+func creditTopUp(tx *gorm.DB, topUp *models.WalletTopUp, gatewayPaymentID string) (*models.WalletHistory, error) {
+	switch topUp.Status {
+	case "paid", "refunding", "refunded":
+		return nil, nil
+	case "pending":
+	default:
+		var wallet models.Wallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", topUp.UserID).First(&wallet).Error; err != nil {
+			return nil, err
+		}
+		toppedUp, err := toppedUpToday(tx, topUp.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, daily := topUpLimits(); toppedUp+topUp.Amount > daily {
+			topUp.Status = "refunding"
+			topUp.GatewayPaymentID = gatewayPaymentID
+			return nil, tx.Model(topUp).Updates(map[string]interface{}{"status": topUp.Status, "gateway_payment_id": gatewayPaymentID}).Error
+		}
+	}
+	history, err := postWalletEntry(tx, walletEntry{
+		UserID:    topUp.UserID,
+		Amount:    topUp.Amount,
+		Account:   models.LedgerAccountTopUps,
+		Operation: "deposit",
+		Reason:    "Wallet top-up",
+		Reference: fmt.Sprintf("topup:%d", topUp.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	topUp.Status = "paid"
+	if err := tx.Model(topUp).Updates(map[string]interface{}{
+		"status":             "paid",
+		"gateway_payment_id": gatewayPaymentID,
+		"credited_at":        now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// ExpirePendingTopUps marks top-ups that are still unpaid window after they
+// were started as expired, so they stop counting towards the daily cap. A
+// payment that still arrives for one is only credited if the cap allows it
+// and refunded otherwise. It returns how many top-ups were expired.
+func ExpirePendingTopUps(db *gorm.DB, window time.Duration) (int64, error) {
+	result := db.Model(&models.WalletTopUp{}).
+		Where("status = ? AND created_at < ?", "pending", time.Now().Add(-window)).
+		Update("status", "expired")
+	return result.RowsAffected, result.Error
+}
+
+// RefundRefusedTopUps sends the payments of top-ups that could not be
+// credited back through the gateway. The top-up id is the idempotency key,
+// so a refund issued before its status could be saved is not issued twice.
+func RefundRefusedTopUps(db *gorm.DB) error {
+	var ids []uint
+	if err := db.Model(&models.WalletTopUp{}).Where("status = ?", "refunding").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var topUp models.WalletTopUp
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("id = ? AND status = ?", id, "refunding").First(&topUp).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return nil
+				}
+				return err
+			}
+			if _, err := PaymentGateway.Refund(topUp.GatewayPaymentID, topUp.Amount, fmt.Sprintf("topup_%d", topUp.ID)); err != nil {
+				return err
+			}
+			return tx.Model(&topUp).Update("status", "refunded").Error
+		})
+		if err != nil {
+			log.Printf("Failed to refund top-up %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// StartTopUpExpiryJob expires unpaid top-ups older than window and refunds
+// refused ones, checking every interval in the background
+func StartTopUpExpiryJob(db *gorm.DB, window, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := RefundRefusedTopUps(db); err != nil {
+				log.Printf("Failed to refund refused top-ups: %v", err)
+			}
+			count, err := ExpirePendingTopUps(db, window)
+			if err != nil {
+				log.Printf("Failed to expire unpaid top-ups: %v", err)
+				continue
+			}
+			if count > 0 {
+				log.Printf("Expired %d unpaid top-ups", count)
+			}
+		}
+	}()
+}
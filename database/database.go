@@ -21,11 +21,20 @@ func ConnectToDB(){
 	}
 
 	// Run database migrations (example)
-	err = DB.AutoMigrate(&models.User{},&models.Store{},&models.Category{},&models.Product{},&models.Image{},&models.Address{},&models.Cart{},&models.CartItem{},&models.Order{},&models.OrderItem{},&models.Payment{},&models.WishlistItem{},&models.Wallet{},&models.WalletHistory{},&models.Coupon{},&models.OrderPaymentDetail{},&models.Offer{})
-	if err != nil {
+	if err := Migrate(DB); err != nil {
 		fmt.Printf("Error during migration: %v\n", err)
 	}
+	if err := SetupProductSearch(DB); err != nil {
+		log.Printf("Product search could not be set up, falling back to plain text matching: %v", err)
+	} else {
+		ProductSearchReady = true
+	}
 
 	fmt.Println("Database connection successful!")
 
-}
\ No newline at end of file
+}
+
+// Migrate creates or updates the tables of every model on db
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&models.User{},&models.Store{},&models.Category{},&models.Product{},&models.Image{},&models.Address{},&models.Cart{},&models.CartItem{},&models.Order{},&models.OrderItem{},&models.Payment{},&models.WishlistItem{},&models.Wallet{},&models.WalletHistory{},&models.Coupon{},&models.OrderPaymentDetail{},&models.Offer{},&models.OrderEvent{},&models.SubOrder{},&models.WebhookEvent{},&models.Refund{},&models.IdempotencyKey{},&models.LedgerTransaction{},&models.LedgerPosting{},&models.WalletTopUp{},&models.Session{},&models.OTP{},&models.OutboxMessage{},&models.Notification{},&models.ProductOption{},&models.ProductOptionValue{},&models.ProductVariant{},&models.Review{},&models.ReviewImage{},&models.ProductView{},&models.SearchLog{},&models.GuestCart{},&models.GuestCartItem{},&models.StockReservation{})
+}
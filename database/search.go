@@ -0,0 +1,63 @@
+package database
+
+import "gorm.io/gorm"
+
+// productSearchSetup keeps products.search_vector up to date for full-text
+// search. The vector weighs the product name highest, then the category
+// name, the store name and the description. Triggers refresh it when a
+// product changes or its category or store is renamed.
+var productSearchSetup = []string{
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+	`CREATE OR REPLACE FUNCTION product_search_vector(p_name text, p_description text, p_category_id bigint, p_store_id bigint)
+	RETURNS tsvector AS $$
+		SELECT setweight(to_tsvector('english', coalesce(p_name, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce((SELECT name FROM categories WHERE id = p_category_id), '')), 'B') ||
+			setweight(to_tsvector('english', coalesce((SELECT name FROM stores WHERE id = p_store_id), '')), 'C') ||
+			setweight(to_tsvector('english', coalesce(p_description, '')), 'D')
+	$$ LANGUAGE sql STABLE`,
+	`CREATE OR REPLACE FUNCTION products_search_vector_update() RETURNS trigger AS $$
+	BEGIN
+		NEW.search_vector := product_search_vector(NEW.name, NEW.description, NEW.category_id, NEW.store_id);
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS products_search_vector ON products`,
+	`CREATE TRIGGER products_search_vector BEFORE INSERT OR UPDATE OF name, description, category_id, store_id
+	ON products FOR EACH ROW EXECUTE FUNCTION products_search_vector_update()`,
+	`CREATE OR REPLACE FUNCTION products_search_vector_refresh() RETURNS trigger AS $$
+	BEGIN
+		IF TG_TABLE_NAME = 'categories' THEN
+			UPDATE products SET search_vector = product_search_vector(name, description, category_id, store_id) WHERE category_id = NEW.id;
+		ELSE
+			UPDATE products SET search_vector = product_search_vector(name, description, category_id, store_id) WHERE store_id = NEW.id;
+		END IF;
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS categories_search_vector ON categories`,
+	`CREATE TRIGGER categories_search_vector AFTER UPDATE OF name ON categories
+	FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name) EXECUTE FUNCTION products_search_vector_refresh()`,
+	`DROP TRIGGER IF EXISTS stores_search_vector ON stores`,
+	`CREATE TRIGGER stores_search_vector AFTER UPDATE OF name ON stores
+	FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name) EXECUTE FUNCTION products_search_vector_refresh()`,
+	`CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector)`,
+	`CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING GIN (name gin_trgm_ops)`,
+	`UPDATE products SET search_vector = product_search_vector(name, description, category_id, store_id) WHERE search_vector IS NULL`,
+}
+
+// ProductSearchReady is set once SetupProductSearch succeeded. Until then
+// searches cannot use the search vector or trigram matching and fall back to
+// plain text matching.
+var ProductSearchReady bool
+
+// SetupProductSearch installs the full-text and trigram search objects and
+// fills the search vector of products that have none. It is safe to run on
+// every start.
+func SetupProductSearch(db *gorm.DB) error {
+	for _, statement := range productSearchSetup {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
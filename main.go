@@ -2,8 +2,11 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/controllers"
 	"github.com/Ukkenjijo/trendtrek/database"
 
 	"github.com/Ukkenjijo/trendtrek/routes"
@@ -22,7 +25,13 @@ func init() {
 }
 
 func main() {
-	app := fiber.New()
+	// Behind a proxy the client address comes from PROXY_HEADER, but only on
+	// requests from one of the TRUSTED_PROXIES
+	app := fiber.New(fiber.Config{
+		ProxyHeader:             os.Getenv("PROXY_HEADER"),
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          config.GetList("TRUSTED_PROXIES"),
+	})
 	// Enable CORS
 	app.Use(cors.New())
 
@@ -32,6 +41,25 @@ func main() {
 	app.Use(logger.New())
 
 	database.ConnectToDB()
+	if err := controllers.BackfillSubOrders(database.DB); err != nil {
+		log.Printf("Failed to backfill store orders: %v", err)
+	}
+	if err := controllers.BackfillWalletLedger(database.DB); err != nil {
+		log.Printf("Failed to backfill wallet ledger: %v", err)
+	}
+	controllers.InitPaymentGateway()
+	controllers.InitOTPService(database.DB)
+	controllers.InitNotifications(database.DB, 10*time.Second)
+	controllers.StartRefundIssuer(database.DB, time.Minute)
+	controllers.StartRefundPoller(database.DB, 15*time.Minute)
+	controllers.InitSuggestions(database.DB, config.GetDuration("SUGGEST_REFRESH_INTERVAL", 5*time.Minute))
+	controllers.StartProductViewRecorder(database.DB, 10*time.Second)
+	controllers.StartSearchLogCleanup(database.DB, config.GetDuration("SEARCH_LOG_RETENTION", 180*24*time.Hour), 24*time.Hour)
+	controllers.StartPopularityJob(database.DB, config.GetDuration("POPULARITY_INTERVAL", time.Hour))
+	controllers.StartGuestCartCleanup(database.DB, time.Hour)
+	controllers.StartReservationExpiryJob(database.DB, time.Minute)
+	controllers.StartTopUpExpiryJob(database.DB, config.GetDuration("WALLET_TOPUP_WINDOW", 30*time.Minute), time.Minute)
+	controllers.StartOrderExpiryJob(database.DB, config.GetDuration("ORDER_PAYMENT_WINDOW", 30*time.Minute), time.Minute)
 
 	// Setup routes
 	routes.SetUpRoutes(app)
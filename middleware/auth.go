@@ -3,6 +3,10 @@ package middleware
 import (
 	"log"
 	"os"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
 
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
@@ -39,9 +43,25 @@ func JWTMiddleware() fiber.Handler {
 			// Log the extracted claims for debugging
 			log.Printf("Extracted claims: %v\n", claims)
 
-			// Store user ID and role in the context for future use
+			// The token is only good while its session is open
+			sid, ok := claims["sid"].(float64)
+			if !ok {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Invalid or expired token",
+				})
+			}
+			var session models.Session
+			if err := database.DB.Select("id", "revoked_at", "expires_at").First(&session, uint(sid)).Error; err != nil ||
+				session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Session has ended, please log in again",
+				})
+			}
+
+			// Store user ID, role and session in the context for future use
 			c.Locals("user_id", claims["user_id"])
 			c.Locals("role", claims["role"])
+			c.Locals("session_id", session.ID)
 
 			return c.Next() // Proceed to the next handler
 		},
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/database"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/clause"
+)
+
+// idempotencyKeyTTL is how long a key is remembered. After that the same key
+// starts a new request.
+const idempotencyKeyTTL = 24 * time.Hour
+
+// Idempotency makes a route safe to retry. When the client sends an
+// Idempotency-Key header the first response is stored and replayed for every
+// repeat of the request. Reusing a key with a different request is rejected.
+// It must run after JWTMiddleware since keys are scoped to the user.
+func Idempotency() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Idempotency-Key is too long"})
+		}
+		userID, ok := c.Locals("user_id").(float64)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+		hash.Write(c.Body())
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// Forget keys that are past their lifetime
+		database.DB.Unscoped().Where("user_id = ? AND key = ? AND created_at < ?", uint(userID), key, time.Now().Add(-idempotencyKeyTTL)).
+			Delete(&models.IdempotencyKey{})
+
+		record := models.IdempotencyKey{UserID: uint(userID), Key: key, RequestHash: requestHash}
+		result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to store idempotency key"})
+		}
+
+		if result.RowsAffected == 0 {
+			var existing models.IdempotencyKey
+			if err := database.DB.Where("user_id = ? AND key = ?", uint(userID), key).First(&existing).Error; err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load idempotency key"})
+			}
+			if existing.RequestHash != requestHash {
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Idempotency-Key was already used for a different request"})
+			}
+			if existing.CompletedAt == nil {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A request with this Idempotency-Key is still being processed"})
+			}
+			c.Set("Idempotent-Replayed", "true")
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			return c.Status(existing.StatusCode).SendString(existing.ResponseBody)
+		}
+
+		err := c.Next()
+		status := c.Response().StatusCode()
+		// Server errors are not stored so the client can retry with the same key
+		if err != nil || status >= fiber.StatusInternalServerError {
+			if delErr := database.DB.Unscoped().Delete(&record).Error; delErr != nil {
+				log.Printf("Failed to release idempotency key %s: %v", key, delErr)
+			}
+			return err
+		}
+		now := time.Now()
+		if err := database.DB.Model(&record).Updates(map[string]interface{}{
+			"status_code":   status,
+			"response_body": string(c.Response().Body()),
+			"completed_at":  now,
+		}).Error; err != nil {
+			log.Printf("Failed to store response for idempotency key %s: %v", key, err)
+		}
+		return nil
+	}
+}
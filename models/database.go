@@ -67,25 +67,38 @@ type Category struct {
 }
 type Product struct {
 	gorm.Model
-	StoreID       uint     `gorm:"not null" json:"store_id"`                                          // Foreign key referencing Store
-	Store         *Store   `gorm:"foreignKey:StoreID" json:"store"`                                   // Relation to Store model
-	Name          string   `gorm:"type:varchar(100);not null" json:"name"`                            // Product name
-	Description   string   `gorm:"type:text" json:"description,omitempty"`                            // Product description (optional)
-	Price         float64  `gorm:"type:decimal(10,2);not null" json:"price" validate:"required,gt=0"` // Product price with 2 decimal places
-	StockQuantity int      `gorm:"default:0;check:stock_quantity > 0" json:"stock_quantity"`          // Stock quantity (default 0)
-	CategoryID    uint     `gorm:"not null" json:"category_id"`                                       // Foreign key referencing Category
-	Category      Category `gorm:"foreignKey:CategoryID" json:"category,omitempty"`                   // Relation to Category model
-	IsActive      bool     `gorm:"default:true" json:"is_active"`
-	Images        []Image  `gorm:"foreignKey:ProductID" json:"images,omitempty"` // Is product active (default: true)
-	StockLeft     int      `gorm:"default:0" json:"stock_left"`
-	Offer         *Offer   `json:"offer,omitempty"`
-	OfferID       *uint    `json:"offer_id"` // Stock left
+	StoreID       uint             `gorm:"not null" json:"store_id"`                                          // Foreign key referencing Store
+	Store         *Store           `gorm:"foreignKey:StoreID" json:"store"`                                   // Relation to Store model
+	Name          string           `gorm:"type:varchar(100);not null" json:"name"`                            // Product name
+	Description   string           `gorm:"type:text" json:"description,omitempty"`                            // Product description (optional)
+	Price         float64          `gorm:"type:decimal(10,2);not null" json:"price" validate:"required,gt=0"` // Product price with 2 decimal places
+	StockQuantity int              `gorm:"default:0;check:stock_quantity > 0" json:"stock_quantity"`          // Stock quantity (default 0)
+	CategoryID    uint             `gorm:"not null" json:"category_id"`                                       // Foreign key referencing Category
+	Category      Category         `gorm:"foreignKey:CategoryID" json:"category,omitempty"`                   // Relation to Category model
+	IsActive      bool             `gorm:"default:true" json:"is_active"`
+	Images        []Image          `gorm:"foreignKey:ProductID" json:"images,omitempty"` // Is product active (default: true)
+	StockLeft     int              `gorm:"default:0" json:"stock_left"`
+	Offer         *Offer           `json:"offer,omitempty"`
+	OfferID       *uint            `json:"offer_id"` // Stock left
+	Options       []ProductOption  `gorm:"foreignKey:ProductID" json:"options,omitempty"`
+	Variants      []ProductVariant `gorm:"foreignKey:ProductID" json:"variants,omitempty"`
+	AverageRating float64          `gorm:"type:decimal(3,2);default:0;index" json:"average_rating"` // Average of the published reviews
+	RatingCount   int              `gorm:"default:0" json:"rating_count"`                           // Number of published reviews
+	// Decayed activity from orders, wishlist adds and views, recomputed by a background job
+	PopularityScore float64    `gorm:"default:0;index" json:"popularity_score"`
+	IsFeatured      bool       `gorm:"default:false" json:"is_featured"`
+	FeaturedFrom    *time.Time `json:"featured_from,omitempty"`        // Featured from this time, right away when empty
+	FeaturedUntil   *time.Time `json:"featured_until,omitempty"`       // Featured until this time, open ended when empty
+	FeaturedRank    int        `gorm:"default:0" json:"featured_rank"` // Lower ranks come first among featured products
+	// Weighted full-text document, filled by a database trigger
+	SearchVector string `gorm:"type:tsvector;->:false;<-:false" json:"-"`
 }
 
 // Offer Model
 type Offer struct {
 	gorm.Model
 	ProductID          uint    `json:"product_id"`
+	VariantID          *uint   `gorm:"index" json:"variant_id,omitempty"` // Set for an offer on a single variant
 	DiscountPercentage float64 `json:"discount_percentage" validate:"gte=0.0,lte=100.0"`
 }
 
@@ -117,15 +130,17 @@ type Cart struct {
 
 type CartItem struct {
 	gorm.Model
-	CartID             uint     `json:"cart_id"`
-	ProductID          uint     `json:"product_id"`
-	Product            Product  `json:"product" gorm:"foreignKey:ProductID"`
-	Quantity           int      `json:"quantity"`
-	Price              float64  `json:"price"`
-	DiscountedPrice    float64  `json:"discounted_price"`              // Unit price of the product
-	TotalPrice         float64  `json:"total_price"`                   // Calculated as Quantity * DiscountedPrice
-	DiscountPercentage *float64 `json:"discount_percentage,omitempty"` // Discount percentage from offer
-
+	CartID             uint            `json:"cart_id"`
+	ProductID          uint            `json:"product_id"`
+	Product            Product         `json:"product" gorm:"foreignKey:ProductID"`
+	VariantID          *uint           `gorm:"index" json:"variant_id,omitempty"`
+	Variant            *ProductVariant `gorm:"foreignKey:VariantID" json:"variant,omitempty"`
+	Quantity           int             `json:"quantity"`
+	Price              float64         `json:"price"`
+	DiscountedPrice    float64         `json:"discounted_price"`              // Unit price of the product
+	TotalPrice         float64         `json:"total_price"`                   // Calculated as Quantity * DiscountedPrice
+	DiscountPercentage *float64        `json:"discount_percentage,omitempty"` // Discount percentage from offer
+	AgreedPrice        float64         `json:"agreed_price"`                  // Unit price the customer last saw, changes from it must be acknowledged
 }
 
 type Order struct {
@@ -136,6 +151,7 @@ type Order struct {
 	PaymentMode string      `json:"payment_mode"` // e.g., "COD"
 	Status      string      `json:"status"`       // e.g., "pending", "shipped", "delivered", "canceled"
 	Items       []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
+	SubOrders   []SubOrder  `json:"sub_orders,omitempty" gorm:"foreignKey:OrderID"`
 
 	// Address snapshot fields
 	ShippingStreet  string `json:"shipping_street"`
@@ -144,23 +160,61 @@ type Order struct {
 	ShippingCountry string `json:"shipping_country"`
 	ShippingZipCode string `json:"shipping_zip_code"`
 }
+
+// SubOrder is the part of an order fulfilled by a single store. It carries
+// its own status and share of the order payment.
+type SubOrder struct {
+	gorm.Model
+	OrderID           uint        `gorm:"index;not null" json:"order_id"`
+	StoreID           uint        `gorm:"index;not null" json:"store_id"`
+	Store             *Store      `gorm:"foreignKey:StoreID" json:"store,omitempty"`
+	Status            string      `gorm:"default:'pending'" json:"status"`
+	ItemsTotal        float64     `json:"items_total"`        // Sum of the item totals after offers
+	OrderDiscount     float64     `json:"order_discount"`     // Offer discount on the items
+	CouponShare       float64     `json:"coupon_share"`       // Part of the coupon discount carried by this store
+	PaymentAllocation float64     `json:"payment_allocation"` // Part of the order payment allocated to this store
+	Items             []OrderItem `json:"items,omitempty" gorm:"foreignKey:SubOrderID"`
+}
+
 type OrderItem struct {
 	gorm.Model
-	OrderID      uint      `json:"order_id"`
-	ProductID    uint      `json:"product_id"`
-	Product      Product   `json:"product" gorm:"foreignKey:ProductID"`
-	Quantity     int       `json:"quantity"`
-	Price        float64   `json:"price"`
-	Status       string    `json:"status" gorm:"default:'pending'"` // individual item status
-	TotalPrice   float64   `json:"total_price"`                     // Price * Quantity
-	ReturnReason string    `json:"return_reason,omitempty"`         // Reason for returning the item
-	ReturnedAt   time.Time `json:"returned_at,omitempty"`
+	OrderID      uint            `json:"order_id"`
+	SubOrderID   *uint           `gorm:"index" json:"sub_order_id,omitempty"`
+	ProductID    uint            `json:"product_id"`
+	Product      Product         `json:"product" gorm:"foreignKey:ProductID"`
+	VariantID    *uint           `gorm:"index" json:"variant_id,omitempty"`
+	Variant      *ProductVariant `gorm:"foreignKey:VariantID" json:"variant,omitempty"`
+	SKU          string          `json:"sku,omitempty"`           // Variant SKU when ordered
+	VariantLabel string          `json:"variant_label,omitempty"` // Variant option values when ordered, e.g. "M / Red"
+	Quantity     int             `json:"quantity"`
+	Price        float64         `json:"price"`
+	Status       string          `json:"status" gorm:"default:'pending'"` // individual item status
+	TotalPrice   float64         `json:"total_price"`                     // Price * Quantity
+	ReturnReason string          `json:"return_reason,omitempty"`         // Reason for returning the item
+	ReturnedAt   time.Time       `json:"returned_at,omitempty"`
+}
+
+// OrderEvent is an entry on the order timeline. SubOrderID and OrderItemID
+// are set when the event concerns a single store or item rather than the
+// whole order.
+type OrderEvent struct {
+	gorm.Model
+	OrderID     uint   `gorm:"index;not null" json:"order_id"`
+	SubOrderID  *uint  `gorm:"index" json:"sub_order_id,omitempty"`
+	OrderItemID *uint  `gorm:"index" json:"order_item_id,omitempty"`
+	Type        string `gorm:"type:varchar(20);not null" json:"type"` // "status", "payment", "refund", "return"
+	FromStatus  string `json:"from_status,omitempty"`
+	ToStatus    string `json:"to_status,omitempty"`
+	Actor       Role   `gorm:"type:varchar(50)" json:"actor"` // customer, seller, admin or system
+	ActorID     uint   `json:"actor_id,omitempty"`
+	Note        string `json:"note,omitempty"`
 }
 
 type Image struct {
 	gorm.Model
 	URL       string `gorm:"type:varchar(255);not null" json:"url"` // URL or path of the image
 	ProductID *uint  `gorm:"index" json:"product_id,omitempty"`     // Optional: Foreign key to Product (nullable)
+	VariantID *uint  `gorm:"index" json:"variant_id,omitempty"`     // Set for images of a single variant
 
 }
 
@@ -169,9 +223,12 @@ type Payment struct {
 	OrderID           uint    `gorm:"not null" json:"order_id"`
 	UserID            uint    `json:"user_id"`
 	PaymentType       string  `gorm:"not null" json:"payment_type"`
-	RazorpayPaymentID string  `json:"razorpayment_id"`
+	RazorpayPaymentID string  `json:"razorpayment_id"`    // Razorpay order id the customer pays against
+	GatewayPaymentID  string  `json:"gateway_payment_id"` // Id of the captured payment at the gateway
 	PaymentStatus     string  `gorm:"default:'pending'" json:"payment_status"`
-	Amount            float64 `json:"amount"`
+	Amount            float64 `json:"amount"`         // Amount due through PaymentType
+	WalletAmount      float64 `json:"wallet_amount"`  // Part of a split payment taken from the wallet
+	GatewayAmount     float64 `json:"gateway_amount"` // Amount of the gateway order, more than Amount once items are canceled unpaid
 }
 
 type OrderPaymentDetail struct {
@@ -184,6 +241,146 @@ type OrderPaymentDetail struct {
 	CouponSavings    float64 `json:"coupon_savings"`
 	ShippingCost     float64 `json:"shipping_cost"`
 	FinalOrderAmount float64 `json:"final_order_amount"`
+	WalletAmount     float64 `json:"wallet_amount"` // Part of FinalOrderAmount paid from the wallet when split
+}
+
+// WebhookEvent records a processed gateway webhook so redeliveries of the
+// same event are ignored
+type WebhookEvent struct {
+	gorm.Model
+	Provider string `gorm:"type:varchar(50);not null" json:"provider"`
+	EventID  string `gorm:"uniqueIndex;not null" json:"event_id"`
+	Event    string `json:"event"`
+	Payload  string `gorm:"type:text" json:"payload"`
+}
+
+// Refund methods and statuses
+const (
+	RefundMethodWallet = "wallet"
+	RefundMethodSource = "source"
+
+	RefundStatusPending   = "pending"
+	RefundStatusProcessed = "processed"
+	RefundStatusFailed    = "failed"
+)
+
+// Refund is money returned to a customer for a canceled or returned order or
+// item, either into their wallet or back to the original payment method
+type Refund struct {
+	gorm.Model
+	OrderID         uint       `gorm:"index;not null" json:"order_id"`
+	OrderItemID     *uint      `json:"order_item_id,omitempty"`
+	PaymentID       uint       `json:"payment_id"`
+	UserID          uint       `json:"user_id"`
+	Amount          float64    `json:"amount"`
+	Method          string     `gorm:"type:varchar(20);not null" json:"method"`
+	GatewayRefundID string     `gorm:"index" json:"gateway_refund_id,omitempty"`
+	Status          string     `gorm:"type:varchar(20);default:'pending'" json:"status"`
+	Reason          string     `json:"reason"`
+	ProcessedAt     *time.Time `json:"processed_at,omitempty"`
+}
+
+// IdempotencyKey stores the response to a request sent with an
+// Idempotency-Key header so a retried request gets the same response
+// instead of being executed again
+type IdempotencyKey struct {
+	gorm.Model
+	UserID       uint       `gorm:"uniqueIndex:idx_idempotency_user_key;not null" json:"user_id"`
+	Key          string     `gorm:"uniqueIndex:idx_idempotency_user_key;type:varchar(255);not null" json:"key"`
+	RequestHash  string     `gorm:"type:varchar(64);not null" json:"request_hash"`
+	StatusCode   int        `json:"status_code"`
+	ResponseBody string     `gorm:"type:text" json:"response_body"`
+	CompletedAt  *time.Time `json:"completed_at"`
+}
+
+// WalletTopUp is money a customer adds to their wallet through the payment
+// gateway. The wallet is credited once the gateway payment is confirmed.
+type WalletTopUp struct {
+	gorm.Model
+	UserID           uint       `gorm:"index;not null" json:"user_id"`
+	Amount           float64    `json:"amount"`
+	GatewayOrderID   string     `gorm:"uniqueIndex" json:"razorpay_order_id"`
+	GatewayPaymentID string     `json:"gateway_payment_id"`
+	Status           string     `gorm:"type:varchar(20);default:'pending'" json:"status"` // pending, paid, failed, expired, refunding or refunded
+	CreditedAt       *time.Time `json:"credited_at,omitempty"`
+}
+
+// Session is a login of a user on one device. Access tokens carry the
+// session id and stop working once the session is revoked. The refresh token
+// is rotated on every use and only its hash is stored.
+type Session struct {
+	gorm.Model
+	UserID            uint       `gorm:"index;not null" json:"user_id"`
+	RefreshTokenHash  string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	PreviousTokenHash string     `gorm:"type:varchar(64);index" json:"-"`
+	UserAgent         string     `json:"user_agent"`
+	IPAddress         string     `json:"ip_address"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+}
+
+// OTP is a one time code sent to an email address. Only a keyed hash of the
+// code is stored. A code is used up once it is verified, replaced by a newer
+// code or has been guessed wrong too often.
+type OTP struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time  `gorm:"index" json:"created_at"`
+	Email      string     `gorm:"index:idx_otp_email_purpose;not null" json:"email"`
+	Purpose    string     `gorm:"type:varchar(30);index:idx_otp_email_purpose;not null" json:"purpose"`
+	CodeHash   string     `gorm:"type:varchar(64);not null" json:"-"`
+	IPAddress  string     `gorm:"index" json:"ip_address"`
+	Attempts   int        `gorm:"default:0" json:"attempts"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+}
+
+// In-app notification types
+const (
+	NotificationTypeOrderStatus = "order_status"
+	NotificationTypeNewOrder    = "new_order"
+	NotificationTypePriceDrop   = "price_drop"
+	NotificationTypeRefund      = "refund"
+)
+
+// Notification is an entry in a user's in-app notification feed
+type Notification struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UserID    uint       `gorm:"index:idx_notification_user_read;not null" json:"user_id"`
+	Type      string     `gorm:"type:varchar(30)" json:"type"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	OrderID   *uint      `json:"order_id,omitempty"`
+	ProductID *uint      `json:"product_id,omitempty"`
+	ReadAt    *time.Time `gorm:"index:idx_notification_user_read" json:"read_at"`
+}
+
+// Outbox message statuses
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusSent    = "sent"
+	OutboxStatusFailed  = "failed"
+)
+
+// OutboxMessage is a rendered notification waiting to be delivered. It is
+// written in the same transaction as the change it is about and sent later,
+// so a failing channel never fails the request. Failed sends are retried.
+type OutboxMessage struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Channel       string     `gorm:"type:varchar(20);not null" json:"channel"` // e.g. "email" or "sms"
+	Recipient     string     `gorm:"not null" json:"recipient"`
+	Template      string     `gorm:"type:varchar(50)" json:"template"`
+	Subject       string     `json:"subject"`
+	TextBody      string     `gorm:"type:text" json:"text_body"`
+	HTMLBody      string     `gorm:"type:text" json:"html_body"`
+	Status        string     `gorm:"type:varchar(20);index:idx_outbox_due;default:'pending'" json:"status"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index:idx_outbox_due" json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
 }
 
 type WishlistItem struct {
@@ -207,6 +404,8 @@ type WalletHistory struct {
 	Operation string  `json:"operation"` // "deposit", "withdrawal", etc.
 	Balance   float64 `json:"balance"`   // updated balance after operation
 	Reason    string  `json:"reason"`    // optional reason for transaction
+
+	LedgerTransactionID *uint `json:"ledger_transaction_id,omitempty"`
 }
 
 // Coupon represents a discount code in the system
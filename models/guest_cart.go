@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GuestCart is the cart of a visitor who has not logged in. It is found by
+// the hash of an opaque cart token the client holds, and is merged into the
+// user's cart on login.
+type GuestCart struct {
+	gorm.Model
+	TokenHash string          `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time       `gorm:"index" json:"expires_at"` // Pushed back on every change
+	Items     []GuestCartItem `gorm:"foreignKey:GuestCartID" json:"items"`
+}
+
+// GuestCartItem is a product in a guest cart. Prices are worked out when the
+// cart is read; only the price the visitor agreed to is stored, so changes
+// since then can be pointed out.
+type GuestCartItem struct {
+	gorm.Model
+	GuestCartID uint            `gorm:"index;not null" json:"guest_cart_id"`
+	ProductID   uint            `json:"product_id"`
+	Product     Product         `gorm:"foreignKey:ProductID" json:"product"`
+	VariantID   *uint           `json:"variant_id,omitempty"`
+	Variant     *ProductVariant `gorm:"foreignKey:VariantID" json:"variant,omitempty"`
+	Quantity    int             `json:"quantity"`
+	AgreedPrice float64         `json:"agreed_price"` // Unit price when the product was added
+}
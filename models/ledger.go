@@ -0,0 +1,52 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// System ledger accounts that wallet money moves to and from. Wallets have an
+// account of their own, see WalletAccount.
+const (
+	LedgerAccountSales     = "system:sales"
+	LedgerAccountRefunds   = "system:refunds"
+	LedgerAccountReferrals = "system:referrals"
+	LedgerAccountOpening   = "system:opening_balance"
+	LedgerAccountTopUps    = "system:topups"
+)
+
+// ErrLedgerImmutable is returned when a ledger entry is updated or deleted
+var ErrLedgerImmutable = errors.New("ledger entries cannot be changed")
+
+// LedgerTransaction groups the postings of a single money movement. The
+// amounts of its postings always add up to zero.
+type LedgerTransaction struct {
+	ID          uint            `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Reference   string          `gorm:"index" json:"reference"` // what caused the movement, e.g. "order:12"
+	Description string          `json:"description"`
+	Postings    []LedgerPosting `gorm:"foreignKey:TransactionID" json:"postings"`
+}
+
+// LedgerPosting is one side of a ledger transaction. A positive amount credits
+// the account and a negative amount debits it.
+type LedgerPosting struct {
+	ID            uint    `gorm:"primarykey" json:"id"`
+	TransactionID uint    `gorm:"index;not null" json:"transaction_id"`
+	Account       string  `gorm:"type:varchar(100);index;not null" json:"account"`
+	WalletID      *uint   `gorm:"index" json:"wallet_id,omitempty"`
+	Amount        float64 `gorm:"type:numeric(12,2);not null" json:"amount"`
+}
+
+// WalletAccount is the ledger account of a wallet
+func WalletAccount(walletID uint) string {
+	return fmt.Sprintf("wallet:%d", walletID)
+}
+
+func (LedgerTransaction) BeforeUpdate(tx *gorm.DB) error { return ErrLedgerImmutable }
+func (LedgerTransaction) BeforeDelete(tx *gorm.DB) error { return ErrLedgerImmutable }
+func (LedgerPosting) BeforeUpdate(tx *gorm.DB) error     { return ErrLedgerImmutable }
+func (LedgerPosting) BeforeDelete(tx *gorm.DB) error     { return ErrLedgerImmutable }
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Order and order item statuses
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusConfirmed = "confirmed"
+	OrderStatusPacked    = "packed"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCompleted = "completed"
+	OrderStatusCanceled  = "canceled"
+	OrderStatusReturned  = "returned"
+)
+
+// RoleSystem is used for transitions triggered by the application itself
+// (background jobs, payment callbacks) rather than by a logged in user
+const RoleSystem Role = "system"
+
+// Order event types recorded on the order timeline
+const (
+	OrderEventStatus  = "status"
+	OrderEventPayment = "payment"
+	OrderEventRefund  = "refund"
+	OrderEventReturn  = "return"
+)
+
+// Actor identifies who made a change to an order
+type Actor struct {
+	Role Role
+	ID   uint
+}
+
+// SystemActor is the actor for changes made by the application itself
+var SystemActor = Actor{Role: RoleSystem}
+
+// ErrInvalidTransition is returned when a status change is not allowed
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// orderTransitions lists, for every status, the statuses it can move to and
+// the roles that are allowed to make that move
+var orderTransitions = map[string]map[string][]Role{
+	OrderStatusPending: {
+		OrderStatusConfirmed: {RoleSeller, RoleAdmin, RoleSystem},
+		OrderStatusCanceled:  {RoleCustomer, RoleSeller, RoleAdmin, RoleSystem},
+	},
+	OrderStatusConfirmed: {
+		OrderStatusPacked:   {RoleSeller, RoleAdmin},
+		OrderStatusCanceled: {RoleCustomer, RoleSeller, RoleAdmin, RoleSystem},
+	},
+	OrderStatusPacked: {
+		OrderStatusShipped:  {RoleSeller, RoleAdmin},
+		OrderStatusCanceled: {RoleSeller, RoleAdmin, RoleSystem},
+	},
+	OrderStatusShipped: {
+		OrderStatusDelivered: {RoleSeller, RoleAdmin, RoleSystem},
+	},
+	OrderStatusDelivered: {
+		OrderStatusCompleted: {RoleAdmin, RoleSystem},
+		OrderStatusReturned:  {RoleCustomer, RoleAdmin},
+	},
+	OrderStatusCompleted: {
+		OrderStatusReturned: {RoleCustomer, RoleAdmin},
+	},
+	OrderStatusCanceled: {},
+	OrderStatusReturned: {},
+}
+
+// IsValidOrderStatus reports whether status is a known order status
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// ValidateTransition checks that role is allowed to move an order or order
+// item from one status to another
+func ValidateTransition(from, to string, role Role) error {
+	if !IsValidOrderStatus(to) {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidTransition, to)
+	}
+	roles, ok := orderTransitions[from][to]
+	if !ok {
+		return fmt.Errorf("%w: cannot move from %q to %q", ErrInvalidTransition, from, to)
+	}
+	for _, r := range roles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s cannot move from %q to %q", ErrInvalidTransition, role, from, to)
+}
+
+// IsFinalStatus reports whether no further transitions are possible
+func IsFinalStatus(status string) bool {
+	return len(orderTransitions[status]) == 0
+}
+
+// RestoresStockOnEntry reports whether entering status puts the items back in stock
+func RestoresStockOnEntry(status string) bool {
+	return status == OrderStatusCanceled || status == OrderStatusReturned
+}
+
+// RefundsOnEntry reports whether entering status makes the item refundable
+func RefundsOnEntry(status string) bool {
+	return status == OrderStatusCanceled || status == OrderStatusReturned
+}
+
+// IsInvoiceEligible reports whether an invoice can be generated in status
+func IsInvoiceEligible(status string) bool {
+	return status == OrderStatusDelivered || status == OrderStatusCompleted
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		role     Role
+		ok       bool
+	}{
+		{OrderStatusPending, OrderStatusConfirmed, RoleSeller, true},
+		{OrderStatusPending, OrderStatusConfirmed, RoleCustomer, false},
+		{OrderStatusPending, OrderStatusCanceled, RoleCustomer, true},
+		{OrderStatusPacked, OrderStatusCanceled, RoleCustomer, false},
+		{OrderStatusPacked, OrderStatusCanceled, RoleSeller, true},
+		{OrderStatusShipped, OrderStatusDelivered, RoleSystem, true},
+		{OrderStatusDelivered, OrderStatusReturned, RoleCustomer, true},
+		{OrderStatusDelivered, OrderStatusReturned, RoleSeller, false},
+		{OrderStatusCompleted, OrderStatusReturned, RoleAdmin, true},
+		{OrderStatusPending, OrderStatusShipped, RoleAdmin, false},
+		{OrderStatusCanceled, OrderStatusPending, RoleAdmin, false},
+		{OrderStatusReturned, OrderStatusDelivered, RoleSystem, false},
+		{OrderStatusPending, "lost", RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		err := ValidateTransition(tt.from, tt.to, tt.role)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s -> %s = %v, want allowed", tt.role, tt.from, tt.to, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("%s: %s -> %s = %v, want ErrInvalidTransition", tt.role, tt.from, tt.to, err)
+		}
+	}
+}
+
+func TestFinalStatuses(t *testing.T) {
+	for status := range orderTransitions {
+		final := status == OrderStatusCanceled || status == OrderStatusReturned
+		if IsFinalStatus(status) != final {
+			t.Errorf("IsFinalStatus(%q) = %v, want %v", status, !final, final)
+		}
+		if RestoresStockOnEntry(status) != final || RefundsOnEntry(status) != final {
+			t.Errorf("%q: restores stock %v and refunds %v on entry, want %v", status, RestoresStockOnEntry(status), RefundsOnEntry(status), final)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// ProductView is one visit to a product page, kept for the popularity score
+type ProductView struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	ProductID uint      `gorm:"index;not null" json:"product_id"`
+	Viewer    string    `gorm:"type:varchar(64);index" json:"-"` // Hashed visitor cookie or client address, to count repeat visits once
+}
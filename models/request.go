@@ -37,6 +37,19 @@ type ResetPasswordRequest struct {
 type OrderRequest struct {
 	AddressID   string `json:"address_id" validate:"required"`
 	PaymentMode string `json:"payment_mode" validate:"required"`
+	// UseWallet applies the wallet balance to the order and leaves the rest
+	// to PaymentMode. WalletAmount caps how much of the balance is used.
+	UseWallet    bool    `json:"use_wallet"`
+	WalletAmount float64 `json:"wallet_amount" validate:"gte=0"`
+	// AcknowledgedPrices accepts the price changes of the cart, mapping each
+	// cart item ID to the new price the customer was shown
+	AcknowledgedPrices map[uint]float64 `json:"acknowledged_prices"`
+}
+
+// PriceAcknowledgementRequest accepts price changes of the cart, mapping each
+// cart item ID to the new price the customer was shown
+type PriceAcknowledgementRequest struct {
+	AcknowledgedPrices map[uint]float64 `json:"acknowledged_prices" validate:"required"`
 }
 
 type StatusRequest struct {
@@ -49,6 +62,10 @@ type RAZORPAY_Payment struct {
 	RazorpaySignature string `json:"razorpay_signature"`
 }
 
+type WalletTopUpRequest struct {
+	Amount float64 `json:"amount" validate:"required,gt=0"`
+}
+
 type UpdateProductStockRequest struct {
 	StockQuantity int `json:"stock_quantity" validate:"required"`
 }
@@ -62,3 +79,17 @@ type CouponRequest struct {
 	MinPurchaseAmount float64  `json:"min_purchase_amount" validate:"required"`
 	MaxDiscountAmount float64  `json:"max_discount_amount" validate:"required"`
 }
+
+type OTPRequest struct {
+	Email   string `json:"email" validate:"required,email"`
+	Purpose string `json:"purpose"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type ProductOptionRequest struct {
+	Name   string   `json:"name" validate:"required,max=50"`
+	Values []string `json:"values" validate:"required,min=1"`
+}
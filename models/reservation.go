@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Stock reservation statuses
+const (
+	ReservationActive    = "active"    // Holds the stock while the customer pays
+	ReservationConverted = "converted" // Paid for, the stock was taken out
+	ReservationReleased  = "released"  // Payment failed or timed out, a new attempt can renew it
+	ReservationCanceled  = "canceled"  // The item was canceled, the hold is never renewed
+)
+
+// StockReservation holds units of a product or variant for an unpaid online
+// order so they are not sold to someone else meanwhile. An active reservation
+// stops holding stock once ExpiresAt has passed.
+type StockReservation struct {
+	gorm.Model
+	OrderID     uint       `gorm:"index;not null" json:"order_id"`
+	OrderItemID uint       `gorm:"index" json:"order_item_id"`
+	ProductID   uint       `gorm:"index;not null" json:"product_id"`
+	VariantID   *uint      `gorm:"index" json:"variant_id,omitempty"`
+	Quantity    int        `json:"quantity"`
+	Status      string     `gorm:"type:varchar(20);index;default:'active'" json:"status"`
+	ExpiresAt   time.Time  `gorm:"index" json:"expires_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"` // When it was converted or released
+}
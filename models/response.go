@@ -13,6 +13,23 @@ type ProductResponse struct {
 	Category           CategoryResponse `json:"category"`
 	Store              StoreResponse    `json:"store"`
 	Images             []string         `json:"images"` // List of image URLs
+	AverageRating      float64          `json:"average_rating"`
+	RatingCount        int              `json:"rating_count"`
+	Options            []ProductOption  `json:"options,omitempty"`
+	Variants           []VariantResponse `json:"variants,omitempty"`
+}
+
+// VariantResponse is a variant of a product as shoppers see it
+type VariantResponse struct {
+	ID                 uint     `json:"id"`
+	SKU                string   `json:"sku"`
+	Label              string   `json:"label"`
+	OptionValueIDs     []uint   `json:"option_value_ids"`
+	Price              float64  `json:"price"`
+	DiscountedPrice    *float64 `json:"discounted_price,omitempty"`
+	DiscountPercentage *float64 `json:"discount_percentage,omitempty"`
+	StockQuantity      int      `json:"stock_quantity"`
+	Images             []string `json:"images"`
 }
 type CategoryResponse struct {
 	ID            uint               `json:"id"`
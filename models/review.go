@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+const (
+	ReviewStatusPublished = "published"
+	ReviewStatusHidden    = "hidden" // taken down by an admin
+)
+
+// ReviewableItemStatuses are the order item statuses that let a customer
+// review the product
+var ReviewableItemStatuses = []string{OrderStatusDelivered, OrderStatusCompleted}
+
+// Review is a customer's rating of a product they received. A customer has
+// one review per product and edits it instead of posting another.
+type Review struct {
+	ID             uint          `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+	ProductID      uint          `gorm:"uniqueIndex:idx_review_product_user;not null" json:"product_id"`
+	UserID         uint          `gorm:"uniqueIndex:idx_review_product_user;not null" json:"user_id"`
+	User           *User         `gorm:"foreignKey:UserID" json:"-"`
+	OrderItemID    uint          `gorm:"not null" json:"order_item_id"` // The delivered item that verifies the purchase
+	Rating         int           `gorm:"not null;check:rating BETWEEN 1 AND 5" json:"rating"`
+	Comment        string        `gorm:"type:text" json:"comment"`
+	Status         string        `gorm:"type:varchar(20);default:'published';index" json:"status"`
+	Images         []ReviewImage `gorm:"foreignKey:ReviewID;constraint:OnDelete:CASCADE" json:"images"`
+	VendorReply    string        `gorm:"type:text" json:"vendor_reply,omitempty"`
+	RepliedAt      *time.Time    `json:"replied_at,omitempty"`
+	ModerationNote string        `json:"moderation_note,omitempty"` // Why an admin hid the review
+	ModeratedAt    *time.Time    `json:"moderated_at,omitempty"`
+}
+
+// ReviewImage is a photo attached to a review
+type ReviewImage struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	ReviewID uint   `gorm:"index;not null" json:"review_id"`
+	URL      string `json:"url"`
+}
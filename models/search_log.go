@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// SearchLog is one call of the product search. Clicks and add-to-carts that
+// came from the results are recorded on it to measure conversion.
+type SearchLog struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	CreatedAt       time.Time  `gorm:"index" json:"created_at"`
+	UserID          *uint      `gorm:"index" json:"user_id,omitempty"`
+	ClientKey       string     `gorm:"type:varchar(64);index" json:"-"` // Visitor that searched, see visitorKey
+	Query           string     `gorm:"type:varchar(200)" json:"query"`
+	NormalizedQuery string     `gorm:"type:varchar(100);index" json:"normalized_query"` // Lowercased with collapsed spaces, what reports group by
+	Filters         string     `gorm:"type:text" json:"filters"`                        // JSON of the applied filters
+	Sort            string     `gorm:"type:varchar(20)" json:"sort"`
+	Page            int        `json:"page"`
+	ResultCount     int64      `json:"result_count"`
+	Fuzzy           bool       `json:"fuzzy"` // Results came from the typo fallback
+	ClickCount      int        `gorm:"default:0" json:"click_count"`
+	FirstClickedAt  *time.Time `json:"first_clicked_at,omitempty"`
+	AddedToCartAt   *time.Time `json:"added_to_cart_at,omitempty"`
+}
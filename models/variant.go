@@ -0,0 +1,57 @@
+package models
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ProductOption is an option type a product comes in, e.g. "Size" with the
+// values S, M and L
+type ProductOption struct {
+	ID        uint                 `gorm:"primarykey" json:"id"`
+	ProductID uint                 `gorm:"index;not null" json:"product_id"`
+	Name      string               `gorm:"type:varchar(50);not null" json:"name"`
+	Position  int                  `json:"position"`
+	Values    []ProductOptionValue `gorm:"foreignKey:OptionID;constraint:OnDelete:CASCADE" json:"values"`
+}
+
+// ProductOptionValue is one value of an option type, e.g. "M"
+type ProductOptionValue struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	OptionID uint   `gorm:"index;not null" json:"option_id"`
+	Value    string `gorm:"type:varchar(50);not null" json:"value"`
+	Position int    `json:"position"`
+}
+
+// ProductVariant is a sellable version of a product with one value for each
+// of its option types. It has its own SKU and stock and can override the
+// product price.
+type ProductVariant struct {
+	gorm.Model
+	ProductID     uint                 `gorm:"index;not null" json:"product_id"`
+	SKU           string               `gorm:"type:varchar(64);uniqueIndex;not null" json:"sku"`
+	Price         *float64             `gorm:"type:decimal(10,2)" json:"price,omitempty"` // Overrides the product price when set
+	StockQuantity int                  `gorm:"default:0" json:"stock_quantity"`
+	IsActive      bool                 `gorm:"default:true" json:"is_active"`
+	Values        []ProductOptionValue `gorm:"many2many:product_variant_values" json:"values"`
+	Images        []Image              `gorm:"foreignKey:VariantID" json:"images,omitempty"`
+}
+
+// UnitPrice is what the variant costs before offers, its own price or the
+// product price
+func (v ProductVariant) UnitPrice(productPrice float64) float64 {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return productPrice
+}
+
+// Label describes the variant by its option values, e.g. "M / Red"
+func (v ProductVariant) Label() string {
+	values := make([]string, len(v.Values))
+	for i, value := range v.Values {
+		values[i] = value.Value
+	}
+	return strings.Join(values, " / ")
+}
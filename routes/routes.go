@@ -1,18 +1,24 @@
 package routes
 
 import (
+	"time"
+
 	"github.com/Ukkenjijo/trendtrek/controllers"
 	"github.com/Ukkenjijo/trendtrek/middleware"
+	"github.com/Ukkenjijo/trendtrek/utils"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 )
 
 func SetUpRoutes(app *fiber.App) {
 
 	admin:=app.Group("/api/v1/admin")
 	admin.Post("/login",controllers.AdminLogin)
+	admin.Post("/token/refresh",controllers.RefreshToken)
 	privateadmin:=app.Group("/api/v1/admin")
 	privateadmin.Use(middleware.JWTMiddleware(),middleware.AdminRoleMiddleware())
 	{
+		privateadmin.Post("/logout",controllers.Logout)
 		privateadmin.Get("/users",controllers.GetAllUsers)
 		privateadmin.Patch("/users/block",controllers.BlockUser)
 		privateadmin.Patch("/users/unblock",controllers.UnblockUser)
@@ -24,6 +30,7 @@ func SetUpRoutes(app *fiber.App) {
 		privateadmin.Patch("/categories/edit/:id",controllers.EditCategory)
 		privateadmin.Delete("/categories/delete/:id",controllers.DeleteCategory)
 		privateadmin.Post("/order/:order_id/status",controllers.UpdateOrderStatus)
+		privateadmin.Get("/order/:order_id",controllers.GetOrderDetailsAdmin)
 
 		privateadmin.Post("/coupons/add",controllers.CreateCoupon)
 		privateadmin.Get("/coupons",controllers.GetAllCoupons)
@@ -32,6 +39,14 @@ func SetUpRoutes(app *fiber.App) {
 		privateadmin.Get("/admin_dashboard/top_products",controllers.GetTopProducts)
 		privateadmin.Get("/admin_dashboard/top_categories",controllers.GetTopCategories)
 		privateadmin.Get("/admin_dashboard/top_sellers",controllers.GetTopSellers)
+		privateadmin.Get("/wallets/reconciliation",controllers.WalletReconciliationReport)
+		privateadmin.Get("/products/featured",controllers.ListFeaturedProductsAdmin)
+		privateadmin.Patch("/products/:id/featured",controllers.SetProductFeatured)
+		privateadmin.Get("/reviews",controllers.ListReviewsAdmin)
+		privateadmin.Patch("/reviews/:id/moderate",controllers.ModerateReview)
+		privateadmin.Get("/search/reports/top-queries",controllers.SearchTopQueries)
+		privateadmin.Get("/search/reports/zero-results",controllers.SearchZeroResultQueries)
+		privateadmin.Get("/search/reports/conversion",controllers.SearchConversionReport)
 
 		
 	}
@@ -40,6 +55,8 @@ func SetUpRoutes(app *fiber.App) {
 
 
 
+	app.Post("/api/v1/payments/razorpay/webhook",controllers.RazorpayWebhook)
+
 	user := app.Group("/api/v1/user")
 	user.Post("/signup", controllers.Signup)        // Signup route
 	user.Post("/forget-password",controllers.ForgetPassword)
@@ -47,19 +64,36 @@ func SetUpRoutes(app *fiber.App) {
 	user.Post("/verify-otp", controllers.VerifyOTP) // OTP verification route
 	user.Post("/resend-otp", controllers.ResendOTP)
 	user.Post("/login",controllers.Login)
+	user.Post("/login/otp",controllers.RequestLoginOTP)
+	user.Post("/login/otp/verify",controllers.LoginWithOTP)
+	user.Post("/token/refresh",controllers.RefreshToken)
 	user.Get("/categories",controllers.GetAllCategories)
 	user.Get("/category/:id",controllers.GetCategoryByID)
 	user.Get("/products",controllers.GetAllProducts)
+	user.Get("/products/featured",controllers.GetFeaturedProducts)
 	user.Get("/stores",controllers.GetAllStores)
 	user.Get("/products/category/:id",controllers.GetProductsByCategory)
 	user.Get("/product/:id",controllers.GetProductbyId)
+	user.Get("/product/:id/reviews",controllers.ListProductReviews)
 	user.Get("/search",controllers.SearchProducts)
+	user.Get("/search/suggest",controllers.SearchSuggestions)
+	user.Get("/search/trending",controllers.TrendingSearches)
+	user.Post("/search/:search_id/click",limiter.New(limiter.Config{Max: 30, Expiration: time.Minute}),controllers.RecordSearchClick)
+	user.Get("/guest-cart",controllers.ListGuestCart)
+	user.Post("/guest-cart/add",controllers.AddToGuestCart)
+	user.Put("/guest-cart/update/:id",controllers.UpdateGuestCartQuantity)
+	user.Delete("/guest-cart/remove/:id",controllers.RemoveFromGuestCart)
 	user.Get("google/login",controllers.GoogleLogin)
 	user.Get("google/callback",controllers.GoogleCallback)
     
 	privateuser:=app.Group("/api/v1/user")
 	privateuser.Use(middleware.JWTMiddleware())
 	{
+		privateuser.Post("logout",controllers.Logout)
+		privateuser.Get("notifications",controllers.ListNotifications)
+		privateuser.Get("notifications/stream",controllers.StreamNotifications)
+		privateuser.Patch("notifications/read-all",controllers.MarkAllNotificationsRead)
+		privateuser.Patch("notifications/:id/read",controllers.MarkNotificationRead)
 		privateuser.Get("myaccount/profile",controllers.GetProfile)
 		privateuser.Patch("myaccount/profile/update",controllers.UpdateProfile)
 		privateuser.Get("myaccount/addresses",controllers.ListAddresses)
@@ -69,24 +103,34 @@ func SetUpRoutes(app *fiber.App) {
 		privateuser.Get("myaccount/getrefferallink",controllers.GenerateReferralLink)
 		privateuser.Get("myaccount/wallet",controllers.GetWalletBallance)
 		privateuser.Get("myaccount/wallet/history",controllers.GetWalletHistory)
+		privateuser.Post("myaccount/wallet/topup",middleware.Idempotency(),controllers.CreateWalletTopUp)
+		privateuser.Post("myaccount/wallet/topup/verify",middleware.Idempotency(),controllers.VerifyWalletTopUp)
 		privateuser.Post("cart/add",controllers.AddToCart)
 		privateuser.Get("cart",controllers.ListCartItems)
 		privateuser.Put("cart/update/:id",controllers.UpdateCartQuantity)
+		privateuser.Post("cart/acknowledge-prices",controllers.AcknowledgeCartPrices)
 		privateuser.Delete("cart/remove/:id",controllers.RemoveFromCart)
 		privateuser.Post("/wishlist/add/:product_id",controllers.AddToWishlist)
 		privateuser.Delete("wishlist/remove/:product_id",controllers.RemoveFromWishlist)
 		privateuser.Get("wishlist",controllers.GetWishlist)
-		privateuser.Post("checkout/orders",controllers.PlaceOrder)
-		privateuser.Post("order/:order_id/retry_payment",controllers.RetryPayment)
+		privateuser.Post("product/:id/reviews",controllers.CreateReview)
+		privateuser.Patch("reviews/:id",controllers.UpdateReview)
+		privateuser.Delete("reviews/:id",controllers.DeleteReview)
+		privateuser.Post("checkout/orders",middleware.Idempotency(),controllers.PlaceOrder)
+		privateuser.Post("order/:order_id/retry_payment",middleware.Idempotency(),controllers.RetryPayment)
 		privateuser.Get("orders",controllers.ListOrders)
 		privateuser.Get("orders/:id",controllers.GetOrderDetails)
 		privateuser.Get("orders/:order_id/invoice",controllers.GenerateInvoicePdf)
+		privateuser.Get("orders/:order_id/invoice/:sub_order_id",controllers.GenerateSubOrderInvoicePdf)
 		privateuser.Put("orders/cancel/:id",controllers.CancelOrder)
 		privateuser.Patch("orders/return/:id", controllers.ReturnOrderItem)
 		privateuser.Post("coupons/apply",controllers.ApplyCoupon)
 		privateuser.Put("coupons/remove",controllers.RemoveCoupon)
 		privateuser.Put("orders/cancel/:order_id/:item_id",controllers.CancelOrderItem)
-		privateuser.Post("payments/razorpay/verify", controllers.VerfyRazorpayPayment)
+		privateuser.Post("payments/razorpay/verify", middleware.Idempotency(), controllers.VerfyRazorpayPayment)
+		if _, ok := controllers.PaymentGateway.(*utils.MockProvider); ok {
+			privateuser.Post("payments/mock/:razorpay_order_id/pay", controllers.MockGatewayPay)
+		}
 		
 
 
@@ -100,10 +144,16 @@ func SetUpRoutes(app *fiber.App) {
 	store.Post("/verify-otp", controllers.VerifyOTP)
 	store.Post("/resend-otp", controllers.ResendOTP)
 	store.Post("/login",controllers.Login)
+	store.Post("/token/refresh",controllers.RefreshToken)
 
 	privatestore := app.Group("/api/v1/vendor")
 	privatestore.Use(middleware.JWTMiddleware(),middleware.SellerRoleMiddleware())
 	{
+		privatestore.Post("/logout",controllers.Logout)
+		privatestore.Get("/notifications",controllers.ListNotifications)
+		privatestore.Get("/notifications/stream",controllers.StreamNotifications)
+		privatestore.Patch("/notifications/read-all",controllers.MarkAllNotificationsRead)
+		privatestore.Patch("/notifications/:id/read",controllers.MarkNotificationRead)
 		privatestore.Post("/products/add",controllers.AddProduct)
 		privatestore.Post("/products/edit/:id",controllers.EditProduct)
 		privatestore.Delete("/products/delete/:id",controllers.DeleteProduct)
@@ -112,11 +162,21 @@ func SetUpRoutes(app *fiber.App) {
 		privatestore.Post("/products/:product_id/offer",controllers.CreateOrUpdateOffer)	
 		privatestore.Delete("/products/:product_id/offer",controllers.DeleteOffer)
 		privatestore.Get("/products/offers",controllers.ListOffers)
+		privatestore.Post("/products/:id/options",controllers.AddProductOption)
+		privatestore.Delete("/products/:id/options/:option_id",controllers.DeleteProductOption)
+		privatestore.Post("/products/:id/variants",controllers.AddProductVariant)
+		privatestore.Patch("/products/:id/variants/:variant_id",controllers.UpdateProductVariant)
+		privatestore.Delete("/products/:id/variants/:variant_id",controllers.DeleteProductVariant)
+		privatestore.Get("/reviews",controllers.ListStoreReviews)
+		privatestore.Post("/reviews/:id/reply",controllers.ReplyToReview)
 		privatestore.Get("myaccount/seller/profile",controllers.GetProfile)
 		privatestore.Patch("myaccount/seller/profile/update",controllers.UpdateProfile)
 		privatestore.Get("myaccount/store/profile",controllers.GetStoreProfile)
 		privatestore.Patch("myaccount/store/profile/update",controllers.UpdateStoreProfile)
 		privatestore.Get("orders",controllers.ListSellerOrders)
+		privatestore.Get("orders/:order_id",controllers.GetSellerOrderDetails)
+		privatestore.Put("orders/:order_id/status",controllers.UpdateSubOrderStatus)
+		privatestore.Get("orders/:order_id/invoice",controllers.GenerateSellerInvoicePdf)
 		privatestore.Put("orders/:order_id/:item_id/status",controllers.UpdateOrderItemStatus)
 		privatestore.Get("sales-report",controllers.GetSalesReport)
 		
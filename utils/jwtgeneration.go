@@ -1,7 +1,11 @@
 package utils
 
 import (
-	"log"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"time"
 
@@ -11,40 +15,69 @@ import (
 
 // Custom claims struct for JWT
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID    uint   `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID uint   `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-   
+// AccessTokenTTL is how long an access token is valid by default. Clients get
+// a new one from the refresh endpoint before it runs out.
+const AccessTokenTTL = 15 * time.Minute
 
-// Load JWT secret key from environment variable
-var jwtSecretKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+// RefreshTokenTTL is how long a session can go unused by default before the
+// user has to log in again
+const RefreshTokenTTL = 30 * 24 * time.Hour
 
-
-// generateJWT generates a JWT token for the authenticated user
-func GenerateJWT(user models.User) (string, error) {
-	// Set expiration time for the token (e.g., 24 hours)
-	expirationTime := time.Now().Add(5 *24 * time.Hour)
+// GenerateJWT generates a short lived access token for a session of the
+// authenticated user
+func GenerateJWT(user models.User, sessionID uint, ttl time.Duration) (string, error) {
+	expirationTime := time.Now().Add(ttl)
 
 	// Create the JWT claims, including the user ID and email
 	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		Role:   string(user.Role),
+		UserID:    user.ID,
+		Email:     user.Email,
+		Role:      string(user.Role),
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime), // Use the new method for expiration
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
-
 	}
 
 	// Create the token with the claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	log.Println("tokengenerated",token)
-	log.Println(jwtSecretKey)
-	
 
 	// Sign the token with the secret key
 	return token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
 }
+
+// GenerateRefreshToken returns a new random refresh token and the hash that
+// is stored for it
+func GenerateRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("refresh token generation failed: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// GenerateGuestCartToken returns a new random token for a guest cart and the
+// hash that is stored for it. Only the hash is kept, like refresh tokens.
+func GenerateGuestCartToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("guest cart token generation failed: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken hashes a refresh token for storage and lookup
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
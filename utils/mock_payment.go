@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// MockProvider is an in-process payment gateway. Orders are kept in memory and
+// paid through Pay, so checkout can run end to end without network access.
+type MockProvider struct {
+	secret   []byte // Signs the checkout and webhook signatures
+	mu       sync.Mutex
+	seq      int
+	orders   map[string]*GatewayPayment
+	payments map[string]string
+	refunds  map[string]*GatewayRefund
+	keys     map[string]string // Refund ids by idempotency key
+}
+
+// NewMockProvider returns an empty mock gateway signing with secret
+func NewMockProvider(secret string) *MockProvider {
+	return &MockProvider{
+		secret:   []byte(secret),
+		orders:   make(map[string]*GatewayPayment),
+		payments: make(map[string]string),
+		refunds:  make(map[string]*GatewayRefund),
+		keys:     make(map[string]string),
+	}
+}
+
+func (p *MockProvider) nextID(prefix string) string {
+	p.seq++
+	return fmt.Sprintf("%s_mock%06d", prefix, p.seq)
+}
+
+func (p *MockProvider) Name() string {
+	return "mock"
+}
+
+func (p *MockProvider) CreateOrder(amount float64, currency, receipt string) (GatewayOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.nextID("order")
+	p.orders[id] = &GatewayPayment{OrderID: id, Status: "created", Amount: amount}
+	return GatewayOrder{ID: id, Amount: amount, Currency: currency, Receipt: receipt}, nil
+}
+
+func (p *MockProvider) VerifyPayment(orderID, paymentID, signature string) bool {
+	return VerifyRazorpaySignature([]byte(orderID+"|"+paymentID), signature, string(p.secret))
+}
+
+func (p *MockProvider) VerifyWebhook(body []byte, signature string) bool {
+	return VerifyRazorpaySignature(body, signature, string(p.secret))
+}
+
+func (p *MockProvider) CapturePayment(paymentID string, amount float64, currency string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.payments[paymentID]; !ok {
+		return ErrGatewayNotFound
+	}
+	return nil
+}
+
+func (p *MockProvider) Refund(paymentID string, amount float64, key string) (GatewayRefund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id, ok := p.keys[key]; ok {
+		return *p.refunds[id], nil
+	}
+	orderID, ok := p.payments[paymentID]
+	if !ok {
+		return GatewayRefund{}, ErrGatewayNotFound
+	}
+	if amount <= 0 || amount > p.orders[orderID].Amount {
+		return GatewayRefund{}, fmt.Errorf("invalid refund amount %.2f", amount)
+	}
+	refund := &GatewayRefund{ID: p.nextID("rfnd"), PaymentID: paymentID, Amount: amount, Status: "pending"}
+	p.refunds[refund.ID] = refund
+	p.keys[key] = refund.ID
+	return *refund, nil
+}
+
+// FetchRefund reports a mock refund as pending the first time it is fetched
+// and as processed after that, like a gateway settling it between polls
+func (p *MockProvider) FetchRefund(refundID string) (GatewayRefund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	refund, ok := p.refunds[refundID]
+	if !ok {
+		return GatewayRefund{}, ErrGatewayNotFound
+	}
+	result := *refund
+	refund.Status = "processed"
+	return result, nil
+}
+
+func (p *MockProvider) FetchStatus(orderID string) (GatewayPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	order, ok := p.orders[orderID]
+	if !ok {
+		return GatewayPayment{}, ErrGatewayNotFound
+	}
+	return *order, nil
+}
+
+// Pay simulates the customer paying a mock order. It returns the payment id
+// and the signature the client would send to the verify endpoint.
+func (p *MockProvider) Pay(orderID string) (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	order, ok := p.orders[orderID]
+	if !ok {
+		return "", "", ErrGatewayNotFound
+	}
+	if order.Status != "paid" {
+		order.PaymentID = p.nextID("pay")
+		order.Status = "paid"
+		p.payments[order.PaymentID] = orderID
+	}
+	return order.PaymentID, p.Sign([]byte(orderID + "|" + order.PaymentID)), nil
+}
+
+// Sign signs a payload the way the mock provider expects, for building
+// checkout callbacks and webhook requests in tests
+func (p *MockProvider) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
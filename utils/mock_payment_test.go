@@ -0,0 +1,81 @@
+package utils
+
+import "testing"
+
+func TestMockProviderPayAndVerify(t *testing.T) {
+	provider := NewMockProvider("test_secret")
+	order, err := provider.CreateOrder(1000, "INR", "order_1")
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	paymentID, signature, err := provider.Pay(order.ID)
+	if err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if !provider.VerifyPayment(order.ID, paymentID, signature) {
+		t.Fatal("VerifyPayment rejected the signature returned by Pay")
+	}
+	if NewMockProvider("other_secret").VerifyPayment(order.ID, paymentID, signature) {
+		t.Fatal("VerifyPayment accepted a signature made with another secret")
+	}
+
+	status, err := provider.FetchStatus(order.ID)
+	if err != nil {
+		t.Fatalf("FetchStatus: %v", err)
+	}
+	if status.Status != "paid" || status.PaymentID != paymentID {
+		t.Fatalf("FetchStatus = %+v, want paid by %s", status, paymentID)
+	}
+}
+
+func TestMockProviderRefundIsIdempotent(t *testing.T) {
+	provider := NewMockProvider("test_secret")
+	order, _ := provider.CreateOrder(1000, "INR", "order_1")
+	paymentID, _, _ := provider.Pay(order.ID)
+
+	first, err := provider.Refund(paymentID, 400, "refund_1")
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	again, err := provider.Refund(paymentID, 400, "refund_1")
+	if err != nil {
+		t.Fatalf("Refund with the same key: %v", err)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("Refund with the same key issued %s, want %s", again.ID, first.ID)
+	}
+	other, err := provider.Refund(paymentID, 100, "refund_2")
+	if err != nil {
+		t.Fatalf("Refund with a new key: %v", err)
+	}
+	if other.ID == first.ID {
+		t.Fatal("Refund with a new key returned the earlier refund")
+	}
+	if _, err := provider.Refund("pay_unknown", 100, "refund_3"); err != ErrGatewayNotFound {
+		t.Fatalf("Refund of an unknown payment = %v, want ErrGatewayNotFound", err)
+	}
+}
+
+func TestNewPaymentProviderMockNeedsDevEnv(t *testing.T) {
+	tests := []struct {
+		env, secret string
+		ok          bool
+	}{
+		{"", "secret", false},
+		{"production", "secret", false},
+		{"test", "", false},
+		{"test", "secret", true},
+		{"development", "secret", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("APP_ENV", tt.env)
+		t.Setenv("MOCK_PAYMENT_SECRET", tt.secret)
+		provider, err := NewPaymentProvider("mock")
+		if tt.ok && (err != nil || provider.Name() != "mock") {
+			t.Errorf("APP_ENV=%q MOCK_PAYMENT_SECRET=%q: got %v, want the mock provider", tt.env, tt.secret, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("APP_ENV=%q MOCK_PAYMENT_SECRET=%q: the mock provider was allowed", tt.env, tt.secret)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification channel names
+const (
+	NotificationChannelEmail = "email"
+	NotificationChannelSMS   = "sms"
+)
+
+// NotificationMessage is a rendered notification ready to be delivered
+type NotificationMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// NotificationChannel delivers messages over one medium. See SMTPChannel,
+// LogChannel and SMSChannel.
+type NotificationChannel interface {
+	Send(msg NotificationMessage) error
+}
+
+// SMTPChannel sends emails through the SMTP server set in SMTP_HOST,
+// SMTP_PORT, SMTP_USER and SMTP_PASS. Messages with an HTML body are sent as
+// multipart/alternative with the text body as fallback.
+type SMTPChannel struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+}
+
+// NewSMTPChannel returns an SMTPChannel configured from the environment
+func NewSMTPChannel() *SMTPChannel {
+	return &SMTPChannel{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		User:     os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+	}
+}
+
+func (s *SMTPChannel) Send(msg NotificationMessage) error {
+	var b strings.Builder
+	b.WriteString("From: " + s.User + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+		b.WriteString(msg.Text + "\r\n")
+	} else {
+		boundary := fmt.Sprintf("trendtrek-%d", time.Now().UnixNano())
+		b.WriteString("Content-Type: multipart/alternative; boundary=" + boundary + "\r\n\r\n")
+		b.WriteString("--" + boundary + "\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" + msg.Text + "\r\n")
+		b.WriteString("--" + boundary + "\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n" + msg.HTML + "\r\n")
+		b.WriteString("--" + boundary + "--\r\n")
+	}
+
+	auth := smtp.PlainAuth("", s.User, s.Password, s.Host)
+	return smtp.SendMail(s.Host+":"+s.Port, auth, s.User, []string{msg.To}, []byte(b.String()))
+}
+
+// LogChannel writes messages to a file instead of delivering them, for local
+// development. With no path it writes to the log.
+type LogChannel struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (l *LogChannel) Send(msg NotificationMessage) error {
+	entry := fmt.Sprintf("---- %s\nTo: %s\nSubject: %s\n\n%s\n", time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Text)
+	if l.Path == "" {
+		log.Print(entry)
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry)
+	return err
+}
+
+// SMSChannel is a placeholder until an SMS provider is chosen. It logs the
+// text body of each message.
+type SMSChannel struct{}
+
+func (SMSChannel) Send(msg NotificationMessage) error {
+	log.Printf("SMS to %s: %s", msg.To, msg.Text)
+	return nil
+}
+
+// NewEmailChannel returns the email channel named by NOTIFY_EMAIL_CHANNEL,
+// "smtp" (default) or "log". The log channel writes to NOTIFY_LOG_FILE when
+// it is set.
+func NewEmailChannel() NotificationChannel {
+	if os.Getenv("NOTIFY_EMAIL_CHANNEL") == "log" {
+		return &LogChannel{Path: os.Getenv("NOTIFY_LOG_FILE")}
+	}
+	return NewSMTPChannel()
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Each notification has a <name>.txt template defining "subject" and "text"
+// and may have a <name>.html template defining "content", which is rendered
+// inside layout.html
+//
+//go:embed templates/notifications/*
+var notificationTemplates embed.FS
+
+const notificationTemplateDir = "templates/notifications/"
+
+// RenderNotification renders the named notification template with data
+func RenderNotification(name string, data interface{}) (subject, text, html string, err error) {
+	textTmpl, err := texttemplate.ParseFS(notificationTemplates, notificationTemplateDir+name+".txt")
+	if err != nil {
+		return "", "", "", fmt.Errorf("notification template %s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", "", err
+	}
+	subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := textTmpl.ExecuteTemplate(&buf, "text", data); err != nil {
+		return "", "", "", err
+	}
+	text = strings.TrimSpace(buf.String())
+
+	htmlTmpl, err := htmltemplate.ParseFS(notificationTemplates, notificationTemplateDir+"layout.html", notificationTemplateDir+name+".html")
+	if err != nil {
+		// Text only notification
+		return subject, text, "", nil
+	}
+	buf.Reset()
+	if err := htmlTmpl.ExecuteTemplate(&buf, "layout", map[string]interface{}{"Subject": subject, "Data": data}); err != nil {
+		return "", "", "", err
+	}
+	return subject, text, buf.String(), nil
+}
+
+// Notifier queues notifications in the outbox and delivers them over the
+// registered channels, retrying failed sends with a growing delay
+type Notifier struct {
+	DB          *gorm.DB
+	Channels    map[string]NotificationChannel
+	MaxAttempts int
+}
+
+// NewNotifier returns a Notifier on db with the email channel from the
+// environment and the SMS stub
+func NewNotifier(db *gorm.DB) *Notifier {
+	return &Notifier{
+		DB: db,
+		Channels: map[string]NotificationChannel{
+			NotificationChannelEmail: NewEmailChannel(),
+			NotificationChannelSMS:   SMSChannel{},
+		},
+		MaxAttempts: int(config.GetFloat("NOTIFY_MAX_ATTEMPTS", 5)),
+	}
+}
+
+// Enqueue renders a notification and adds it to the outbox in tx, so it is
+// only sent when tx commits. It runs in a savepoint: a notification that
+// cannot be queued is logged and never fails tx.
+func (n *Notifier) Enqueue(tx *gorm.DB, channel, recipient, template string, data interface{}) {
+	if recipient == "" {
+		return
+	}
+	subject, text, html, err := RenderNotification(template, data)
+	if err != nil {
+		log.Printf("Failed to render %s notification: %v", template, err)
+		return
+	}
+	msg := models.OutboxMessage{
+		Channel:       channel,
+		Recipient:     recipient,
+		Template:      template,
+		Subject:       subject,
+		TextBody:      text,
+		HTMLBody:      html,
+		Status:        models.OutboxStatusPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Transaction(func(sp *gorm.DB) error {
+		return sp.Create(&msg).Error
+	}); err != nil {
+		log.Printf("Failed to queue %s notification to %s: %v", template, recipient, err)
+	}
+}
+
+// SendNow renders a notification and delivers it straight away without going
+// through the outbox. It is for messages that must not be stored, like OTPs,
+// and is not retried.
+func (n *Notifier) SendNow(channel, recipient, template string, data interface{}) error {
+	subject, text, html, err := RenderNotification(template, data)
+	if err != nil {
+		return err
+	}
+	return n.send(&models.OutboxMessage{Channel: channel, Recipient: recipient, Subject: subject, TextBody: text, HTMLBody: html})
+}
+
+// retryDelay is how long to wait before the next attempt after attempts
+// failed ones
+func retryDelay(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * time.Minute
+}
+
+// outboxClaimLease is how long a dispatcher has to send the messages it
+// claimed before another dispatcher may pick them up
+const outboxClaimLease = 5 * time.Minute
+
+// Dispatch sends the messages that are due and returns how many were sent.
+// Due rows are claimed with SKIP LOCKED, so several instances can dispatch at
+// once, by moving their next attempt past outboxClaimLease. The claim commits
+// before anything is sent so no row stays locked while a channel is slow; a
+// message whose dispatcher dies mid-send is retried when the lease runs out.
+func (n *Notifier) Dispatch() (int, error) {
+	var messages []models.OutboxMessage
+	if err := n.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.OutboxStatusPending, time.Now()).
+			Order("next_attempt_at").Limit(50).Find(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(messages))
+		for i, msg := range messages {
+			ids[i] = msg.ID
+		}
+		return tx.Model(&models.OutboxMessage{}).Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(outboxClaimLease)).Error
+	}); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i := range messages {
+		msg := &messages[i]
+		err := n.send(msg)
+		updates := map[string]interface{}{"attempts": msg.Attempts + 1}
+		if err == nil {
+			now := time.Now()
+			updates["status"] = models.OutboxStatusSent
+			updates["sent_at"] = now
+			updates["last_error"] = ""
+			sent++
+		} else {
+			log.Printf("Failed to send %s notification %d to %s: %v", msg.Channel, msg.ID, msg.Recipient, err)
+			updates["last_error"] = err.Error()
+			if msg.Attempts+1 >= n.MaxAttempts {
+				updates["status"] = models.OutboxStatusFailed
+			} else {
+				updates["next_attempt_at"] = time.Now().Add(retryDelay(msg.Attempts + 1))
+			}
+		}
+		if err := n.DB.Model(msg).Updates(updates).Error; err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func (n *Notifier) send(msg *models.OutboxMessage) error {
+	channel, ok := n.Channels[msg.Channel]
+	if !ok {
+		return errors.New("unknown notification channel " + msg.Channel)
+	}
+	return channel.Send(NotificationMessage{To: msg.Recipient, Subject: msg.Subject, Text: msg.TextBody, HTML: msg.HTMLBody})
+}
+
+// Start dispatches queued messages every interval in the background
+func (n *Notifier) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := n.Dispatch(); err != nil {
+				log.Printf("Failed to dispatch notifications: %v", err)
+			}
+		}
+	}()
+}
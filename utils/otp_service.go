@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/config"
+	"github.com/Ukkenjijo/trendtrek/models"
+)
+
+// OTPPurpose is what an OTP is for. A code sent for one purpose cannot be
+// used for another.
+type OTPPurpose string
+
+const (
+	OTPPurposeSignup        OTPPurpose = "signup"
+	OTPPurposePasswordReset OTPPurpose = "password_reset"
+	OTPPurposeLogin         OTPPurpose = "login"
+)
+
+// ValidOTPPurpose reports whether p is a known purpose
+func ValidOTPPurpose(p OTPPurpose) bool {
+	switch p {
+	case OTPPurposeSignup, OTPPurposePasswordReset, OTPPurposeLogin:
+		return true
+	}
+	return false
+}
+
+var (
+	// ErrOTPInvalid is returned when there is no code to check or the code is
+	// wrong
+	ErrOTPInvalid = errors.New("invalid or expired OTP")
+	// ErrOTPAttemptsExceeded is returned once a code was guessed wrong too
+	// often. A new code has to be requested.
+	ErrOTPAttemptsExceeded = errors.New("too many wrong attempts, request a new OTP")
+)
+
+// OTPCooldownError is returned when a code was requested too soon after the
+// last one
+type OTPCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OTPCooldownError) Error() string {
+	return fmt.Sprintf("please wait %s before requesting another OTP", e.RetryAfter.Round(time.Second))
+}
+
+// OTPService sends and checks one time codes. Handlers use it through this
+// interface so tests can swap in a fake.
+type OTPService interface {
+	// Send creates a new code for email and purpose, replacing any earlier
+	// one, and delivers it. ip is the address of the client asking for it.
+	Send(email string, purpose OTPPurpose, ip string) error
+	// Verify checks code and uses it up when it matches
+	Verify(email string, purpose OTPPurpose, code string) error
+}
+
+// OTPLimits are the sending limits OTPStore.Create enforces
+type OTPLimits struct {
+	EmailCooldown time.Duration // wait between codes to the same email and purpose
+	IPLimit       int           // codes one address can ask for per IPWindow, 0 for no limit
+	IPWindow      time.Duration
+}
+
+// OTPStore keeps issued codes. See GormOTPStore and MemoryOTPStore.
+type OTPStore interface {
+	// Create saves a new code and retires the earlier codes for the same
+	// email and purpose. The limits are checked in the same step, so
+	// concurrent requests cannot both pass them; an *OTPCooldownError is
+	// returned when one is hit.
+	Create(otp *models.OTP, limits OTPLimits) error
+	// Active returns the newest unused code for email and purpose, or nil
+	Active(email, purpose string) (*models.OTP, error)
+	// AddAttempt counts an attempt at a code that has had fewer than max
+	// and returns the new number of attempts, or 0 when none were left
+	AddAttempt(id uint, max int) (int, error)
+	// Consume marks a code used. It returns false when another request used
+	// it first.
+	Consume(id uint) (bool, error)
+}
+
+// OTPSender delivers a code to an email address
+type OTPSender func(email string, purpose OTPPurpose, code string, ttl time.Duration) error
+
+// OTPManager is the OTPService used by the app
+type OTPManager struct {
+	Store         OTPStore
+	Sender        OTPSender
+	TTL           time.Duration // how long a code is valid
+	MaxAttempts   int           // wrong guesses allowed per code
+	EmailCooldown time.Duration // wait between codes to the same email
+	IPLimit       int           // codes one address can ask for per IPWindow
+	IPWindow      time.Duration
+	Secret        []byte // key for hashing codes
+	Now           func() time.Time
+}
+
+// NewOTPService returns an OTPManager on store with limits read from the
+// environment. Codes are emailed.
+func NewOTPService(store OTPStore) *OTPManager {
+	secret := os.Getenv("OTP_SECRET")
+	if secret == "" {
+		secret = os.Getenv("JWT_SECRET_KEY")
+	}
+	return &OTPManager{
+		Store:         store,
+		Sender:        SendOTPForPurpose,
+		TTL:           config.GetDuration("OTP_TTL", 5*time.Minute),
+		MaxAttempts:   int(config.GetFloat("OTP_MAX_ATTEMPTS", 5)),
+		EmailCooldown: config.GetDuration("OTP_EMAIL_COOLDOWN", time.Minute),
+		IPLimit:       int(config.GetFloat("OTP_IP_LIMIT", 10)),
+		IPWindow:      config.GetDuration("OTP_IP_WINDOW", 15*time.Minute),
+		Secret:        []byte(secret),
+		Now:           time.Now,
+	}
+}
+
+func (m *OTPManager) hash(email string, purpose OTPPurpose, code string) string {
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write([]byte(email + "\n" + string(purpose) + "\n" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send implements OTPService
+func (m *OTPManager) Send(email string, purpose OTPPurpose, ip string) error {
+	now := m.Now()
+	code, err := GenerateOTP()
+	if err != nil {
+		return err
+	}
+	otp := models.OTP{
+		Email:     email,
+		Purpose:   string(purpose),
+		CodeHash:  m.hash(email, purpose, code),
+		IPAddress: ip,
+		ExpiresAt: now.Add(m.TTL),
+	}
+	limits := OTPLimits{EmailCooldown: m.EmailCooldown, IPLimit: m.IPLimit, IPWindow: m.IPWindow}
+	if err := m.Store.Create(&otp, limits); err != nil {
+		return err
+	}
+	return m.Sender(email, purpose, code, m.TTL)
+}
+
+// Verify implements OTPService
+func (m *OTPManager) Verify(email string, purpose OTPPurpose, code string) error {
+	otp, err := m.Store.Active(email, string(purpose))
+	if err != nil {
+		return err
+	}
+	if otp == nil || m.Now().After(otp.ExpiresAt) {
+		return ErrOTPInvalid
+	}
+	// Count the attempt before comparing, so concurrent guesses cannot
+	// together go over the limit
+	attempts, err := m.Store.AddAttempt(otp.ID, m.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	if attempts == 0 {
+		return ErrOTPAttemptsExceeded
+	}
+	if !hmac.Equal([]byte(otp.CodeHash), []byte(m.hash(email, purpose, code))) {
+		if attempts >= m.MaxAttempts {
+			return ErrOTPAttemptsExceeded
+		}
+		return ErrOTPInvalid
+	}
+	used, err := m.Store.Consume(otp.ID)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrOTPInvalid
+	}
+	return nil
+}
+
+// SendOTPForPurpose emails a code straight away with a subject that says
+// what it is for
+func SendOTPForPurpose(email string, purpose OTPPurpose, code string, ttl time.Duration) error {
+	subject, text, html, err := RenderNotification("otp", OTPMessageData(purpose, code, ttl))
+	if err != nil {
+		return err
+	}
+	return NewEmailChannel().Send(NotificationMessage{To: email, Subject: subject, Text: text, HTML: html})
+}
+
+// OTPMessageData is the data of the otp notification template
+func OTPMessageData(purpose OTPPurpose, code string, ttl time.Duration) map[string]interface{} {
+	return map[string]interface{}{"Purpose": string(purpose), "Code": code, "TTL": ttl.String()}
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestOTPManager returns an OTPManager on a MemoryOTPStore that keeps the
+// last code sent to every email instead of mailing it
+func newTestOTPManager() (*OTPManager, map[string]string) {
+	sent := make(map[string]string)
+	return &OTPManager{
+		Store: NewMemoryOTPStore(),
+		Sender: func(email string, purpose OTPPurpose, code string, ttl time.Duration) error {
+			sent[email] = code
+			return nil
+		},
+		TTL:           5 * time.Minute,
+		MaxAttempts:   3,
+		EmailCooldown: time.Minute,
+		IPLimit:       2,
+		IPWindow:      15 * time.Minute,
+		Secret:        []byte("test_secret"),
+		Now:           time.Now,
+	}, sent
+}
+
+func TestOTPManagerSendAndVerify(t *testing.T) {
+	m, sent := newTestOTPManager()
+	if err := m.Send("a@example.com", OTPPurposeSignup, "10.0.0.1"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	code := sent["a@example.com"]
+	if len(code) == 0 {
+		t.Fatal("Send did not deliver a code")
+	}
+
+	if err := m.Verify("a@example.com", OTPPurposePasswordReset, code); err != ErrOTPInvalid {
+		t.Fatalf("Verify for another purpose = %v, want ErrOTPInvalid", err)
+	}
+	if err := m.Verify("a@example.com", OTPPurposeSignup, "wrong"); err != ErrOTPInvalid {
+		t.Fatalf("Verify with a wrong code = %v, want ErrOTPInvalid", err)
+	}
+	if err := m.Verify("a@example.com", OTPPurposeSignup, code); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := m.Verify("a@example.com", OTPPurposeSignup, code); err != ErrOTPInvalid {
+		t.Fatalf("Verify of a used code = %v, want ErrOTPInvalid", err)
+	}
+}
+
+func TestOTPManagerExpiredCode(t *testing.T) {
+	m, sent := newTestOTPManager()
+	if err := m.Send("a@example.com", OTPPurposeLogin, ""); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	m.Now = func() time.Time { return time.Now().Add(m.TTL + time.Second) }
+	if err := m.Verify("a@example.com", OTPPurposeLogin, sent["a@example.com"]); err != ErrOTPInvalid {
+		t.Fatalf("Verify of an expired code = %v, want ErrOTPInvalid", err)
+	}
+}
+
+func TestOTPManagerAttemptsLimit(t *testing.T) {
+	m, sent := newTestOTPManager()
+	if err := m.Send("a@example.com", OTPPurposeSignup, ""); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := []error{ErrOTPInvalid, ErrOTPInvalid, ErrOTPAttemptsExceeded, ErrOTPAttemptsExceeded}
+	for i, wantErr := range want {
+		if err := m.Verify("a@example.com", OTPPurposeSignup, "wrong"); err != wantErr {
+			t.Fatalf("wrong guess %d = %v, want %v", i+1, err, wantErr)
+		}
+	}
+	if err := m.Verify("a@example.com", OTPPurposeSignup, sent["a@example.com"]); err != ErrOTPAttemptsExceeded {
+		t.Fatalf("Verify after too many guesses = %v, want ErrOTPAttemptsExceeded", err)
+	}
+}
+
+func TestOTPManagerSendLimits(t *testing.T) {
+	m, _ := newTestOTPManager()
+	var cooldown *OTPCooldownError
+
+	if err := m.Send("a@example.com", OTPPurposeSignup, "10.0.0.1"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	err := m.Send("a@example.com", OTPPurposeSignup, "10.0.0.9")
+	if !errors.As(err, &cooldown) || cooldown.RetryAfter <= 0 || cooldown.RetryAfter > m.EmailCooldown {
+		t.Fatalf("Send again within the cooldown = %v, want an OTPCooldownError", err)
+	}
+	if err := m.Send("a@example.com", OTPPurposeLogin, "10.0.0.9"); err != nil {
+		t.Fatalf("Send for another purpose: %v", err)
+	}
+
+	if err := m.Send("b@example.com", OTPPurposeSignup, "10.0.0.1"); err != nil {
+		t.Fatalf("Send from the same address: %v", err)
+	}
+	err = m.Send("c@example.com", OTPPurposeSignup, "10.0.0.1")
+	if !errors.As(err, &cooldown) || cooldown.RetryAfter != m.IPWindow {
+		t.Fatalf("Send over the address limit = %v, want an OTPCooldownError", err)
+	}
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Ukkenjijo/trendtrek/models"
+	"gorm.io/gorm"
+)
+
+// otpRetention is how long codes are kept after they were sent. They are
+// only needed that long for the cooldown and per address limits.
+const otpRetention = 24 * time.Hour
+
+// GormOTPStore keeps codes in the database so they survive restarts and are
+// shared between instances
+type GormOTPStore struct {
+	DB *gorm.DB
+}
+
+// NewGormOTPStore returns an OTPStore on db
+func NewGormOTPStore(db *gorm.DB) *GormOTPStore {
+	return &GormOTPStore{DB: db}
+}
+
+func (s *GormOTPStore) Create(otp *models.OTP, limits OTPLimits) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		// Requests for the same email and purpose, then from the same
+		// address, wait for each other here so the limits below cannot be
+		// passed twice
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "otp:"+otp.Email+"\n"+otp.Purpose).Error; err != nil {
+			return err
+		}
+		limitIP := otp.IPAddress != "" && limits.IPLimit > 0
+		if limitIP {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "otp-ip:"+otp.IPAddress).Error; err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		var last models.OTP
+		err := tx.Select("created_at").Where("email = ? AND purpose = ?", otp.Email, otp.Purpose).
+			Order("created_at DESC").First(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if wait := limits.EmailCooldown - now.Sub(last.CreatedAt); err == nil && wait > 0 {
+			return &OTPCooldownError{RetryAfter: wait}
+		}
+		if limitIP {
+			var sent int64
+			if err := tx.Model(&models.OTP{}).Where("ip_address = ? AND created_at >= ?", otp.IPAddress, now.Add(-limits.IPWindow)).Count(&sent).Error; err != nil {
+				return err
+			}
+			if sent >= int64(limits.IPLimit) {
+				return &OTPCooldownError{RetryAfter: limits.IPWindow}
+			}
+		}
+
+		// Forget codes that are no longer needed
+		if err := tx.Where("created_at < ?", time.Now().Add(-otpRetention)).Delete(&models.OTP{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.OTP{}).
+			Where("email = ? AND purpose = ? AND consumed_at IS NULL", otp.Email, otp.Purpose).
+			Update("consumed_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(otp).Error
+	})
+}
+
+func (s *GormOTPStore) Active(email, purpose string) (*models.OTP, error) {
+	var otp models.OTP
+	err := s.DB.Where("email = ? AND purpose = ? AND consumed_at IS NULL", email, purpose).
+		Order("created_at DESC").First(&otp).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &otp, nil
+}
+
+func (s *GormOTPStore) AddAttempt(id uint, max int) (int, error) {
+	var attempts int
+	err := s.DB.Raw("UPDATE otps SET attempts = attempts + 1 WHERE id = ? AND attempts < ? RETURNING attempts", id, max).Scan(&attempts).Error
+	return attempts, err
+}
+
+func (s *GormOTPStore) Consume(id uint) (bool, error) {
+	// Only one request can flip consumed_at, so a code cannot be used twice
+	result := s.DB.Model(&models.OTP{}).Where("id = ? AND consumed_at IS NULL", id).Update("consumed_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// MemoryOTPStore keeps codes in memory. It is meant for tests and a single
+// local instance.
+type MemoryOTPStore struct {
+	mu     sync.Mutex
+	nextID uint
+	otps   []*models.OTP
+}
+
+// NewMemoryOTPStore returns an empty MemoryOTPStore
+func NewMemoryOTPStore() *MemoryOTPStore {
+	return &MemoryOTPStore{}
+}
+
+func (s *MemoryOTPStore) Create(otp *models.OTP, limits OTPLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var last time.Time
+	var sent int
+	for _, o := range s.otps {
+		if o.Email == otp.Email && o.Purpose == otp.Purpose && o.CreatedAt.After(last) {
+			last = o.CreatedAt
+		}
+		if o.IPAddress == otp.IPAddress && !o.CreatedAt.Before(now.Add(-limits.IPWindow)) {
+			sent++
+		}
+	}
+	if wait := limits.EmailCooldown - now.Sub(last); !last.IsZero() && wait > 0 {
+		return &OTPCooldownError{RetryAfter: wait}
+	}
+	if otp.IPAddress != "" && limits.IPLimit > 0 && sent >= limits.IPLimit {
+		return &OTPCooldownError{RetryAfter: limits.IPWindow}
+	}
+
+	kept := s.otps[:0]
+	for _, o := range s.otps {
+		if o.CreatedAt.Before(now.Add(-otpRetention)) {
+			continue
+		}
+		if o.Email == otp.Email && o.Purpose == otp.Purpose && o.ConsumedAt == nil {
+			o.ConsumedAt = &now
+		}
+		kept = append(kept, o)
+	}
+	s.nextID++
+	otp.ID = s.nextID
+	otp.CreatedAt = now
+	stored := *otp
+	s.otps = append(kept, &stored)
+	return nil
+}
+
+func (s *MemoryOTPStore) Active(email, purpose string) (*models.OTP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.otps) - 1; i >= 0; i-- {
+		o := s.otps[i]
+		if o.Email == email && o.Purpose == purpose && o.ConsumedAt == nil {
+			found := *o
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryOTPStore) find(id uint) *models.OTP {
+	for _, o := range s.otps {
+		if o.ID == id {
+			return o
+		}
+	}
+	return nil
+}
+
+func (s *MemoryOTPStore) AddAttempt(id uint, max int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.find(id)
+	if o == nil || o.Attempts >= max {
+		return 0, nil
+	}
+	o.Attempts++
+	return o.Attempts, nil
+}
+
+func (s *MemoryOTPStore) Consume(id uint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.find(id)
+	if o == nil || o.ConsumedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	o.ConsumedAt = &now
+	return true, nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+
+	"github.com/razorpay/razorpay-go"
+)
+
+// VerifyRazorpaySignature checks a Razorpay HMAC-SHA256 signature of message.
+// Checkout callbacks sign "order_id|payment_id" with the key secret and
+// webhooks sign the raw request body with the webhook secret.
+func VerifyRazorpaySignature(message []byte, signature string, secret string) bool {
+	if secret == "" || signature == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(message)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// RazorpayProvider takes payments through Razorpay
+type RazorpayProvider struct {
+	client        *razorpay.Client
+	secret        string
+	webhookSecret string
+}
+
+// NewRazorpayProvider creates a Razorpay provider from the RAZORPAY_KEY,
+// RAZORPAY_SECRET and RAZORPAY_WEBHOOK_SECRET environment variables
+func NewRazorpayProvider() *RazorpayProvider {
+	return &RazorpayProvider{
+		client:        razorpay.NewClient(os.Getenv("RAZORPAY_KEY"), os.Getenv("RAZORPAY_SECRET")),
+		secret:        os.Getenv("RAZORPAY_SECRET"),
+		webhookSecret: os.Getenv("RAZORPAY_WEBHOOK_SECRET"),
+	}
+}
+
+func (p *RazorpayProvider) Name() string {
+	return "razorpay"
+}
+
+func (p *RazorpayProvider) CreateOrder(amount float64, currency, receipt string) (GatewayOrder, error) {
+	// Razorpay expects the amount in paise
+	options := map[string]interface{}{
+		"amount":          toPaise(amount),
+		"currency":        currency,
+		"receipt":         receipt,
+		"payment_capture": 1,
+	}
+	order, err := p.client.Order.Create(options, nil)
+	if err != nil {
+		return GatewayOrder{}, err
+	}
+	id, _ := order["id"].(string)
+	return GatewayOrder{ID: id, Amount: amount, Currency: currency, Receipt: receipt}, nil
+}
+
+func (p *RazorpayProvider) VerifyPayment(orderID, paymentID, signature string) bool {
+	return VerifyRazorpaySignature([]byte(orderID+"|"+paymentID), signature, p.secret)
+}
+
+func (p *RazorpayProvider) VerifyWebhook(body []byte, signature string) bool {
+	return VerifyRazorpaySignature(body, signature, p.webhookSecret)
+}
+
+func (p *RazorpayProvider) CapturePayment(paymentID string, amount float64, currency string) error {
+	_, err := p.client.Payment.Capture(paymentID, toPaise(amount), map[string]interface{}{"currency": currency}, nil)
+	return err
+}
+
+// Refund sends key as the refund receipt. A refund of the payment with that
+// receipt is returned as is, so a retry after a lost response does not refund
+// twice.
+func (p *RazorpayProvider) Refund(paymentID string, amount float64, key string) (GatewayRefund, error) {
+	existing, err := p.client.Payment.FetchMultipleRefund(paymentID, map[string]interface{}{"count": 100}, nil)
+	if err != nil {
+		return GatewayRefund{}, err
+	}
+	items, _ := existing["items"].([]interface{})
+	for _, item := range items {
+		refund, _ := item.(map[string]interface{})
+		if receipt, _ := refund["receipt"].(string); receipt == key {
+			id, _ := refund["id"].(string)
+			status, _ := refund["status"].(string)
+			return GatewayRefund{ID: id, PaymentID: paymentID, Amount: fromPaise(refund["amount"]), Status: status}, nil
+		}
+	}
+
+	refund, err := p.client.Payment.Refund(paymentID, toPaise(amount), map[string]interface{}{"receipt": key}, nil)
+	if err != nil {
+		return GatewayRefund{}, err
+	}
+	id, _ := refund["id"].(string)
+	status, _ := refund["status"].(string)
+	return GatewayRefund{ID: id, PaymentID: paymentID, Amount: fromPaise(refund["amount"]), Status: status}, nil
+}
+
+func (p *RazorpayProvider) FetchRefund(refundID string) (GatewayRefund, error) {
+	refund, err := p.client.Refund.Fetch(refundID, nil, nil)
+	if err != nil {
+		return GatewayRefund{}, err
+	}
+	paymentID, _ := refund["payment_id"].(string)
+	status, _ := refund["status"].(string)
+	return GatewayRefund{ID: refundID, PaymentID: paymentID, Amount: fromPaise(refund["amount"]), Status: status}, nil
+}
+
+func (p *RazorpayProvider) FetchStatus(orderID string) (GatewayPayment, error) {
+	order, err := p.client.Order.Fetch(orderID, nil, nil)
+	if err != nil {
+		return GatewayPayment{}, err
+	}
+	status, _ := order["status"].(string)
+	result := GatewayPayment{OrderID: orderID, Status: status, Amount: fromPaise(order["amount_paid"])}
+	if status != "paid" {
+		return result, nil
+	}
+
+	// Find the captured payment so it can be refunded later
+	payments, err := p.client.Order.Payments(orderID, nil, nil)
+	if err != nil {
+		return GatewayPayment{}, err
+	}
+	items, _ := payments["items"].([]interface{})
+	for _, item := range items {
+		payment, _ := item.(map[string]interface{})
+		if payment["status"] == "captured" {
+			result.PaymentID, _ = payment["id"].(string)
+			break
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,380 @@
+package utils
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// SuggestionKind is what a suggestion points to
+type SuggestionKind string
+
+const (
+	SuggestionProduct  SuggestionKind = "product"
+	SuggestionCategory SuggestionKind = "category"
+	SuggestionStore    SuggestionKind = "store"
+	SuggestionQuery    SuggestionKind = "query"
+)
+
+// Suggestion is one entry of the type-ahead index. Weight ranks entries that
+// match equally well, e.g. product popularity or how often a query was run.
+type Suggestion struct {
+	Kind   SuggestionKind `json:"kind"`
+	ID     uint           `json:"id,omitempty"`
+	Text   string         `json:"text"`
+	Weight float64        `json:"-"`
+}
+
+// SuggestionLoader returns everything the index should hold
+type SuggestionLoader func() ([]Suggestion, error)
+
+// Match qualities, a whole prefix beats a word prefix beats a typo
+const (
+	matchFuzzy  = 1.0
+	matchWord   = 2.0
+	matchPrefix = 3.0
+)
+
+// maxTrackedQueries caps how many distinct queries are counted in memory
+const maxTrackedQueries = 10000
+
+type suggestEntry struct {
+	Suggestion
+	norm string
+}
+
+type indexToken struct {
+	token   string
+	entries []int
+}
+
+// SuggestIndex answers type-ahead lookups from memory. Entries are kept
+// sorted so prefix lookups are binary searches; typos are matched by edit
+// distance against the words of all entries.
+type SuggestIndex struct {
+	mu      sync.RWMutex
+	entries []suggestEntry
+	tokens  []indexToken // sorted by token
+	queries map[string]*Suggestion
+
+	loader SuggestionLoader
+	dirty  chan struct{}
+}
+
+// NewSuggestIndex returns an empty index filled by loader
+func NewSuggestIndex(loader SuggestionLoader) *SuggestIndex {
+	return &SuggestIndex{
+		queries: make(map[string]*Suggestion),
+		loader:  loader,
+		dirty:   make(chan struct{}, 1),
+	}
+}
+
+// NormalizeQuery lowercases s and collapses its whitespace
+func NormalizeQuery(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// TruncateRunes shortens s to at most n characters without splitting one
+func TruncateRunes(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// words splits normalized text into words
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// Rebuild reloads every entry from the loader
+func (x *SuggestIndex) Rebuild() error {
+	suggestions, err := x.loader()
+	if err != nil {
+		return err
+	}
+	entries := make([]suggestEntry, 0, len(suggestions))
+	for _, s := range suggestions {
+		if s.Kind == SuggestionQuery {
+			continue
+		}
+		if norm := NormalizeQuery(s.Text); norm != "" {
+			entries = append(entries, suggestEntry{Suggestion: s, norm: norm})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].norm < entries[j].norm })
+
+	byToken := make(map[string][]int)
+	for i, entry := range entries {
+		for _, word := range words(entry.norm) {
+			if list := byToken[word]; len(list) == 0 || list[len(list)-1] != i {
+				byToken[word] = append(list, i)
+			}
+		}
+	}
+	tokens := make([]indexToken, 0, len(byToken))
+	for token, list := range byToken {
+		tokens = append(tokens, indexToken{token: token, entries: list})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].token < tokens[j].token })
+
+	// Queries come from the loader too so they survive restarts
+	queries := make(map[string]*Suggestion)
+	for _, s := range suggestions {
+		if s.Kind != SuggestionQuery {
+			continue
+		}
+		if norm := NormalizeQuery(s.Text); norm != "" {
+			q := s
+			q.Text = norm
+			queries[norm] = &q
+		}
+	}
+
+	x.mu.Lock()
+	x.entries, x.tokens = entries, tokens
+	if len(queries) > 0 {
+		x.queries = queries
+	}
+	x.mu.Unlock()
+	return nil
+}
+
+// Invalidate asks the background loop to rebuild the index soon
+func (x *SuggestIndex) Invalidate() {
+	select {
+	case x.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Start builds the index and keeps it fresh, rebuilding shortly after
+// Invalidate and every interval in case another instance changed the data
+func (x *SuggestIndex) Start(interval time.Duration) {
+	if err := x.Rebuild(); err != nil {
+		log.Printf("Failed to build suggestion index: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-x.dirty:
+				// Let a burst of changes and their transaction settle
+				time.Sleep(500 * time.Millisecond)
+				select {
+				case <-x.dirty:
+				default:
+				}
+			case <-ticker.C:
+			}
+			if err := x.Rebuild(); err != nil {
+				log.Printf("Failed to rebuild suggestion index: %v", err)
+			}
+		}
+	}()
+}
+
+// RecordQuery counts a search so it can be suggested to others
+func (x *SuggestIndex) RecordQuery(text string) {
+	norm := NormalizeQuery(text)
+	if norm == "" || len(norm) > 100 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if q, ok := x.queries[norm]; ok {
+		q.Weight++
+		return
+	}
+	if len(x.queries) >= maxTrackedQueries {
+		return
+	}
+	x.queries[norm] = &Suggestion{Kind: SuggestionQuery, Text: norm, Weight: 1}
+}
+
+// Suggest returns up to limit entries of each kind matching text, best first.
+// Past queries need at least minQueryCount searches to be suggested.
+func (x *SuggestIndex) Suggest(text string, limit int, minQueryCount float64) map[SuggestionKind][]Suggestion {
+	norm := NormalizeQuery(text)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	result := map[SuggestionKind][]Suggestion{
+		SuggestionProduct:  {},
+		SuggestionCategory: {},
+		SuggestionStore:    {},
+		SuggestionQuery:    x.popularQueries(norm, limit, minQueryCount),
+	}
+	if norm == "" {
+		return result
+	}
+
+	scores := make(map[int]float64)
+	add := func(i int, quality float64) {
+		if quality > scores[i] {
+			scores[i] = quality
+		}
+	}
+	// The whole text is a prefix of the entry
+	start := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].norm >= norm })
+	for i := start; i < len(x.entries) && strings.HasPrefix(x.entries[i].norm, norm); i++ {
+		add(i, matchPrefix)
+	}
+
+	// Every typed word starts a word of the entry, the last one may be
+	// incomplete
+	typed := words(norm)
+	if len(typed) > 0 {
+		var matched map[int]bool
+		for n, word := range typed {
+			found := x.tokenMatches(word, n == len(typed)-1)
+			if matched == nil {
+				matched = found
+				continue
+			}
+			for i := range matched {
+				if !found[i] {
+					delete(matched, i)
+				}
+			}
+		}
+		for i := range matched {
+			add(i, matchWord)
+		}
+	}
+
+	// Fall back to typos on the last word when there are few matches
+	if len(scores) < limit && len(typed) > 0 {
+		last := typed[len(typed)-1]
+		if maxEdits := allowedEdits(last); maxEdits > 0 {
+			for _, token := range x.tokens {
+				if fuzzyPrefix(last, token.token, maxEdits) {
+					for _, i := range token.entries {
+						add(i, matchFuzzy)
+					}
+				}
+			}
+		}
+	}
+
+	ranked := make([]int, 0, len(scores))
+	for i := range scores {
+		ranked = append(ranked, i)
+	}
+	sort.Slice(ranked, func(a, b int) bool {
+		ea, eb := x.entries[ranked[a]], x.entries[ranked[b]]
+		if scores[ranked[a]] != scores[ranked[b]] {
+			return scores[ranked[a]] > scores[ranked[b]]
+		}
+		if ea.Weight != eb.Weight {
+			return ea.Weight > eb.Weight
+		}
+		return ea.norm < eb.norm
+	})
+	for _, i := range ranked {
+		entry := x.entries[i]
+		if len(result[entry.Kind]) < limit {
+			result[entry.Kind] = append(result[entry.Kind], entry.Suggestion)
+		}
+	}
+	return result
+}
+
+// tokenMatches returns the entries with a word equal to word, or starting
+// with it when prefix is set
+func (x *SuggestIndex) tokenMatches(word string, prefix bool) map[int]bool {
+	found := make(map[int]bool)
+	start := sort.Search(len(x.tokens), func(i int) bool { return x.tokens[i].token >= word })
+	for i := start; i < len(x.tokens); i++ {
+		token := x.tokens[i].token
+		if token != word && (!prefix || !strings.HasPrefix(token, word)) {
+			break
+		}
+		for _, entry := range x.tokens[i].entries {
+			found[entry] = true
+		}
+	}
+	return found
+}
+
+// popularQueries returns the most run past queries starting with norm
+func (x *SuggestIndex) popularQueries(norm string, limit int, minCount float64) []Suggestion {
+	queries := []Suggestion{}
+	for text, q := range x.queries {
+		if q.Weight >= minCount && strings.HasPrefix(text, norm) {
+			queries = append(queries, *q)
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Weight != queries[j].Weight {
+			return queries[i].Weight > queries[j].Weight
+		}
+		return queries[i].Text < queries[j].Text
+	})
+	if len(queries) > limit {
+		queries = queries[:limit]
+	}
+	return queries
+}
+
+// allowedEdits is how many typos a word of this length may have
+func allowedEdits(word string) int {
+	switch n := len([]rune(word)); {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// fuzzyPrefix reports whether some prefix of token is within maxEdits edits
+// of word
+func fuzzyPrefix(word, token string, maxEdits int) bool {
+	a, b := []rune(word), []rune(token)
+	if len(b) < len(a)-maxEdits {
+		return false
+	}
+	// Levenshtein rows of word against growing prefixes of token
+	prev := make([]int, len(a)+1)
+	cur := make([]int, len(a)+1)
+	for i := range prev {
+		prev[i] = i
+	}
+	if prev[len(a)] <= maxEdits {
+		return true
+	}
+	for j := 1; j <= len(b) && j <= len(a)+maxEdits; j++ {
+		cur[0] = j
+		best := cur[0]
+		for i := 1; i <= len(a); i++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[i] = min(prev[i]+1, cur[i-1]+1, prev[i-1]+cost)
+			if cur[i] < best {
+				best = cur[i]
+			}
+		}
+		if cur[len(a)] <= maxEdits {
+			return true
+		}
+		// No prefix can come back within reach
+		if best > maxEdits {
+			return false
+		}
+		prev, cur = cur, prev
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package utils
+
+import "testing"
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"shirt", 10, "shirt"},
+		{"shirt", 3, "shi"},
+		{"café au lait", 4, "café"},
+		{"日本語の服", 3, "日本語"},
+		{"", 5, ""},
+	}
+	for _, tt := range tests {
+		if got := TruncateRunes(tt.in, tt.n); got != tt.want {
+			t.Errorf("TruncateRunes(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+// UploadURL returns the public URL of a file saved under ./uploads/dir. The
+// host comes from PUBLIC_BASE_URL.
+func UploadURL(dir, fileName string) string {
+	base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		base = "https://jijoshibuukken.website"
+	}
+	return fmt.Sprintf("%s/uploads/%s/%s", base, dir, fileName)
+}
+
+// RemoveFiles deletes uploaded files whose database change was rolled back
+func RemoveFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to remove upload %s: %v", path, err)
+		}
+	}
+}